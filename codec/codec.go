@@ -0,0 +1,65 @@
+package codec
+
+import (
+	"encoding/json"
+	"fmt"
+	"google.golang.org/protobuf/proto"
+	"reflect"
+)
+
+var typeOfProtoMessage = reflect.TypeOf((*proto.Message)(nil)).Elem()
+
+// JsonMarshal
+//
+//	@Description: json编码
+//	@param recv
+//	@return []byte
+//	@return error
+func JsonMarshal(recv any) ([]byte, error) {
+	return json.Marshal(recv)
+}
+
+// JsonUnmarshal
+//
+//	@Description: json解码
+//	@param in
+//	@param recv 接收结果的指针
+//	@return error
+func JsonUnmarshal(in []byte, recv any) error {
+	return json.Unmarshal(in, recv)
+}
+
+// PbMarshal
+//
+//	@Description: protobuf编码
+//	@param recv 必须是proto.Message
+//	@return []byte
+//	@return error
+func PbMarshal(recv any) ([]byte, error) {
+	message, ok := recv.(proto.Message)
+	if !ok {
+		return nil, fmt.Errorf("%T is not a proto.Message", recv)
+	}
+	return proto.Marshal(message)
+}
+
+// PbUnmarshal
+//
+//	@Description: protobuf解码
+//	@param in
+//	@param recv proto.Message，或者指向proto.Message的指针（为nil时自动创建）
+//	@return error
+func PbUnmarshal(in []byte, recv any) error {
+	if message, ok := recv.(proto.Message); ok {
+		return proto.Unmarshal(in, message)
+	}
+	//  服务方法的入参一般是*pb.Xxx，这里拿到的是**pb.Xxx
+	v := reflect.ValueOf(recv)
+	if v.Kind() != reflect.Pointer || v.IsNil() || v.Elem().Kind() != reflect.Pointer || !v.Elem().Type().Implements(typeOfProtoMessage) {
+		return fmt.Errorf("%T is not a proto.Message", recv)
+	}
+	if v.Elem().IsNil() {
+		v.Elem().Set(reflect.New(v.Elem().Type().Elem()))
+	}
+	return proto.Unmarshal(in, v.Elem().Interface().(proto.Message))
+}
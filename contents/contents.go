@@ -3,13 +3,46 @@ package contents
 import go_log "github.com/yuhao-jack/go-log"
 
 const (
-	Register      = "REGISTER"
-	DisCover      = "DISCOVER"
-	OK            = "OK"
-	ALive         = "ALIVE"
-	Default       = "DEFAULT"
-	ConnectClosed = "CONNECT_CLOSED"
+	Register       = "REGISTER"
+	DisCover       = "DISCOVER"
+	OK             = "OK"
+	ALive          = "ALIVE"
+	Default        = "DEFAULT"
+	ConnectClosed  = "CONNECT_CLOSED"
+	Watch          = "WATCH"
+	DeRegister     = "DEREGISTER"
+	MarkDown       = "MARK_DOWN"       //集群的副本把服务断开连接转发给主节点
+	ClusterSync    = "CLUSTER_SYNC"    //集群的副本向主节点拉取所有服务信息
+	ClusterEvent   = "CLUSTER_EVENT"   //集群的主节点向副本同步服务变化和心跳
+	ClusterVote    = "CLUSTER_VOTE"    //集群的候选节点向其它节点请求投票
+	GetConfig      = "GET_CONFIG"      //读取配置，元信息里可以指定版本
+	WatchConfig    = "WATCH_CONFIG"    //订阅配置，配置变化后以同样的命令推送
+	PushConfig     = "PUSH_CONFIG"     //发布新版本的配置
+	RollbackConfig = "ROLLBACK_CONFIG" //把配置回滚到之前的版本，回滚后的内容作为新版本发布
+	Cancel         = "CANCEL"          //调用方放弃了调用，消息序号为要取消的调用的序号，服务端不回复
 )
+
+// ForwardedBy 集群的副本转发给主节点的消息在元信息里带上副本的地址
+const ForwardedBy = "forwarded_by"
+
+// DefaultNamespace 服务没有指定命名空间时所在的命名空间
+const DefaultNamespace = "default"
+
+// 发现和订阅服务时在元信息里指定服务所在的命名空间和环境
+const (
+	Namespace = "namespace"
+	Env       = "env"
+	Selector  = "selector" //发现服务时按标签筛选 eg:version=2, zone in (a,b), status=UP
+)
+
+// ConfigVersion 读取配置时在元信息里指定版本，为空时读取最新版本
+const ConfigVersion = "config_version"
+
+// ConfigToken 发布和回滚配置时在元信息里带上的令牌
+const ConfigToken = "config_token"
+
+// RevokedLeases 续约的回复在元信息里带上被管理员强制下线的租约ID，多个用逗号分隔
+const RevokedLeases = "revoked_leases"
 const (
 	Json = "json"
 	Pb   = "pb"
@@ -32,8 +65,30 @@ type ServiceStatus string
 func (k ServiceStatus) String() string { return string(k) }
 
 const (
-	Up   ServiceStatus = "UP"
-	Down ServiceStatus = "DOWN"
+	Up       ServiceStatus = "UP"
+	Down     ServiceStatus = "DOWN"
+	Draining ServiceStatus = "DRAINING" //服务即将下线，不再接收新的调用
+	Disabled ServiceStatus = "DISABLED" //被管理员停用，重新注册也不会恢复，需要管理员重新启用
+)
+
+type ServiceEventType string
+
+func (k ServiceEventType) String() string { return string(k) }
+
+const (
+	ServiceAdd    ServiceEventType = "ADD"    //新注册的服务
+	ServiceUpdate ServiceEventType = "UPDATE" //服务信息或者状态有变化
+	ServiceRemove ServiceEventType = "REMOVE" //服务从注册中心移除
+)
+
+type ConnState string
+
+func (k ConnState) String() string { return string(k) }
+
+const (
+	Connected    ConnState = "CONNECTED"    //连接正常
+	Disconnected ConnState = "DISCONNECTED" //连接断开，正在重连
+	Closed       ConnState = "CLOSED"       //客户端已关闭
 )
 
 type AdditionalMetaKey string
@@ -44,3 +99,29 @@ const (
 	LostTime AdditionalMetaKey = "lost_time"
 	Status   AdditionalMetaKey = "status"
 )
+
+type BalanceStrategy string
+
+func (k BalanceStrategy) String() string { return string(k) }
+
+const (
+	RoundRobin       BalanceStrategy = "round_robin"       //轮询
+	Random           BalanceStrategy = "random"            //随机
+	Weighted         BalanceStrategy = "weighted"          //按附加元信息里的weight加权随机
+	LeastOutstanding BalanceStrategy = "least_outstanding" //选择未完成调用最少的
+	P2C              BalanceStrategy = "p2c"               //随机选两个，取未完成调用少的
+	ConsistentHash   BalanceStrategy = "consistent_hash"   //按调用的路由键一致性哈希，没有路由键时随机
+)
+
+// Weight 服务附加元信息里的权重，没有设置或者不合法时为1
+const Weight AdditionalMetaKey = "weight"
+
+type CircuitState string
+
+func (k CircuitState) String() string { return string(k) }
+
+const (
+	CircuitClosed   CircuitState = "CLOSED"    //正常调用，统计失败率和慢调用比例
+	CircuitOpen     CircuitState = "OPEN"      //熔断，调用直接失败，负载均衡时跳过
+	CircuitHalfOpen CircuitState = "HALF_OPEN" //熔断一段时间后放少量调用探测是否恢复
+)
@@ -1,7 +1,163 @@
 package errorx
 
-import "errors"
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// Code
+// @Description: 调用的状态码
+type Code int32
+
+const (
+	OK                Code = 0 //成功
+	UnknownCommand    Code = 1 //未知命令
+	BadRequest        Code = 2 //请求不合法，如入参无法解析
+	Internal          Code = 3 //服务端内部错误
+	Unavailable       Code = 4 //服务不可用，如连接断开、没有可用的服务节点
+	DeadlineExceeded  Code = 5 //调用超时
+	Canceled          Code = 6 //调用方取消了调用
+	UnsupportedProtoc Code = 7 //没有对应的编码协议，详情里带有对方支持的协议
+	NotFound          Code = 8 //请求的资源不存在，如配置或者配置的版本不存在
+	PermissionDenied  Code = 9 //没有权限，如发布配置时没有带正确的令牌
+)
+
+var codeNames = map[Code]string{
+	OK:                "OK",
+	UnknownCommand:    "UNKNOWN_COMMAND",
+	BadRequest:        "BAD_REQUEST",
+	Internal:          "INTERNAL",
+	Unavailable:       "UNAVAILABLE",
+	DeadlineExceeded:  "DEADLINE_EXCEEDED",
+	Canceled:          "CANCELED",
+	UnsupportedProtoc: "UNSUPPORTED_PROTOC",
+	NotFound:          "NOT_FOUND",
+	PermissionDenied:  "PERMISSION_DENIED",
+}
+
+func (c Code) String() string {
+	if name, ok := codeNames[c]; ok {
+		return name
+	}
+	return fmt.Sprintf("CODE(%d)", int32(c))
+}
+
+// StatusError
+// @Description: 带状态码的错误，会原样在网络上传输给调用方
+type StatusError struct {
+	Code    Code              `json:"code"`              //状态码
+	Message string            `json:"message"`           //错误信息
+	Details map[string]string `json:"details,omitempty"` //错误详情
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
+
+// Is
+//
+//	@Description: 状态码相同即认为是同一个错误，方便调用方使用errors.Is判断
+//	@receiver e
+//	@param target
+//	@return bool
+func (e *StatusError) Is(target error) bool {
+	t, ok := target.(*StatusError)
+	return ok && t.Code == e.Code
+}
+
+// DetailUnsent 请求没有发出时错误详情里带有这个key，这样的调用即使不是幂等的也可以安全重试
+const DetailUnsent = "unsent"
+
+// New
+//
+//	@Description: 创建带状态码的错误
+//	@param code 状态码
+//	@param format 错误信息
+//	@param args
+//	@return *StatusError
+func New(code Code, format string, args ...any) *StatusError {
+	return &StatusError{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+// FromError
+//
+//	@Description: 把任意错误转换为带状态码的错误，非StatusError的错误视为服务端内部错误
+//	@param err
+//	@return *StatusError
+func FromError(err error) *StatusError {
+	return WithCode(Internal, err)
+}
+
+// WithCode
+//
+//	@Description: 把任意错误转换为带状态码的错误，已经是StatusError的错误保留原来的状态码
+//	@param code 非StatusError的错误使用的状态码
+//	@param err
+//	@return *StatusError
+func WithCode(code Code, err error) *StatusError {
+	if err == nil {
+		return nil
+	}
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		return statusErr
+	}
+	return &StatusError{Code: code, Message: err.Error()}
+}
+
+// FromContextError
+//
+//	@Description: 把context的错误转换为带状态码的错误
+//	@param err ctx.Err()
+//	@return *StatusError
+func FromContextError(err error) *StatusError {
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, context.DeadlineExceeded):
+		return &StatusError{Code: DeadlineExceeded, Message: err.Error()}
+	case errors.Is(err, context.Canceled):
+		return &StatusError{Code: Canceled, Message: err.Error()}
+	}
+	return FromError(err)
+}
+
+// CodeOf
+//
+//	@Description: 获取错误的状态码
+//	@param err
+//	@return Code
+func CodeOf(err error) Code {
+	if err == nil {
+		return OK
+	}
+	return FromError(err).Code
+}
+
+// Unsent
+//
+//	@Description: 标记请求没有发出，如连接不可用、没有可用的服务节点
+//	@param err
+//	@return *StatusError 带有DetailUnsent的副本
+func Unsent(err *StatusError) *StatusError {
+	details := map[string]string{DetailUnsent: "true"}
+	for k, v := range err.Details {
+		details[k] = v
+	}
+	return &StatusError{Code: err.Code, Message: err.Message, Details: details}
+}
+
+// IsUnsent
+//
+//	@Description: 请求是否确定没有发出
+//	@param err
+//	@return bool
+func IsUnsent(err error) bool {
+	var statusErr *StatusError
+	return errors.As(err, &statusErr) && statusErr.Details[DetailUnsent] == "true"
+}
 
 var (
-	UnknownCommandErr = errors.New(" unknown command")
+	UnknownCommandErr = New(UnknownCommand, "unknown command")
 )
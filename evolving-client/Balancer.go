@@ -0,0 +1,159 @@
+package evolving_client
+
+import (
+	"fmt"
+	"github.com/yuhao-jack/evolving-rpc/contents"
+	"github.com/yuhao-jack/evolving-rpc/model"
+	"math/rand"
+	"strconv"
+	"sync/atomic"
+)
+
+// Instance
+// @Description: 负载均衡的候选服务实例
+type Instance struct {
+	Info   *model.ServiceInfo // 服务信息，不能修改
+	Client *EvolvingClient    // 到服务的连接，还没有连上时为nil，这样的实例不会交给负载均衡器
+	dialed chan struct{}      // 第一次连接结束后关闭，不管是否连上
+}
+
+// PickInfo
+// @Description: 选择服务实例时调用的信息
+type PickInfo struct {
+	Command    string      // 调用的命令
+	RoutingKey string      // 调用方通过WithRoutingKey指定的路由键，没有指定时为空
+	Members    []*Instance // 服务的所有实例，包括还没有连上、已经熔断和这次调用已经调用过的，不能修改
+}
+
+// Balancer
+// @Description: 负载均衡器，每个服务各用一个，需要支持并发调用
+type Balancer interface {
+	// Pick
+	//
+	//	@Description: 从候选服务实例中选择一个
+	//	@param info 调用的信息
+	//	@param instances 候选服务实例，至少有一个，不能修改
+	//	@return *Instance 选中的服务实例
+	Pick(info PickInfo, instances []*Instance) *Instance
+}
+
+// NewBalancer
+//
+//	@Description: 按策略创建内置的负载均衡器
+//	@param strategy 负载均衡策略
+//	@return Balancer
+//	@return error 没有这个策略时的错误信息
+func NewBalancer(strategy contents.BalanceStrategy) (Balancer, error) {
+	switch strategy {
+	case contents.RoundRobin:
+		return &roundRobinBalancer{}, nil
+	case contents.Random:
+		return randomBalancer{}, nil
+	case contents.Weighted:
+		return weightedBalancer{}, nil
+	case contents.LeastOutstanding:
+		return leastOutstandingBalancer{}, nil
+	case contents.P2C:
+		return p2cBalancer{}, nil
+	case contents.ConsistentHash:
+		return NewConsistentHashBalancer(0), nil
+	}
+	return nil, fmt.Errorf("unknown balance strategy %s", strategy)
+}
+
+// roundRobinBalancer
+// @Description: 轮询
+type roundRobinBalancer struct {
+	next uint64
+}
+
+func (b *roundRobinBalancer) Pick(info PickInfo, instances []*Instance) *Instance {
+	return instances[(atomic.AddUint64(&b.next, 1)-1)%uint64(len(instances))]
+}
+
+// randomBalancer
+// @Description: 随机
+type randomBalancer struct{}
+
+func (randomBalancer) Pick(info PickInfo, instances []*Instance) *Instance {
+	return instances[rand.Intn(len(instances))]
+}
+
+// weightedBalancer
+// @Description: 按附加元信息里的weight加权随机，权重为0的实例只在其它实例的权重也都为0时才会被选中
+type weightedBalancer struct{}
+
+func (weightedBalancer) Pick(info PickInfo, instances []*Instance) *Instance {
+	total := 0
+	for _, instance := range instances {
+		total += weightOf(instance.Info)
+	}
+	if total == 0 {
+		return instances[rand.Intn(len(instances))]
+	}
+	n := rand.Intn(total)
+	for _, instance := range instances {
+		if n -= weightOf(instance.Info); n < 0 {
+			return instance
+		}
+	}
+	return instances[len(instances)-1]
+}
+
+// weightOf
+//
+//	@Description: 获取服务的权重
+//	@param info 服务信息
+//	@return int 没有设置或者不合法时为1
+func weightOf(info *model.ServiceInfo) int {
+	value, ok := info.AdditionalMeta[contents.Weight.String()]
+	if !ok {
+		return 1
+	}
+	weight, err := strconv.Atoi(fmt.Sprint(value))
+	if err != nil || weight < 0 {
+		return 1
+	}
+	return weight
+}
+
+// leastOutstandingBalancer
+// @Description: 选择未完成调用最少的，一样多时随机选一个
+type leastOutstandingBalancer struct{}
+
+func (leastOutstandingBalancer) Pick(info PickInfo, instances []*Instance) *Instance {
+	var picked *Instance
+	least, count := 0, 0
+	for _, instance := range instances {
+		outstanding := instance.Client.Outstanding()
+		switch {
+		case picked == nil || outstanding < least:
+			picked, least, count = instance, outstanding, 1
+		case outstanding == least:
+			//  蓄水池抽样，一样多的实例被选中的概率相同
+			if count++; rand.Intn(count) == 0 {
+				picked = instance
+			}
+		}
+	}
+	return picked
+}
+
+// p2cBalancer
+// @Description: 随机选两个实例，取未完成调用少的
+type p2cBalancer struct{}
+
+func (p2cBalancer) Pick(info PickInfo, instances []*Instance) *Instance {
+	if len(instances) == 1 {
+		return instances[0]
+	}
+	i := rand.Intn(len(instances))
+	j := rand.Intn(len(instances) - 1)
+	if j >= i {
+		j++
+	}
+	if instances[j].Client.Outstanding() < instances[i].Client.Outstanding() {
+		return instances[j]
+	}
+	return instances[i]
+}
@@ -0,0 +1,48 @@
+package evolving_client
+
+// callOptions
+// @Description: 单次调用的选项
+type callOptions struct {
+	protoc     string // 入参和结果的编码协议
+	routingKey string // 负载均衡的路由键
+}
+
+// CallOption
+// @Description: 单次调用的选项设置
+type CallOption func(o *callOptions)
+
+// WithProtoc
+//
+//	@Description: 指定本次调用的编码协议
+//	@param protoc 编码协议 eg:contents.Json contents.Pb
+//	@return CallOption
+func WithProtoc(protoc string) CallOption {
+	return func(o *callOptions) {
+		o.protoc = protoc
+	}
+}
+
+// WithRoutingKey
+//
+//	@Description: 指定调用的路由键，一致性哈希负载均衡时同一个路由键的调用总是发给同一个服务实例
+//	@param key 路由键 eg:分片键、用户ID
+//	@return CallOption
+func WithRoutingKey(key string) CallOption {
+	return func(o *callOptions) {
+		o.routingKey = key
+	}
+}
+
+// newCallOptions
+//
+//	@Description: 合并调用选项
+//	@param defaultProtoc 客户端默认的编码协议
+//	@param opts
+//	@return *callOptions
+func newCallOptions(defaultProtoc string, opts []CallOption) *callOptions {
+	o := &callOptions{protoc: defaultProtoc}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
@@ -0,0 +1,365 @@
+package evolving_client
+
+import (
+	"github.com/yuhao-jack/evolving-rpc/contents"
+	"github.com/yuhao-jack/evolving-rpc/errorx"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CircuitBreakerConfig
+// @Description: 熔断器的配置，每个服务实例的每个方法各用一个熔断器
+type CircuitBreakerConfig struct {
+	WindowSize            int           // 统计最近多少次调用，为0时为20
+	MinRequests           int           // 窗口内至少有多少次调用才判断是否熔断，为0时为10
+	FailureRateThreshold  float64       // 失败率达到多少时熔断，为0时为0.5
+	SlowCallDuration      time.Duration // 耗时超过多少算慢调用，为0时不统计慢调用
+	SlowCallRateThreshold float64       // 慢调用比例达到多少时熔断，为0时为0.5
+	OpenDuration          time.Duration // 熔断多久后进入半开状态，为0时为5s
+	HalfOpenRequests      int           // 半开时放过的探测调用数，都成功后恢复，有一个失败就继续熔断，为0时为1
+	FailureCodes          []errorx.Code // 哪些状态码的错误算失败，为空时为errorx.Unavailable errorx.DeadlineExceeded errorx.Internal
+	// OnStateChange 熔断器状态变化时的回调 addr:服务实例的地址 command:方法
+	OnStateChange func(addr, command string, from, to contents.CircuitState)
+}
+
+// withDefaults
+//
+//	@Description: 补全没有设置的配置
+//	@receiver conf
+//	@return *CircuitBreakerConfig
+func (conf CircuitBreakerConfig) withDefaults() *CircuitBreakerConfig {
+	if conf.WindowSize <= 0 {
+		conf.WindowSize = 20
+	}
+	if conf.MinRequests <= 0 {
+		conf.MinRequests = 10
+	}
+	if conf.MinRequests > conf.WindowSize {
+		conf.MinRequests = conf.WindowSize
+	}
+	if conf.FailureRateThreshold <= 0 {
+		conf.FailureRateThreshold = 0.5
+	}
+	if conf.SlowCallRateThreshold <= 0 {
+		conf.SlowCallRateThreshold = 0.5
+	}
+	if conf.OpenDuration <= 0 {
+		conf.OpenDuration = 5 * time.Second
+	}
+	if conf.HalfOpenRequests <= 0 {
+		conf.HalfOpenRequests = 1
+	}
+	if len(conf.FailureCodes) == 0 {
+		conf.FailureCodes = []errorx.Code{errorx.Unavailable, errorx.DeadlineExceeded, errorx.Internal}
+	}
+	return &conf
+}
+
+// isFailure
+//
+//	@Description: 调用的错误是否算失败
+//	@receiver conf
+//	@param err
+//	@return bool
+func (conf *CircuitBreakerConfig) isFailure(err error) bool {
+	code := errorx.CodeOf(err)
+	for _, c := range conf.FailureCodes {
+		if c == code {
+			return true
+		}
+	}
+	return false
+}
+
+// circuitBreaker
+// @Description: 一个服务实例的一个方法的熔断器，按最近的调用结果统计失败率和慢调用比例
+type circuitBreaker struct {
+	addr      string
+	command   string
+	conf      *CircuitBreakerConfig
+	lock      sync.Mutex
+	state     contents.CircuitState
+	failed    []bool // 最近调用是否失败，环形缓冲
+	slow      []bool // 最近调用是否是慢调用，环形缓冲
+	next      int
+	count     int
+	failures  int
+	slowCalls int
+	openedAt  time.Time
+	probing   int // 半开时正在进行的探测调用数
+	probed    int // 半开时已经成功的探测调用数
+}
+
+func newCircuitBreaker(addr, command string, conf *CircuitBreakerConfig) *circuitBreaker {
+	return &circuitBreaker{
+		addr:    addr,
+		command: command,
+		conf:    conf,
+		state:   contents.CircuitClosed,
+		failed:  make([]bool, conf.WindowSize),
+		slow:    make([]bool, conf.WindowSize),
+	}
+}
+
+// available
+//
+//	@Description: 负载均衡时是否可以选择，不占用半开时的探测名额
+//	@receiver b
+//	@return bool
+func (b *circuitBreaker) available() bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	switch b.state {
+	case contents.CircuitOpen:
+		return time.Since(b.openedAt) >= b.conf.OpenDuration
+	case contents.CircuitHalfOpen:
+		return b.probing < b.conf.HalfOpenRequests
+	}
+	return true
+}
+
+// allow
+//
+//	@Description: 调用前检查是否放过，熔断时间到了之后进入半开状态，半开时占用一个探测名额
+//	@receiver b
+//	@return bool
+func (b *circuitBreaker) allow() bool {
+	b.lock.Lock()
+	from := b.state
+	allowed := true
+	switch b.state {
+	case contents.CircuitOpen:
+		if time.Since(b.openedAt) < b.conf.OpenDuration {
+			allowed = false
+			break
+		}
+		b.state, b.probing, b.probed = contents.CircuitHalfOpen, 1, 0
+	case contents.CircuitHalfOpen:
+		if allowed = b.probing < b.conf.HalfOpenRequests; allowed {
+			b.probing++
+		}
+	}
+	to := b.state
+	b.lock.Unlock()
+	b.notify(from, to)
+	return allowed
+}
+
+// onResult
+//
+//	@Description: 记录调用结果并按阈值切换状态，调用方取消的调用不统计
+//	@receiver b
+//	@param err 调用的错误信息
+//	@param elapsed 调用的耗时
+func (b *circuitBreaker) onResult(err error, elapsed time.Duration) {
+	failed := b.conf.isFailure(err)
+	slow := b.conf.SlowCallDuration > 0 && elapsed >= b.conf.SlowCallDuration
+	b.lock.Lock()
+	from := b.state
+	switch b.state {
+	case contents.CircuitHalfOpen:
+		if b.probing > 0 {
+			//  熔断前发出的调用在半开时才返回，没有占用探测名额
+			b.probing--
+		}
+		switch {
+		case errorx.CodeOf(err) == errorx.Canceled:
+		case failed || slow:
+			b.openLocked()
+		default:
+			if b.probed++; b.probed >= b.conf.HalfOpenRequests {
+				b.state = contents.CircuitClosed
+				b.resetLocked()
+			}
+		}
+	case contents.CircuitClosed:
+		if errorx.CodeOf(err) == errorx.Canceled {
+			break
+		}
+		b.recordLocked(failed, slow)
+		if b.count >= b.conf.MinRequests && b.tripLocked() {
+			b.openLocked()
+		}
+	}
+	to := b.state
+	b.lock.Unlock()
+	b.notify(from, to)
+}
+
+// recordLocked
+//
+//	@Description: 把调用结果加入统计窗口，窗口满了之后覆盖最早的结果
+//	@receiver b
+//	@param failed 是否失败
+//	@param slow 是否是慢调用
+func (b *circuitBreaker) recordLocked(failed, slow bool) {
+	if b.count == len(b.failed) {
+		if b.failed[b.next] {
+			b.failures--
+		}
+		if b.slow[b.next] {
+			b.slowCalls--
+		}
+	} else {
+		b.count++
+	}
+	b.failed[b.next], b.slow[b.next] = failed, slow
+	if failed {
+		b.failures++
+	}
+	if slow {
+		b.slowCalls++
+	}
+	b.next = (b.next + 1) % len(b.failed)
+}
+
+// tripLocked
+//
+//	@Description: 失败率或者慢调用比例是否达到阈值
+//	@receiver b
+//	@return bool
+func (b *circuitBreaker) tripLocked() bool {
+	if float64(b.failures) >= b.conf.FailureRateThreshold*float64(b.count) {
+		return true
+	}
+	return b.conf.SlowCallDuration > 0 && float64(b.slowCalls) >= b.conf.SlowCallRateThreshold*float64(b.count)
+}
+
+// openLocked
+//
+//	@Description: 熔断并清空统计窗口
+//	@receiver b
+func (b *circuitBreaker) openLocked() {
+	b.state, b.openedAt = contents.CircuitOpen, time.Now()
+	b.resetLocked()
+}
+
+// resetLocked
+//
+//	@Description: 清空统计窗口
+//	@receiver b
+func (b *circuitBreaker) resetLocked() {
+	for i := range b.failed {
+		b.failed[i], b.slow[i] = false, false
+	}
+	b.next, b.count, b.failures, b.slowCalls, b.probing, b.probed = 0, 0, 0, 0, 0, 0
+}
+
+// notify
+//
+//	@Description: 状态变化时回调，在锁外调用，回调里可以查询熔断器
+//	@receiver b
+//	@param from 原来的状态
+//	@param to 新的状态
+func (b *circuitBreaker) notify(from, to contents.CircuitState) {
+	if from != to && b.conf.OnStateChange != nil {
+		b.conf.OnStateChange(b.addr, b.command, from, to)
+	}
+}
+
+// circuitBreakers
+// @Description: 客户端所有服务实例和方法的熔断器
+type circuitBreakers struct {
+	lock     sync.Mutex
+	conf     *CircuitBreakerConfig
+	breakers map[string]*circuitBreaker
+}
+
+func newCircuitBreakers() *circuitBreakers {
+	return &circuitBreakers{breakers: map[string]*circuitBreaker{}}
+}
+
+// setConfig
+//
+//	@Description: 设置熔断器的配置，已有的熔断器全部重新开始统计
+//	@receiver m
+//	@param conf 熔断器的配置，为nil时不熔断
+func (m *circuitBreakers) setConfig(conf *CircuitBreakerConfig) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.conf = nil
+	if conf != nil {
+		m.conf = conf.withDefaults()
+	}
+	m.breakers = map[string]*circuitBreaker{}
+}
+
+// get
+//
+//	@Description: 获取服务实例的方法的熔断器，没有时创建
+//	@receiver m
+//	@param addr 服务实例的地址
+//	@param command 方法
+//	@return *circuitBreaker 没有开启熔断时为nil
+func (m *circuitBreakers) get(addr, command string) *circuitBreaker {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.conf == nil {
+		return nil
+	}
+	key := addr + "/" + command
+	breaker, ok := m.breakers[key]
+	if !ok {
+		breaker = newCircuitBreaker(addr, command, m.conf)
+		m.breakers[key] = breaker
+	}
+	return breaker
+}
+
+// state
+//
+//	@Description: 获取服务实例的方法的熔断器状态
+//	@receiver m
+//	@param addr 服务实例的地址
+//	@param command 方法
+//	@return contents.CircuitState 没有开启熔断或者还没有调用过时为CircuitClosed
+func (m *circuitBreakers) state(addr, command string) contents.CircuitState {
+	m.lock.Lock()
+	breaker := m.breakers[addr+"/"+command]
+	m.lock.Unlock()
+	if breaker == nil {
+		return contents.CircuitClosed
+	}
+	breaker.lock.Lock()
+	defer breaker.lock.Unlock()
+	return breaker.state
+}
+
+// filter
+//
+//	@Description: 去掉方法已经熔断的服务实例
+//	@receiver m
+//	@param instances 候选服务实例
+//	@param command 方法
+//	@return []*Instance 没有开启熔断时为原来的候选服务实例
+func (m *circuitBreakers) filter(instances []*Instance, command string) []*Instance {
+	m.lock.Lock()
+	enabled := m.conf != nil
+	m.lock.Unlock()
+	if !enabled {
+		return instances
+	}
+	var available []*Instance
+	for _, instance := range instances {
+		if breaker := m.get(instance.Info.Addr(), command); breaker == nil || breaker.available() {
+			available = append(available, instance)
+		}
+	}
+	return available
+}
+
+// remove
+//
+//	@Description: 服务实例下线后删除它的熔断器
+//	@receiver m
+//	@param addr 服务实例的地址
+func (m *circuitBreakers) remove(addr string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for key := range m.breakers {
+		if strings.HasPrefix(key, addr+"/") {
+			delete(m.breakers, key)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package evolving_client
+
+import (
+	"hash/fnv"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// defaultVirtualNodes 每个服务实例默认的虚拟节点数
+const defaultVirtualNodes = 160
+
+// ringNode
+// @Description: 哈希环上的虚拟节点
+type ringNode struct {
+	hash uint64
+	addr string // 服务实例的地址
+}
+
+// consistentHashBalancer
+// @Description: 按路由键在哈希环上选择服务实例，环上的位置只由实例的地址决定，
+// 实例加入或者离开时只有相邻的一段路由键会换实例。哈希环由服务的所有实例构建，
+// 实例暂时不能选择时沿顺时针交给下一个能选择的实例，其它路由键不受影响
+type consistentHashBalancer struct {
+	virtualNodes int
+	lock         sync.RWMutex
+	signature    string // 构建哈希环时的所有实例的地址，实例加入或者离开后重新构建
+	ring         []ringNode
+}
+
+// NewConsistentHashBalancer
+//
+//	@Description: 创建一致性哈希负载均衡器，调用通过WithRoutingKey指定路由键，没有路由键的调用随机选择
+//	@param virtualNodes 每个服务实例的虚拟节点数，为0时为160
+//	@return Balancer
+func NewConsistentHashBalancer(virtualNodes int) Balancer {
+	if virtualNodes <= 0 {
+		virtualNodes = defaultVirtualNodes
+	}
+	return &consistentHashBalancer{virtualNodes: virtualNodes}
+}
+
+func (b *consistentHashBalancer) Pick(info PickInfo, instances []*Instance) *Instance {
+	if info.RoutingKey == "" {
+		return instances[rand.Intn(len(instances))]
+	}
+	members := info.Members
+	if len(members) == 0 {
+		members = instances
+	}
+	candidates := make(map[string]*Instance, len(instances))
+	for _, instance := range instances {
+		candidates[instance.Info.Addr()] = instance
+	}
+	ring := b.getRing(members)
+	h := hashOf(info.RoutingKey)
+	i := sort.Search(len(ring), func(i int) bool { return ring[i].hash >= h })
+	for n := 0; n < len(ring); n++ {
+		if instance, ok := candidates[ring[(i+n)%len(ring)].addr]; ok {
+			return instance
+		}
+	}
+	//  候选实例不在服务的实例中，不会发生
+	return instances[rand.Intn(len(instances))]
+}
+
+// getRing
+//
+//	@Description: 获取服务的所有实例对应的哈希环，实例加入或者离开后重新构建
+//	@receiver b
+//	@param members 服务的所有实例
+//	@return []ringNode
+func (b *consistentHashBalancer) getRing(members []*Instance) []ringNode {
+	addrs := make([]string, len(members))
+	for i, instance := range members {
+		addrs[i] = instance.Info.Addr()
+	}
+	sort.Strings(addrs)
+	signature := strings.Join(addrs, ",")
+	b.lock.RLock()
+	if b.signature == signature {
+		defer b.lock.RUnlock()
+		return b.ring
+	}
+	b.lock.RUnlock()
+	ring := make([]ringNode, 0, len(addrs)*b.virtualNodes)
+	for _, addr := range addrs {
+		for v := 0; v < b.virtualNodes; v++ {
+			ring = append(ring, ringNode{hash: hashOf(addr + "#" + strconv.Itoa(v)), addr: addr})
+		}
+	}
+	sort.Slice(ring, func(i, j int) bool { return ring[i].hash < ring[j].hash })
+	b.lock.Lock()
+	b.signature, b.ring = signature, ring
+	b.lock.Unlock()
+	return ring
+}
+
+// hashOf
+//
+//	@Description: 计算在哈希环上的位置，fnv对只有末尾不同的key分布不均匀，再打散一次
+//	@param key
+//	@return uint64
+func hashOf(key string) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(key))
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
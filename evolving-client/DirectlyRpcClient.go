@@ -1,22 +1,27 @@
 package evolving_client
 
 import (
+	"context"
+	"github.com/yuhao-jack/evolving-rpc/contents"
 	"github.com/yuhao-jack/evolving-rpc/model"
 	"github.com/yuhao-jack/go-toolx/netx"
-	"sync"
+	"time"
 )
 
 // DirectlyRpcClientConfig
 // @Description: 直连模式下的Rpc客户端的配置
 type DirectlyRpcClientConfig struct {
 	model.EvolvingClientConfig
+	DefaultProtoc string `json:"default_protoc"` // 默认的编码协议，为空时使用json
 }
 
 // DirectlyRpcClient
 // @Description: 直连模式下的Rpc客户端
 type DirectlyRpcClient struct {
-	client     *EvolvingClient
-	signalLock *sync.Mutex
+	client        *EvolvingClient
+	protocHandler *protocHandler
+	retryer       *retryer
+	callTimeout   time.Duration // 同步执行命令的超时时间
 }
 
 // NewDirectlyRpcClient
@@ -29,7 +34,7 @@ func NewDirectlyRpcClient(config *DirectlyRpcClientConfig) *DirectlyRpcClient {
 	if client == nil {
 		return nil
 	}
-	return &DirectlyRpcClient{client: client, signalLock: &sync.Mutex{}}
+	return &DirectlyRpcClient{client: client, protocHandler: newProtocHandler(config.DefaultProtoc), retryer: newRetryer(), callTimeout: config.CallTimeout}
 }
 
 // ExecuteCommand
@@ -37,37 +42,117 @@ func NewDirectlyRpcClient(config *DirectlyRpcClientConfig) *DirectlyRpcClient {
 //	@Description: 执行命令
 //	@receiver d
 //	@param command 命令 eg:Arith.Multiply
-//	@param req 命令入参
-//	@param isSync 是否同步
+//	@param req 按客户端默认的编码协议编码后的命令入参
+//	@param isSync 是否同步，同步时等待结果，超过配置的CallTimeout还没有回复时返回DeadlineExceeded
 //	@return res 命令结果
-//	@return err 失败时的错误信息
-func (d *DirectlyRpcClient) ExecuteCommand(command string, req []byte, isAsync bool) (res []byte, err error) {
-	var signalChan chan struct{}
-	if isAsync {
-		d.signalLock.Lock()
-		signalChan = make(chan struct{})
-		defer close(signalChan)
+//	@return err 失败时的错误信息，服务端返回的错误为*errorx.StatusError
+func (d *DirectlyRpcClient) ExecuteCommand(command string, req []byte, isSync bool) (res []byte, err error) {
+	message := model.NewRpcMessage(netx.NewDefaultMessage([]byte(command), req), 0)
+	message.Protoc = d.protocHandler.getDefaultProtoc()
+	if !isSync {
+		d.client.Execute(message, nil)
+		return nil, nil
 	}
-	d.client.Execute(netx.NewDefaultMessage([]byte(command), req), func(reply netx.IMessage) {
-		res = reply.GetBody()
-		if isAsync {
-			d.signalLock.Unlock()
-			signalChan <- struct{}{}
-		}
+	ctx, cancel := callTimeoutContext(d.callTimeout)
+	defer cancel()
+	reply, err := d.client.ExecuteContext(ctx, message)
+	if err != nil {
+		return nil, err
+	}
+	return reply.GetBody(), nil
+}
 
+// Call
+//
+//	@Description: 调用服务的方法，入参和结果自动编解码，context取消或超时后立即返回，失败后按方法的重试策略重试
+//	@receiver d
+//	@param ctx 调用的context，截止时间会发给服务端
+//	@param command 命令 eg:Arith.Multiply
+//	@param req 命令入参，按调用选项或者客户端默认的编码协议编码
+//	@param resp 接收命令结果的指针，为nil时忽略结果
+//	@param opts 调用选项 eg:WithProtoc(contents.Pb)
+//	@return error 失败时的错误信息，为*errorx.StatusError
+func (d *DirectlyRpcClient) Call(ctx context.Context, command string, req any, resp any, opts ...CallOption) error {
+	o := newCallOptions(d.protocHandler.getDefaultProtoc(), opts)
+	return d.retryer.do(ctx, d.retryer.policyOf(command, ""), func() error {
+		return call(ctx, d.client, d.protocHandler, command, req, resp, o)
 	})
-	if isAsync {
-		<-signalChan
-	}
-	return res, nil
+}
+
+// SetRetryPolicy
+//
+//	@Description: 设置方法的重试策略，默认不重试
+//	@receiver d
+//	@param command 命令 eg:Arith.Multiply，为空时作为没有单独设置的方法的策略
+//	@param policy 重试策略，为nil时删除
+func (d *DirectlyRpcClient) SetRetryPolicy(command string, policy *RetryPolicy) {
+	d.retryer.setPolicy(command, policy)
+}
+
+// SetRetryBudget
+//
+//	@Description: 设置所有方法共用的重试预算，默认NewRetryBudget(10, 0.1)
+//	@receiver d
+//	@param budget 重试预算，为nil时不限制
+func (d *DirectlyRpcClient) SetRetryBudget(budget *RetryBudget) {
+	d.retryer.setBudget(budget)
 }
 
 func (d *DirectlyRpcClient) ExecuteCmd(command string, req []byte, callBack func([]byte)) {
-	d.client.Execute(netx.NewDefaultMessage([]byte(command), req), func(reply netx.IMessage) {
+	message := model.NewRpcMessage(netx.NewDefaultMessage([]byte(command), req), 0)
+	message.Protoc = d.protocHandler.getDefaultProtoc()
+	d.client.Execute(message, func(reply netx.IMessage) {
 		callBack(reply.GetBody())
 	})
 }
 
+// GetState
+//
+//	@Description: 获取连接的状态
+//	@receiver d
+//	@return contents.ConnState
+func (d *DirectlyRpcClient) GetState() contents.ConnState {
+	return d.client.GetState()
+}
+
+// SetStateCallBack
+//
+//	@Description: 设置连接状态变化时的回调，断线、重连成功、关闭时都会回调
+//	@receiver d
+//	@param f 回调方法
+func (d *DirectlyRpcClient) SetStateCallBack(f func(state contents.ConnState)) {
+	d.client.SetStateCallBack(f)
+}
+
+// SetDefaultProtoc
+//
+//	@Description: 设置默认的编码协议，调用时可以通过WithProtoc覆盖
+//	@receiver d
+//	@param protoc 编码协议，为空时使用json
+func (d *DirectlyRpcClient) SetDefaultProtoc(protoc string) {
+	d.protocHandler.setDefaultProtoc(protoc)
+}
+
+// SetProtocUnmarshalHandler
+//
+//	@Description: 设置Unmarshal处理方法
+//	@receiver d
+//	@param protoc
+//	@param handler
+func (d *DirectlyRpcClient) SetProtocUnmarshalHandler(protoc string, handler func(in []byte, recv any) error) {
+	d.protocHandler.protocUnmarshalHandlerMap.Set(protoc, handler)
+}
+
+// SetProtocMarshalHandler
+//
+//	@Description: 设置Marshal处理方法
+//	@receiver d
+//	@param protoc
+//	@param handler
+func (d *DirectlyRpcClient) SetProtocMarshalHandler(protoc string, handler func(recv any) ([]byte, error)) {
+	d.protocHandler.protocMarshalHandlerMap.Set(protoc, handler)
+}
+
 // Close
 //
 //	@Description: 关闭客户端
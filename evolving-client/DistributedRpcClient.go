@@ -1,115 +1,753 @@
 package evolving_client
 
 import (
+	"context"
 	"encoding/json"
-	"errors"
+	"fmt"
 	"github.com/yuhao-jack/evolving-rpc/contents"
+	"github.com/yuhao-jack/evolving-rpc/errorx"
 	"github.com/yuhao-jack/evolving-rpc/model"
-	"github.com/yuhao-jack/go-toolx/fun"
 	"github.com/yuhao-jack/go-toolx/netx"
-	"hash/crc32"
 	"sync"
 	"time"
 )
 
 type ModeType string
 
+// drainTimeout 服务下线时等待调用完成的最长时间
+const drainTimeout = 10 * time.Second
+
+// ServiceHeartbeatInterval 连接服务实例时的心跳间隔，服务端按这个间隔检测死连接
+const ServiceHeartbeatInterval = 60 * time.Second
+
 type DistributedRpcClient struct {
 	registerCenterConfigs []*model.EvolvingClientConfig
 	serviceInfoMap        map[string][]*model.ServiceInfo
-	serviceClientMap      map[string][]*EvolvingClient
+	serviceClientMap      map[string][]*Instance
+	balancers             map[string]Balancer // 每个服务的负载均衡器，没有设置时按默认策略创建
+	defaultStrategy       contents.BalanceStrategy
 	evolvingClient        []*EvolvingClient
+	watching              *EvolvingClient
+	dependentServices     []string
 	mode                  ModeType
+	protocHandler         *protocHandler
+	retryer               *retryer
+	circuitBreakers       *circuitBreakers
+	hedging               *hedging
+	callTimeout           time.Duration // 同步执行命令的超时时间，使用第一个注册中心的配置
+	closed                bool
+	lock                  *sync.RWMutex
 }
 
 func NewDistributedRpcClient(registerCenterConfigs []*model.EvolvingClientConfig, dependentServices []string) (c *DistributedRpcClient) {
-	rpcClient := DistributedRpcClient{registerCenterConfigs: registerCenterConfigs, serviceInfoMap: map[string][]*model.ServiceInfo{}, serviceClientMap: map[string][]*EvolvingClient{}}
+	rpcClient := DistributedRpcClient{registerCenterConfigs: registerCenterConfigs, dependentServices: dependentServices, serviceInfoMap: map[string][]*model.ServiceInfo{}, serviceClientMap: map[string][]*Instance{}, balancers: map[string]Balancer{}, defaultStrategy: contents.RoundRobin, protocHandler: newProtocHandler(contents.Json), retryer: newRetryer(), circuitBreakers: newCircuitBreakers(), hedging: newHedging(), lock: &sync.RWMutex{}}
+	if len(registerCenterConfigs) > 0 {
+		rpcClient.callTimeout = registerCenterConfigs[0].CallTimeout
+	}
 	for _, config := range registerCenterConfigs {
 		evolvingClient := NewEvolvingClient(config)
 		if evolvingClient != nil {
 			rpcClient.evolvingClient = append(rpcClient.evolvingClient, evolvingClient)
 		}
 	}
-	group := sync.WaitGroup{}
-	for _, service := range dependentServices {
-		group.Add(1)
-		var serviceList []*model.ServiceInfo
-		waitGroup := sync.WaitGroup{}
-
-		for _, client := range rpcClient.evolvingClient {
-			waitGroup.Add(1)
-			var tmpErr error
-			Err := client.DisCover(service, func(reply netx.IMessage) {
-				err := json.Unmarshal(reply.GetBody(), &serviceList)
-				if err != nil {
-					tmpErr = err
-				}
-				waitGroup.Done()
-			})
-
-			if tmpErr == nil && Err == nil {
-				break
+	if len(rpcClient.evolvingClient) == 0 {
+		contents.RpcLogger.Error("services %v has no available register center...", dependentServices)
+		return nil
+	}
+	for _, registerCenter := range rpcClient.evolvingClient {
+		registerCenter := registerCenter
+		registerCenter.SetStateCallBack(func(state contents.ConnState) {
+			if state == contents.Disconnected {
+				rpcClient.failover(registerCenter)
 			}
+		})
+	}
+	//  订阅依赖的服务，之后服务的变化由注册中心推送过来
+	rpcClient.watchVia(rpcClient.evolvingClient[0]).Wait()
+	rpcClient.waitDialed()
+
+	return &rpcClient
+}
+
+// watchVia
+//
+//	@Description: 通过一个注册中心订阅依赖的服务
+//	@receiver c
+//	@param registerCenter 注册中心的连接
+//	@return *sync.WaitGroup 所有服务都收到完整的服务列表后结束
+func (c *DistributedRpcClient) watchVia(registerCenter *EvolvingClient) *sync.WaitGroup {
+	c.lock.Lock()
+	c.watching = registerCenter
+	c.lock.Unlock()
+	registerCenter.SetCommand(contents.Watch, c.onServiceEvent)
+	group := &sync.WaitGroup{}
+	for _, service := range c.dependentServices {
+		service := service
+		once := sync.Once{}
+		group.Add(1)
+		err := registerCenter.Watch(service, func(reply netx.IMessage) {
+			c.onServiceList(service, reply)
+			once.Do(group.Done)
+		})
+		if err != nil {
+			contents.RpcLogger.Error("watch service %s failed,err:%v", service, err)
+			once.Do(group.Done)
 		}
-		waitGroup.Wait()
-		if len(rpcClient.evolvingClient) == 0 {
-			contents.RpcLogger.Error("service %s has no available nodes...", service)
-			return nil
+	}
+	return group
+}
+
+// waitDialed
+//
+//	@Description: 等所有服务实例的第一次连接结束，创建完客户端就可以调用
+//	@receiver c
+func (c *DistributedRpcClient) waitDialed() {
+	var dialed []chan struct{}
+	c.lock.RLock()
+	for _, instances := range c.serviceClientMap {
+		for _, instance := range instances {
+			dialed = append(dialed, instance.dialed)
 		}
-		waitGroup.Add(1)
-		_ = rpcClient.evolvingClient[0].DisCover(service, func(reply netx.IMessage) {
-			err := json.Unmarshal(reply.GetBody(), &serviceList)
-			if err != nil {
-				contents.RpcLogger.Error("json.Unmarshal failed,err:%v", err)
-			}
-			waitGroup.Done()
+	}
+	c.lock.RUnlock()
+	for _, ch := range dialed {
+		<-ch
+	}
+}
+
+// failover
+//
+//	@Description: 正在订阅的注册中心断开时改从其它连着的注册中心订阅，都断开时等原来的重连后自动重新订阅
+//	@receiver c
+//	@param registerCenter 断开的注册中心的连接
+func (c *DistributedRpcClient) failover(registerCenter *EvolvingClient) {
+	c.lock.RLock()
+	watching := c.watching
+	c.lock.RUnlock()
+	if watching != registerCenter {
+		return
+	}
+	for _, client := range c.evolvingClient {
+		if client != registerCenter && client.GetState() == contents.Connected {
+			contents.RpcLogger.Warn("register center %s lost,watch services via %s", clientAddr(registerCenter), clientAddr(client))
+			//  原来的注册中心重连后不再重新订阅，避免两边的推送交替到达
+			registerCenter.clearWatches()
+			c.watchVia(client)
+			return
+		}
+	}
+}
+
+// onServiceList
+//
+//	@Description: 收到订阅时完整的服务列表，按列表增删服务的连接
+//	@receiver c
+//	@param serviceName 服务名
+//	@param reply 注册中心的回复
+func (c *DistributedRpcClient) onServiceList(serviceName string, reply netx.IMessage) {
+	if err := model.StatusOf(reply); err != nil {
+		contents.RpcLogger.Error("watch service %s failed,err:%v", serviceName, err)
+		return
+	}
+	var serviceList []*model.ServiceInfo
+	if err := json.Unmarshal(reply.GetBody(), &serviceList); err != nil {
+		contents.RpcLogger.Error("json.Unmarshal failed,err:%v", err)
+		return
+	}
+	c.lock.Lock()
+	c.serviceInfoMap[serviceName] = serviceList
+	c.lock.Unlock()
+	available := make(map[string]*model.ServiceInfo)
+	for _, info := range serviceList {
+		if info.GetStatus() == contents.Up {
+			available[info.Addr()] = info
+		}
+	}
+	c.lock.RLock()
+	instances := append([]*Instance{}, c.serviceClientMap[serviceName]...)
+	c.lock.RUnlock()
+	for _, instance := range instances {
+		if _, ok := available[instance.Info.Addr()]; !ok {
+			c.removeClient(serviceName, instance.Info.Addr())
+		}
+	}
+	for _, info := range available {
+		c.addClient(info)
+	}
+}
+
+// onServiceEvent
+//
+//	@Description: 收到注册中心推送的服务变化事件，更新服务信息和服务的连接
+//	@receiver c
+//	@param reply 注册中心推送的消息
+func (c *DistributedRpcClient) onServiceEvent(reply netx.IMessage) {
+	var event model.ServiceEvent
+	if err := json.Unmarshal(reply.GetBody(), &event); err != nil || event.ServiceInfo == nil {
+		contents.RpcLogger.Error("bad service event %s,err:%v", string(reply.GetBody()), err)
+		return
+	}
+	info := event.ServiceInfo
+	contents.RpcLogger.Info("service %s %s %s", info.ServiceName, info.Addr(), event.Type)
+	c.lock.Lock()
+	var serviceList []*model.ServiceInfo
+	for _, old := range c.serviceInfoMap[info.ServiceName] {
+		if !old.SameInstance(info) {
+			serviceList = append(serviceList, old)
+		}
+	}
+	if event.Type != contents.ServiceRemove {
+		serviceList = append(serviceList, info)
+	}
+	c.serviceInfoMap[info.ServiceName] = serviceList
+	c.lock.Unlock()
+	if event.Type == contents.ServiceRemove || info.GetStatus() != contents.Up {
+		c.removeClient(info.ServiceName, info.Addr())
+		return
+	}
+	c.addClient(info)
+}
+
+// addClient
+//
+//	@Description: 添加服务实例并在后台连接，连上之前不会被选中，已经有这个实例时只更新服务信息。
+//	在注册中心连接的读协程里调用，不能等待连接服务
+//	@receiver c
+//	@param info 服务信息
+func (c *DistributedRpcClient) addClient(info *model.ServiceInfo) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.closed {
+		return
+	}
+	instances := c.serviceClientMap[info.ServiceName]
+	for i, instance := range instances {
+		if instance.Info.Addr() == info.Addr() {
+			//  负载均衡器可能正在读旧的实例，这里整个替换
+			updated := append([]*Instance{}, instances...)
+			updated[i] = &Instance{Info: info, Client: instance.Client, dialed: instance.dialed}
+			c.serviceClientMap[info.ServiceName] = updated
+			return
+		}
+	}
+	instance := &Instance{Info: info, dialed: make(chan struct{})}
+	c.serviceClientMap[info.ServiceName] = append(instances, instance)
+	go c.dial(info, instance.dialed)
+}
+
+// dial
+//
+//	@Description: 连接服务实例，失败后等待一段时间重试，每次翻倍，直到连上或者服务实例被移除
+//	@receiver c
+//	@param info 服务信息
+//	@param dialed 第一次连接结束后关闭
+func (c *DistributedRpcClient) dial(info *model.ServiceInfo, dialed chan struct{}) {
+	defer func() {
+		if dialed != nil {
+			close(dialed)
+		}
+	}()
+	interval := 500 * time.Millisecond
+	for c.dialing(info) {
+		client := NewEvolvingClient(&model.EvolvingClientConfig{
+			EvolvingServerHost: info.ServiceHost,
+			EvolvingServerPort: info.ServicePort,
+			HeartbeatInterval:  ServiceHeartbeatInterval,
 		})
-		waitGroup.Wait()
-		rpcClient.serviceInfoMap[service] = serviceList
-		if rpcClient.serviceClientMap == nil {
-			rpcClient.serviceClientMap = map[string][]*EvolvingClient{}
-		}
-		for _, info := range serviceList {
-			client := NewEvolvingClient(&model.EvolvingClientConfig{
-				EvolvingServerHost: info.ServiceHost,
-				EvolvingServerPort: info.ServicePort,
-				HeartbeatInterval:  60 * time.Second,
-			})
-			if client != nil {
-				rpcClient.serviceClientMap[service] = append(rpcClient.serviceClientMap[service], client)
+		if client != nil {
+			if !c.connected(info, client) {
+				//  连接期间服务实例被移除了
+				client.Close()
 			}
+			return
+		}
+		contents.RpcLogger.Warn("connect to %s %s failed,retry after %v", info.ServiceName, info.Addr(), interval)
+		close(dialed)
+		dialed = nil
+		time.Sleep(interval)
+		if interval *= 2; interval > 30*time.Second {
+			interval = 30 * time.Second
+		}
+	}
+}
 
+// dialing
+//
+//	@Description: 服务实例是否还在等待连接
+//	@receiver c
+//	@param info 服务信息
+//	@return bool 已经被移除或者客户端已经关闭时为false
+func (c *DistributedRpcClient) dialing(info *model.ServiceInfo) bool {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	if c.closed {
+		return false
+	}
+	for _, instance := range c.serviceClientMap[info.ServiceName] {
+		if instance.Info.Addr() == info.Addr() {
+			return instance.Client == nil
 		}
-		group.Done()
 	}
-	group.Wait()
+	return false
+}
 
-	return &rpcClient
+// connected
+//
+//	@Description: 连上之后把连接放到服务实例上，之后可以被选中
+//	@receiver c
+//	@param info 服务信息
+//	@param client 到服务的连接
+//	@return bool 服务实例已经被移除或者客户端已经关闭时为false，调用方需要关闭连接
+func (c *DistributedRpcClient) connected(info *model.ServiceInfo, client *EvolvingClient) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.closed {
+		return false
+	}
+	instances := c.serviceClientMap[info.ServiceName]
+	for i, instance := range instances {
+		if instance.Info.Addr() == info.Addr() && instance.Client == nil {
+			updated := append([]*Instance{}, instances...)
+			updated[i] = &Instance{Info: instance.Info, Client: client, dialed: instance.dialed}
+			c.serviceClientMap[info.ServiceName] = updated
+			return true
+		}
+	}
+	return false
 }
 
+// removeClient
+//
+//	@Description: 移除服务的连接，已经发出的调用完成后断开
+//	@receiver c
+//	@param serviceName 服务名
+//	@param addr 服务的地址
+func (c *DistributedRpcClient) removeClient(serviceName, addr string) {
+	var instances, removed []*Instance
+	c.lock.Lock()
+	for _, instance := range c.serviceClientMap[serviceName] {
+		if instance.Info.Addr() == addr {
+			removed = append(removed, instance)
+		} else {
+			instances = append(instances, instance)
+		}
+	}
+	c.serviceClientMap[serviceName] = instances
+	c.lock.Unlock()
+	c.circuitBreakers.remove(addr)
+	for _, instance := range removed {
+		//  服务下线前会先处理完已经收到的调用，这里等回复都到了再断开，还没有连上的由连接协程关闭
+		if instance.Client != nil {
+			go instance.Client.closeWhenIdle(drainTimeout)
+		}
+	}
+}
+
+// clientAddr
+//
+//	@Description: 连接的服务端地址
+//	@param client
+//	@return string host:port
+func clientAddr(client *EvolvingClient) string {
+	return fmt.Sprintf("%s:%d", client.conf.EvolvingServerHost, client.conf.EvolvingServerPort)
+}
+
+// ExecuteCommand
+//
+//	@Description: 选择一个服务实例执行命令
+//	@receiver c
+//	@param serviceName 服务名
+//	@param command 命令 eg:Arith.Multiply
+//	@param req 按客户端默认的编码协议编码后的命令入参
+//	@param isSync 是否同步，同步时等待结果，超过第一个注册中心配置的CallTimeout还没有回复时返回DeadlineExceeded
+//	@return res 命令结果
+//	@return err 失败时的错误信息，为*errorx.StatusError
 func (c *DistributedRpcClient) ExecuteCommand(serviceName, command string, req []byte, isSync bool) (res []byte, err error) {
-	clients, ok := c.serviceClientMap[serviceName]
-	if !ok {
-		return nil, errors.New("service " + serviceName + " not found")
+	instance, err := c.getClient(serviceName, PickInfo{Command: command}, nil)
+	if err != nil {
+		return nil, err
 	}
-	if len(clients) == 0 {
-		return nil, errors.New("service " + serviceName + " has no provider")
+	client := instance.Client
+	message := model.NewRpcMessage(netx.NewDefaultMessage([]byte(command), req), 0)
+	message.Protoc = c.protocHandler.getDefaultProtoc()
+	if !isSync {
+		client.Execute(message, nil)
+		return nil, nil
 	}
-	group := sync.WaitGroup{}
-	if isSync {
-		group.Add(1)
+	ctx, cancel := callTimeoutContext(c.callTimeout)
+	defer cancel()
+	reply, err := client.ExecuteContext(ctx, message)
+	if err != nil {
+		return nil, err
+	}
+	return reply.GetBody(), nil
+}
+
+// Call
+//
+//	@Description: 调用服务的方法，入参和结果自动编解码，context取消或超时后立即返回，
+//	失败后按方法的重试策略重试，重试时优先选择还没有调用过的服务实例，开启熔断后不选择方法已经熔断的服务实例，
+//	开启对冲调用的方法没有及时回复时再发给另一个服务实例
+//	@receiver c
+//	@param ctx 调用的context，截止时间会发给服务端
+//	@param serviceName 服务名
+//	@param command 命令 eg:Arith.Multiply
+//	@param req 命令入参，按调用选项或者客户端默认的编码协议编码
+//	@param resp 接收命令结果的指针，为nil时忽略结果
+//	@param opts 调用选项 eg:WithProtoc(contents.Pb)
+//	@return error 失败时的错误信息，为*errorx.StatusError
+func (c *DistributedRpcClient) Call(ctx context.Context, serviceName, command string, req any, resp any, opts ...CallOption) error {
+	o := newCallOptions(c.protocHandler.getDefaultProtoc(), opts)
+	bytes, err := c.protocHandler.marshal(o.protoc, req)
+	if err != nil {
+		return err
 	}
-	clients[c.getClientsIndex(command, len(clients))].Execute(netx.NewDefaultMessage([]byte(command), req), func(reply netx.IMessage) {
-		res = reply.GetBody()
-		if isSync {
-			group.Done()
+	info := PickInfo{Command: command, RoutingKey: o.routingKey}
+	var tried []*EvolvingClient
+	return c.retryer.do(ctx, c.retryer.policyOf(serviceName+"/"+command, serviceName+"/"), func() error {
+		var reply netx.IMessage
+		if policy := c.hedging.policyOf(serviceName + "/" + command); policy != nil {
+			reply, err = c.hedgedSend(ctx, serviceName, info, bytes, o, policy, &tried)
+		} else {
+			var instance *Instance
+			if instance, err = c.pick(serviceName, info, &tried); err != nil {
+				return err
+			}
+			reply, err = c.send(ctx, serviceName, instance, command, bytes, o)
+		}
+		if err != nil {
+			return err
 		}
+		return decodeReply(c.protocHandler, reply, resp, o)
 	})
-	if isSync {
-		group.Wait()
+}
+
+// pick
+//
+//	@Description: 选择一个服务实例并记录到已经调用过的连接
+//	@receiver c
+//	@param serviceName 服务名
+//	@param info 调用的信息
+//	@param tried 这次调用已经调用过的连接
+//	@return *Instance
+//	@return error 没有可用连接时的错误信息
+func (c *DistributedRpcClient) pick(serviceName string, info PickInfo, tried *[]*EvolvingClient) (*Instance, error) {
+	instance, err := c.getClient(serviceName, info, *tried)
+	if err != nil {
+		return nil, err
+	}
+	*tried = append(*tried, instance.Client)
+	return instance, nil
+}
+
+// send
+//
+//	@Description: 把调用发给一个服务实例，按结果更新熔断器和方法的调用耗时
+//	@receiver c
+//	@param ctx 调用的context
+//	@param serviceName 服务名
+//	@param instance 服务实例
+//	@param command 命令
+//	@param bytes 编码后的命令入参
+//	@param o 调用选项
+//	@return netx.IMessage 回复消息
+//	@return error 失败时的错误信息，为*errorx.StatusError
+func (c *DistributedRpcClient) send(ctx context.Context, serviceName string, instance *Instance, command string, bytes []byte, o *callOptions) (netx.IMessage, error) {
+	breaker := c.circuitBreakers.get(instance.Info.Addr(), command)
+	if breaker != nil && !breaker.allow() {
+		//  选择后其它调用占用了半开时的探测名额
+		return nil, errorx.Unsent(errorx.New(errorx.Unavailable, "circuit of %s %s is open", instance.Info.Addr(), command))
+	}
+	start := time.Now()
+	reply, err := instance.Client.ExecuteContext(ctx, newCallMessage(command, bytes, o))
+	elapsed := time.Since(start)
+	if breaker != nil {
+		breaker.onResult(err, elapsed)
+	}
+	if err == nil {
+		c.hedging.record(serviceName+"/"+command, elapsed)
+	}
+	return reply, err
+}
+
+// hedgeResult
+// @Description: 对冲调用中一个调用的结果
+type hedgeResult struct {
+	reply netx.IMessage
+	err   error
+}
+
+// hedgedSend
+//
+//	@Description: 对冲调用，第一个调用超过延迟还没有回复时再发给另一个服务实例，先成功的回复作为结果，
+//	返回时取消还没有回复的调用，都失败时返回最后一个错误
+//	@receiver c
+//	@param ctx 调用的context
+//	@param serviceName 服务名
+//	@param info 调用的信息
+//	@param bytes 编码后的命令入参
+//	@param o 调用选项
+//	@param policy 方法的对冲调用策略
+//	@param tried 这次调用已经调用过的连接
+//	@return netx.IMessage 回复消息
+//	@return error 失败时的错误信息，为*errorx.StatusError
+func (c *DistributedRpcClient) hedgedSend(ctx context.Context, serviceName string, info PickInfo, bytes []byte, o *callOptions, policy *HedgingPolicy, tried *[]*EvolvingClient) (netx.IMessage, error) {
+	first, err := c.pick(serviceName, info, tried)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	results := make(chan hedgeResult, 2)
+	hedge := func(instance *Instance) {
+		go func() {
+			reply, err := c.send(ctx, serviceName, instance, info.Command, bytes, o)
+			results <- hedgeResult{reply: reply, err: err}
+		}()
+	}
+	hedge(first)
+	pending := 1
+	timer := time.NewTimer(c.hedging.delay(serviceName+"/"+info.Command, policy))
+	defer timer.Stop()
+	var result hedgeResult
+	for pending > 0 {
+		select {
+		case <-timer.C:
+			//  没有其它服务实例时继续等第一个调用
+			if second, err := c.pick(serviceName, info, tried); err == nil && second.Client != first.Client {
+				hedge(second)
+				pending++
+			}
+		case result = <-results:
+			pending--
+			if result.err == nil {
+				return result.reply, nil
+			}
+		}
+	}
+	return nil, result.err
+}
+
+// getClient
+//
+//	@Description: 按服务的负载均衡器选择一个服务实例，跳过方法已经熔断的服务实例
+//	@receiver c
+//	@param serviceName 服务名
+//	@param info 调用的信息
+//	@param excluded 重试时已经调用过的连接，还有其它服务实例时不选择
+//	@return *Instance
+//	@return error 没有可用连接时的错误信息
+func (c *DistributedRpcClient) getClient(serviceName string, info PickInfo, excluded []*EvolvingClient) (*Instance, error) {
+	c.lock.RLock()
+	instances, ok := c.serviceClientMap[serviceName]
+	balancer := c.balancers[serviceName]
+	c.lock.RUnlock()
+	if !ok {
+		return nil, errorx.Unsent(errorx.New(errorx.Unavailable, "service %s not found", serviceName))
+	}
+	if len(instances) == 0 {
+		return nil, errorx.Unsent(errorx.New(errorx.Unavailable, "service %s has no provider", serviceName))
+	}
+	info.Members = instances
+	if instances = connectedInstances(instances); len(instances) == 0 {
+		return nil, errorx.Unsent(errorx.New(errorx.Unavailable, "service %s has no connected provider", serviceName))
+	}
+	if instances = c.circuitBreakers.filter(instances, info.Command); len(instances) == 0 {
+		return nil, errorx.Unsent(errorx.New(errorx.Unavailable, "circuits of service %s %s are open on all providers", serviceName, info.Command))
+	}
+	if balancer == nil {
+		balancer = c.defaultBalancer(serviceName)
+	}
+	if remaining := excludeInstances(instances, excluded); len(remaining) > 0 {
+		instances = remaining
+	}
+	return balancer.Pick(info, instances), nil
+}
+
+// connectedInstances
+//
+//	@Description: 去掉还没有连上的服务实例
+//	@param instances 候选服务实例
+//	@return []*Instance
+func connectedInstances(instances []*Instance) []*Instance {
+	connected := make([]*Instance, 0, len(instances))
+	for _, instance := range instances {
+		if instance.Client != nil {
+			connected = append(connected, instance)
+		}
+	}
+	return connected
+}
+
+// excludeInstances
+//
+//	@Description: 去掉已经调用过的服务实例
+//	@param instances 候选服务实例
+//	@param excluded 已经调用过的连接
+//	@return []*Instance 没有要去掉的实例时为原来的候选服务实例
+func excludeInstances(instances []*Instance, excluded []*EvolvingClient) []*Instance {
+	if len(excluded) == 0 {
+		return instances
+	}
+	var remaining []*Instance
+	for _, instance := range instances {
+		skip := false
+		for _, client := range excluded {
+			if instance.Client == client {
+				skip = true
+				break
+			}
+		}
+		if !skip {
+			remaining = append(remaining, instance)
+		}
+	}
+	return remaining
+}
+
+// defaultBalancer
+//
+//	@Description: 按默认策略给服务创建负载均衡器
+//	@receiver c
+//	@param serviceName 服务名
+//	@return Balancer
+func (c *DistributedRpcClient) defaultBalancer(serviceName string) Balancer {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if balancer := c.balancers[serviceName]; balancer != nil {
+		return balancer
+	}
+	balancer, _ := NewBalancer(c.defaultStrategy)
+	c.balancers[serviceName] = balancer
+	return balancer
+}
+
+// SetBalancer
+//
+//	@Description: 设置服务的负载均衡器
+//	@receiver c
+//	@param serviceName 服务名
+//	@param balancer 负载均衡器，为nil时恢复默认策略
+func (c *DistributedRpcClient) SetBalancer(serviceName string, balancer Balancer) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if balancer == nil {
+		delete(c.balancers, serviceName)
+		return
+	}
+	c.balancers[serviceName] = balancer
+}
+
+// SetBalanceStrategy
+//
+//	@Description: 设置服务使用的内置负载均衡策略
+//	@receiver c
+//	@param serviceName 服务名
+//	@param strategy 负载均衡策略
+//	@return error 没有这个策略时的错误信息
+func (c *DistributedRpcClient) SetBalanceStrategy(serviceName string, strategy contents.BalanceStrategy) error {
+	balancer, err := NewBalancer(strategy)
+	if err != nil {
+		return err
+	}
+	c.SetBalancer(serviceName, balancer)
+	return nil
+}
+
+// SetDefaultBalanceStrategy
+//
+//	@Description: 设置没有单独设置负载均衡器的服务使用的策略，默认轮询，已经创建的负载均衡器不受影响
+//	@receiver c
+//	@param strategy 负载均衡策略
+//	@return error 没有这个策略时的错误信息
+func (c *DistributedRpcClient) SetDefaultBalanceStrategy(strategy contents.BalanceStrategy) error {
+	if _, err := NewBalancer(strategy); err != nil {
+		return err
 	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.defaultStrategy = strategy
+	return nil
+}
 
-	return res, nil
+// SetRetryPolicy
+//
+//	@Description: 设置服务方法的重试策略，默认不重试
+//	@receiver c
+//	@param serviceName 服务名
+//	@param command 命令 eg:Arith.Multiply，为空时作为服务中没有单独设置的方法的策略
+//	@param policy 重试策略，为nil时删除
+func (c *DistributedRpcClient) SetRetryPolicy(serviceName, command string, policy *RetryPolicy) {
+	c.retryer.setPolicy(serviceName+"/"+command, policy)
+}
+
+// SetRetryBudget
+//
+//	@Description: 设置所有服务共用的重试预算，默认NewRetryBudget(10, 0.1)
+//	@receiver c
+//	@param budget 重试预算，为nil时不限制
+func (c *DistributedRpcClient) SetRetryBudget(budget *RetryBudget) {
+	c.retryer.setBudget(budget)
+}
+
+// SetCircuitBreaker
+//
+//	@Description: 开启熔断，每个服务实例的每个方法各用一个熔断器，已有的熔断器重新开始统计
+//	@receiver c
+//	@param conf 熔断器的配置，为nil时关闭熔断
+func (c *DistributedRpcClient) SetCircuitBreaker(conf *CircuitBreakerConfig) {
+	c.circuitBreakers.setConfig(conf)
+}
+
+// CircuitState
+//
+//	@Description: 获取服务实例的方法的熔断器状态
+//	@receiver c
+//	@param addr 服务实例的地址 host:port
+//	@param command 命令 eg:Arith.Multiply
+//	@return contents.CircuitState 没有开启熔断或者还没有调用过时为CircuitClosed
+func (c *DistributedRpcClient) CircuitState(addr, command string) contents.CircuitState {
+	return c.circuitBreakers.state(addr, command)
+}
+
+// SetHedgingPolicy
+//
+//	@Description: 给服务的方法开启对冲调用，默认不开启，只给只读或者幂等的方法开启
+//	@receiver c
+//	@param serviceName 服务名
+//	@param command 命令 eg:Arith.Multiply
+//	@param policy 对冲调用策略，为nil时关闭
+func (c *DistributedRpcClient) SetHedgingPolicy(serviceName, command string, policy *HedgingPolicy) {
+	c.hedging.setPolicy(serviceName+"/"+command, policy)
+}
+
+// SetDefaultProtoc
+//
+//	@Description: 设置默认的编码协议，调用时可以通过WithProtoc覆盖
+//	@receiver c
+//	@param protoc 编码协议，为空时使用json
+func (c *DistributedRpcClient) SetDefaultProtoc(protoc string) {
+	c.protocHandler.setDefaultProtoc(protoc)
+}
+
+// SetProtocUnmarshalHandler
+//
+//	@Description: 设置Unmarshal处理方法
+//	@receiver c
+//	@param protoc
+//	@param handler
+func (c *DistributedRpcClient) SetProtocUnmarshalHandler(protoc string, handler func(in []byte, recv any) error) {
+	c.protocHandler.protocUnmarshalHandlerMap.Set(protoc, handler)
+}
+
+// SetProtocMarshalHandler
+//
+//	@Description: 设置Marshal处理方法
+//	@receiver c
+//	@param protoc
+//	@param handler
+func (c *DistributedRpcClient) SetProtocMarshalHandler(protoc string, handler func(recv any) ([]byte, error)) {
+	c.protocHandler.protocMarshalHandlerMap.Set(protoc, handler)
 }
 
 // Close
@@ -119,22 +757,18 @@ func (c *DistributedRpcClient) ExecuteCommand(serviceName, command string, req [
 //	@Author yuhao
 //	@Data 2023-03-01 21:03:07
 func (c *DistributedRpcClient) Close() {
-	for _, clients := range c.serviceClientMap {
-		for _, client := range clients {
-			client.Close()
+	//  先断开注册中心，不再收到服务变化
+	for _, client := range c.evolvingClient {
+		client.Close()
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.closed = true
+	for _, instances := range c.serviceClientMap {
+		for _, instance := range instances {
+			if instance.Client != nil {
+				instance.Client.Close()
+			}
 		}
 	}
 }
-
-// getClientsIndex
-//
-//	@Description:
-//	@receiver c
-//	@param in
-//	@param hashBy
-//	@return int
-func (c *DistributedRpcClient) getClientsIndex(in string, hashBy int) int {
-	v := int(crc32.ChecksumIEEE([]byte(in)))
-	t := fun.IfOr(v >= 0, v, -v) % hashBy
-	return t
-}
@@ -1,28 +1,43 @@
 package evolving_client
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/yuhao-jack/evolving-rpc/contents"
+	"github.com/yuhao-jack/evolving-rpc/errorx"
 	"github.com/yuhao-jack/evolving-rpc/model"
 	"github.com/yuhao-jack/go-toolx/fun"
 	"github.com/yuhao-jack/go-toolx/netx"
+	"math/rand"
 	"net"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 // EvolvingClient
 // @Description: 客户端连接（非RPC客户端）
 type EvolvingClient struct {
-	msgChan   chan netx.IMessage
-	dataPack  *netx.DataPack
-	conf      *model.EvolvingClientConfig
-	commands  map[string]func(message netx.IMessage)
-	lock      *sync.RWMutex
-	closeFlag bool
-	closeChan chan bool
+	msgChan       chan netx.IMessage
+	dataPack      *netx.DataPack
+	conf          *model.EvolvingClientConfig
+	commands      map[string]func(message netx.IMessage)
+	pending       map[uint64]func(message netx.IMessage)
+	services      map[*model.ServiceInfo]*model.Lease // 注册过的服务及其租约，重连或者租约失效后重新注册
+	registerLock  sync.Mutex                          // 重新注册和下线互斥，下线的消息发出后不会再发出重新注册的消息
+	leaseOnce     sync.Once
+	watches       map[string]func(reply netx.IMessage)  // 订阅过的服务，重连后重新订阅
+	configWatches map[string]func(config *model.Config) // 订阅过的配置，重连后重新订阅
+	configVersion map[string]uint64                     // 订阅的配置最后回调过的版本
+	seq           uint64
+	lock          *sync.RWMutex
+	state         contents.ConnState
+	stateCallBack func(state contents.ConnState)
+	closeOnce     sync.Once
+	closeChan     chan struct{}
 }
 
 // NewEvolvingClient
@@ -32,10 +47,16 @@ type EvolvingClient struct {
 //	@return *EvolvingClient 客户端连接
 func NewEvolvingClient(conf *model.EvolvingClientConfig) *EvolvingClient {
 	evolvingClient := EvolvingClient{msgChan: make(chan netx.IMessage, 1024),
-		conf:      conf,
-		commands:  make(map[string]func(message netx.IMessage)),
-		lock:      &sync.RWMutex{},
-		closeChan: make(chan bool, 1),
+		conf:          conf,
+		commands:      make(map[string]func(message netx.IMessage)),
+		pending:       make(map[uint64]func(message netx.IMessage)),
+		services:      make(map[*model.ServiceInfo]*model.Lease),
+		watches:       make(map[string]func(reply netx.IMessage)),
+		configWatches: make(map[string]func(config *model.Config)),
+		configVersion: make(map[string]uint64),
+		lock:          &sync.RWMutex{},
+		state:         contents.Connected,
+		closeChan:     make(chan struct{}),
 	}
 	err := evolvingClient.createConn()
 	if err != nil {
@@ -44,6 +65,7 @@ func NewEvolvingClient(conf *model.EvolvingClientConfig) *EvolvingClient {
 	evolvingClient.SetCommand(contents.Default, func(reply netx.IMessage) {
 		contents.RpcLogger.Info(string(reply.GetCommand()) + ":" + string(reply.GetBody()))
 	})
+	evolvingClient.SetCommand(contents.WatchConfig, evolvingClient.onConfig)
 
 	go evolvingClient.processMsg()
 	go evolvingClient.sendMsg()
@@ -57,27 +79,157 @@ func NewEvolvingClient(conf *model.EvolvingClientConfig) *EvolvingClient {
 //	@Author yuhao
 //	@Data 2023-03-01 21:04:46
 func (c *EvolvingClient) Close() {
-	close(c.msgChan)
-	c.closeFlag = true
-	c.closeChan <- c.closeFlag
-	err := c.dataPack.Close()
-	if err != nil {
-		contents.RpcLogger.Warn(c.dataPack.LocalAddr().String()+" closed failed,err:%s", err.Error())
+	c.closeOnce.Do(func() {
+		close(c.closeChan)
+		c.setState(contents.Closed)
+		dataPack := c.getDataPack()
+		err := dataPack.Close()
+		if err != nil {
+			contents.RpcLogger.Warn(dataPack.LocalAddr().String()+" closed failed,err:%s", err.Error())
+		}
+		c.failPending(errorx.New(errorx.Unavailable, "client closed"))
+		contents.RpcLogger.Warn(dataPack.LocalAddr().String() + " closed successful.")
+	})
+}
+
+// GetState
+//
+//	@Description: 获取连接的状态
+//	@receiver c
+//	@return contents.ConnState
+func (c *EvolvingClient) GetState() contents.ConnState {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.state
+}
+
+// SetStateCallBack
+//
+//	@Description: 设置连接状态变化时的回调，断线、重连成功、关闭时都会回调
+//	@receiver c
+//	@param f 回调方法
+func (c *EvolvingClient) SetStateCallBack(f func(state contents.ConnState)) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.stateCallBack = f
+}
+
+// setState
+//
+//	@Description: 设置连接的状态，状态有变化时回调
+//	@receiver c
+//	@param state
+func (c *EvolvingClient) setState(state contents.ConnState) {
+	c.lock.Lock()
+	if c.state == state || c.state == contents.Closed {
+		c.lock.Unlock()
+		return
+	}
+	c.state = state
+	f := c.stateCallBack
+	c.lock.Unlock()
+	contents.RpcLogger.Info("evolving-client %s:%d %s", c.conf.EvolvingServerHost, c.conf.EvolvingServerPort, state)
+	if f != nil {
+		f(state)
 	}
-	contents.RpcLogger.Warn(c.dataPack.LocalAddr().String() + " closed successful.")
 }
 
 // Execute
 //
-//	@Description: 连接执行的命令
+//	@Description: 连接执行的命令，每次调用都会分配一个唯一的调用序号，回复按序号回调，同一命令可以并发调用
 //	@receiver c
 //	@param req 入参
 //	@param callBack 回调方法
 func (c *EvolvingClient) Execute(req netx.IMessage, callBack func(reply netx.IMessage)) {
+	message := model.NewRpcMessage(req, atomic.AddUint64(&c.seq, 1))
+	if err := c.unavailableErr(); err != nil {
+		//  连接不可用时立即失败，不再排队等待
+		if callBack != nil {
+			callBack(model.SetStatus(message, err))
+		}
+		return
+	}
 	if callBack != nil {
-		c.SetCommand(string(req.GetCommand()), callBack)
+		c.setPending(message.Seq, callBack)
+	}
+	select {
+	case c.msgChan <- message:
+	case <-c.closeChan:
+		c.popPending(message.Seq)
+	}
+}
+
+// ExecuteContext
+//
+//	@Description: 执行命令并等待回复，context取消或超时后立即返回，剩余的等待时间会一并发给服务端
+//	@receiver c
+//	@param ctx
+//	@param req 入参
+//	@return reply 回复
+//	@return err 失败时的错误信息，为*errorx.StatusError
+func (c *EvolvingClient) ExecuteContext(ctx context.Context, req netx.IMessage) (reply netx.IMessage, err error) {
+	message := model.NewRpcMessage(req, atomic.AddUint64(&c.seq, 1))
+	message.Meta = model.OutgoingMeta(ctx)
+	if deadline, ok := ctx.Deadline(); ok {
+		message.Timeout = time.Until(deadline)
+		if message.Timeout <= 0 {
+			return nil, errorx.FromContextError(context.DeadlineExceeded)
+		}
+	}
+	if err = c.unavailableErr(); err != nil {
+		return nil, err
+	}
+	replyChan := make(chan netx.IMessage, 1)
+	c.setPending(message.Seq, func(reply netx.IMessage) {
+		replyChan <- reply
+	})
+	select {
+	case c.msgChan <- message:
+	case <-ctx.Done():
+		c.popPending(message.Seq)
+		return nil, errorx.FromContextError(ctx.Err())
+	case <-c.closeChan:
+		c.popPending(message.Seq)
+		return nil, errorx.Unsent(errorx.New(errorx.Unavailable, "client closed"))
+	}
+	select {
+	case reply = <-replyChan:
+		return reply, model.StatusOf(reply)
+	case <-ctx.Done():
+		c.popPending(message.Seq)
+		if errors.Is(ctx.Err(), context.Canceled) {
+			c.cancelRemote(message.Seq)
+		}
+		return nil, errorx.FromContextError(ctx.Err())
+	}
+}
+
+// defaultCallTimeout 没有配置CallTimeout时同步调用的超时时间
+const defaultCallTimeout = 10 * time.Second
+
+// callTimeoutContext
+//
+//	@Description: 创建不带context的同步调用使用的context，超时后调用返回DeadlineExceeded，服务端不回复时不会一直等下去
+//	@param timeout 配置的超时时间，为0时为10s
+//	@return context.Context
+//	@return context.CancelFunc
+func callTimeoutContext(timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		timeout = defaultCallTimeout
+	}
+	return context.WithTimeout(context.Background(), timeout)
+}
+
+// cancelRemote
+//
+//	@Description: 通知服务端调用方已经放弃了调用，服务端取消处理这次调用的context，发送队列满时放弃通知
+//	@receiver c
+//	@param seq 调用序号
+func (c *EvolvingClient) cancelRemote(seq uint64) {
+	select {
+	case c.msgChan <- model.NewRpcMessage(netx.NewDefaultMessage([]byte(contents.Cancel), nil), seq):
+	default:
 	}
-	c.msgChan <- req
 }
 
 // SetCommand
@@ -105,6 +257,62 @@ func (c *EvolvingClient) GetCommand(command string) (f func(reply netx.IMessage)
 	return f
 }
 
+// setPending
+//
+//	@Description: 设置调用序号对应的回调
+//	@receiver c
+//	@param seq 调用序号
+//	@param f 回调方法
+func (c *EvolvingClient) setPending(seq uint64, f func(reply netx.IMessage)) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.pending[seq] = f
+}
+
+// popPending
+//
+//	@Description: 取出并删除调用序号对应的回调
+//	@receiver c
+//	@param seq 调用序号
+//	@return f 回调方法
+func (c *EvolvingClient) popPending(seq uint64) (f func(reply netx.IMessage)) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	f = c.pending[seq]
+	delete(c.pending, seq)
+	return f
+}
+
+// failPending
+//
+//	@Description: 让所有等待回复的调用立即失败
+//	@receiver c
+//	@param err 失败的原因
+func (c *EvolvingClient) failPending(err error) {
+	c.lock.Lock()
+	pending := c.pending
+	c.pending = make(map[uint64]func(message netx.IMessage))
+	c.lock.Unlock()
+	for seq, f := range pending {
+		message := model.NewRpcMessage(netx.NewDefaultMessage(nil, nil), seq)
+		f(model.SetStatus(message, err))
+	}
+}
+
+// unavailableErr
+//
+//	@Description: 连接不可用时的错误信息
+//	@receiver c
+//	@return error 连接可用时为nil
+func (c *EvolvingClient) unavailableErr() error {
+	switch state := c.GetState(); state {
+	case contents.Connected:
+		return nil
+	default:
+		return errorx.Unsent(errorx.New(errorx.Unavailable, "connection to %s:%d is %s", c.conf.EvolvingServerHost, c.conf.EvolvingServerPort, state))
+	}
+}
+
 // start
 //
 //	@Description: 创建连接
@@ -118,44 +326,272 @@ func (c *EvolvingClient) createConn() error {
 
 	dataPack := netx.DataPack{}
 	dataPack.Conn = conn
+	c.lock.Lock()
 	c.dataPack = &dataPack
+	c.lock.Unlock()
 	contents.RpcLogger.Info("start evolving-client successful.")
 	return nil
 }
 
+// getDataPack
+//
+//	@Description: 获取当前的连接包
+//	@receiver c
+//	@return *netx.DataPack
+func (c *EvolvingClient) getDataPack() *netx.DataPack {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.dataPack
+}
+
+// reconnect
+//
+//	@Description: 按带随机抖动的指数退避不断重连，直到成功或者客户端关闭
+//	@receiver c
+//	@return bool 是否重连成功
+func (c *EvolvingClient) reconnect() bool {
+	interval := fun.IfOr(c.conf.ReconnectInterval > 0, c.conf.ReconnectInterval, 500*time.Millisecond)
+	maxInterval := fun.IfOr(c.conf.MaxReconnectInterval > 0, c.conf.MaxReconnectInterval, 30*time.Second)
+	for {
+		//  在[interval/2,interval)之间随机等待，避免大量客户端同时重连
+		wait := interval/2 + time.Duration(rand.Int63n(int64(interval/2)+1))
+		select {
+		case <-c.closeChan:
+			return false
+		case <-time.After(wait):
+		}
+		if err := c.createConn(); err == nil {
+			select {
+			case <-c.closeChan:
+				//  重连的同时客户端被关闭了
+				_ = c.getDataPack().Close()
+				return false
+			default:
+				return true
+			}
+		}
+		interval = fun.IfOr(interval*2 < maxInterval, interval*2, maxInterval)
+	}
+}
+
+// reRegister
+//
+//	@Description: 重连后把注册过的服务重新注册到注册中心
+//	@receiver c
+func (c *EvolvingClient) reRegister() {
+	c.lock.RLock()
+	services := make([]*model.ServiceInfo, 0, len(c.services))
+	for info := range c.services {
+		services = append(services, info)
+	}
+	c.lock.RUnlock()
+	for _, info := range services {
+		c.registerAgain(info, "")
+	}
+}
+
+// registerAgain
+//
+//	@Description: 服务还没有下线时重新注册，和DeregisterService互斥，列出服务之后下线的服务不会被重新注册
+//	@receiver c
+//	@param info 服务的详情信息
+//	@param leaseId 注册中心不认识的租约，服务已经换了租约时不再注册，为空时不检查
+func (c *EvolvingClient) registerAgain(info *model.ServiceInfo, leaseId string) {
+	c.registerLock.Lock()
+	defer c.registerLock.Unlock()
+	c.lock.RLock()
+	lease, ok := c.services[info]
+	c.lock.RUnlock()
+	if !ok || (leaseId != "" && lease != nil && lease.LeaseId != leaseId) {
+		return
+	}
+	if err := c.register(info, nil); err != nil {
+		contents.RpcLogger.Error("re-register service %s failed,err:%v", info.ServiceName, err)
+	}
+}
+
+// forgetService
+//
+//	@Description: 服务被注册中心强制下线后不再续约，重连后也不再重新注册，需要的话由调用方重新注册
+//	@receiver c
+//	@param info 服务的详情信息
+//	@param leaseId 被强制下线的租约，服务已经换了租约时保留
+func (c *EvolvingClient) forgetService(info *model.ServiceInfo, leaseId string) {
+	c.registerLock.Lock()
+	defer c.registerLock.Unlock()
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if lease, ok := c.services[info]; ok && lease != nil && lease.LeaseId == leaseId {
+		delete(c.services, info)
+	}
+}
+
+// reWatch
+//
+//	@Description: 重连后重新订阅服务，订阅的回调会重新收到完整的服务列表
+//	@receiver c
+func (c *EvolvingClient) reWatch() {
+	c.lock.RLock()
+	watches := make(map[string]func(reply netx.IMessage), len(c.watches))
+	for serviceName, callBack := range c.watches {
+		watches[serviceName] = callBack
+	}
+	c.lock.RUnlock()
+	for serviceName, callBack := range watches {
+		c.Execute(c.scopedMessage(contents.Watch, serviceName), callBack)
+	}
+	c.reWatchConfig()
+}
+
+// clearWatches
+//
+//	@Description: 清空订阅，重连后不再重新订阅
+//	@receiver c
+func (c *EvolvingClient) clearWatches() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.watches = make(map[string]func(reply netx.IMessage))
+}
+
+// register
+//
+//	@Description: 注册服务，记下注册中心回复的租约
+//	@receiver c
+//	@param info 服务的详情信息
+//	@param callBack 注册后的回调方法，可以为nil
+//	@return error
+func (c *EvolvingClient) register(info *model.ServiceInfo, callBack func(reply netx.IMessage)) error {
+	c.lock.RLock()
+	bytes, err := json.Marshal(info)
+	c.lock.RUnlock()
+	if err != nil {
+		return err
+	}
+	c.Execute(netx.NewDefaultMessage([]byte(contents.Register), bytes), func(reply netx.IMessage) {
+		if err := model.StatusOf(reply); err != nil {
+			contents.RpcLogger.Error("register service %s failed,err:%v", info.ServiceName, err)
+		} else {
+			var lease model.Lease
+			if err := json.Unmarshal(reply.GetBody(), &lease); err != nil {
+				contents.RpcLogger.Error("register service %s failed,err:%v", info.ServiceName, err)
+			} else {
+				c.lock.Lock()
+				//  注册的回复到达前服务可能已经下线
+				if _, ok := c.services[info]; ok {
+					c.services[info] = &lease
+				}
+				c.lock.Unlock()
+			}
+		}
+		if callBack != nil {
+			callBack(reply)
+		}
+	})
+	return nil
+}
+
+// keepLeases
+//
+//	@Description: 定时给注册过的服务续约，注册中心不认识的租约重新注册
+//	@receiver c
+func (c *EvolvingClient) keepLeases() {
+	for {
+		select {
+		case <-c.closeChan:
+			return
+		case <-time.After(c.leaseInterval()):
+		}
+		c.lock.RLock()
+		leaseIds := make([]string, 0, len(c.services))
+		services := make(map[string]*model.ServiceInfo, len(c.services))
+		for info, lease := range c.services {
+			if lease != nil {
+				leaseIds = append(leaseIds, lease.LeaseId)
+				services[lease.LeaseId] = info
+			}
+		}
+		c.lock.RUnlock()
+		if len(leaseIds) == 0 || c.GetState() != contents.Connected {
+			continue
+		}
+		bytes, _ := json.Marshal(leaseIds)
+		c.Execute(netx.NewDefaultMessage([]byte(contents.ALive), bytes), func(reply netx.IMessage) {
+			if err := model.StatusOf(reply); err != nil {
+				contents.RpcLogger.Warn("keep leases alive failed,err:%v", err)
+				return
+			}
+			var unknown []string
+			if err := json.Unmarshal(reply.GetBody(), &unknown); err != nil {
+				contents.RpcLogger.Error(err.Error())
+				return
+			}
+			for _, leaseId := range unknown {
+				contents.RpcLogger.Warn("lease %s of %s expired, registering again.", leaseId, services[leaseId].ServiceName)
+				c.registerAgain(services[leaseId], leaseId)
+			}
+			if m, ok := reply.(*model.RpcMessage); ok && m.Meta[contents.RevokedLeases] != "" {
+				for _, leaseId := range strings.Split(m.Meta[contents.RevokedLeases], ",") {
+					if info, ok := services[leaseId]; ok {
+						contents.RpcLogger.Warn("lease %s of %s was revoked by the registry, stop keeping it alive.", leaseId, info.ServiceName)
+						c.forgetService(info, leaseId)
+					}
+				}
+			}
+		})
+	}
+}
+
+// leaseInterval
+//
+//	@Description: 续约间隔，为最短租约有效期的1/3
+//	@receiver c
+//	@return time.Duration
+func (c *EvolvingClient) leaseInterval() time.Duration {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	var interval time.Duration
+	for _, lease := range c.services {
+		if lease != nil && lease.TTL/3 > 0 && (interval == 0 || lease.TTL/3 < interval) {
+			interval = lease.TTL / 3
+		}
+	}
+	//  还没有拿到租约时稍后再看
+	return fun.IfOr(interval > 0, interval, time.Second)
+}
+
 // sendMsg
 //
 //	@Description: 发送消息，这里真正将数据包发送到网络上
 //	@receiver c
 func (c *EvolvingClient) sendMsg() {
 	ticker := time.NewTicker(c.conf.HeartbeatInterval)
+	defer ticker.Stop()
 	for {
 		select {
 		case <-ticker.C:
-			if c.closeFlag || c.dataPack == nil {
+			if c.GetState() != contents.Connected {
 				break
 			}
-			err := c.dataPack.Pack([]byte(contents.ALive), nil)
+			err := c.getDataPack().Pack([]byte(contents.ALive), nil)
 			if err != nil {
 				contents.RpcLogger.Error(err.Error())
 				continue
 			}
-		case msg, ok := <-c.msgChan:
-			if ok {
-				if c.closeFlag || c.dataPack == nil {
-					break
-				}
-				err := c.dataPack.PackMessage(msg)
-				if err != nil {
-					contents.RpcLogger.Error(err.Error())
-					continue
+		case msg := <-c.msgChan:
+			dataPack := c.getDataPack()
+			err := model.PackRpcMessage(dataPack, msg)
+			if err != nil {
+				contents.RpcLogger.Error(err.Error())
+				//  发送失败说明连接已经坏了，关闭连接让processMsg去重连，这次调用立即失败
+				_ = dataPack.Close()
+				if m, ok := msg.(*model.RpcMessage); ok {
+					if f := c.popPending(m.Seq); f != nil {
+						f(model.SetStatus(m, errorx.New(errorx.Unavailable, err.Error())))
+					}
 				}
 			}
-		case closeFlag, ok := <-c.closeChan:
-			if ok && closeFlag {
-				close(c.closeChan)
-				return
-			}
+		case <-c.closeChan:
+			return
 		}
 	}
 
@@ -163,11 +599,35 @@ func (c *EvolvingClient) sendMsg() {
 
 // processMsg
 //
-//	@Description: 处理接受的消息，这里是真正的从网络上拿到数据包并执行对应的函数
+//	@Description: 处理接受的消息，这里是真正的从网络上拿到数据包并执行对应的函数，连接断开后自动重连
 //	@receiver c
 func (c *EvolvingClient) processMsg() {
-	for !c.closeFlag && c.dataPack != nil {
-		message, err := c.dataPack.UnPackMessage()
+	for {
+		c.readMsg(c.getDataPack())
+		select {
+		case <-c.closeChan:
+			return
+		default:
+		}
+		c.setState(contents.Disconnected)
+		c.failPending(errorx.New(errorx.Unavailable, "connection to %s:%d lost", c.conf.EvolvingServerHost, c.conf.EvolvingServerPort))
+		if !c.reconnect() {
+			return
+		}
+		c.setState(contents.Connected)
+		c.reRegister()
+		c.reWatch()
+	}
+}
+
+// readMsg
+//
+//	@Description: 从连接上读取消息并回调，直到连接断开
+//	@receiver c
+//	@param dataPack 连接包
+func (c *EvolvingClient) readMsg(dataPack *netx.DataPack) {
+	for {
+		message, err := dataPack.UnPackMessage()
 		if err != nil {
 			_, ok := err.(*net.OpError)
 			if !ok {
@@ -175,15 +635,28 @@ func (c *EvolvingClient) processMsg() {
 			}
 			break
 		}
+		rpcMessage, err := model.UnPackRpcMessage(message)
+		if err != nil {
+			contents.RpcLogger.Error(err.Error())
+		}
+		if rpcMessage.Seq != 0 {
+			//  调用的回复，按调用序号回调
+			if f := c.popPending(rpcMessage.Seq); f != nil {
+				f(rpcMessage)
+			}
+			continue
+		}
+		//  服务端主动推送的消息，按命令回调
 		f := c.GetCommand(string(message.GetCommand()))
-		fun.IfOr(f != nil, f, c.GetCommand(contents.Default))(message)
+		fun.IfOr(f != nil, f, c.GetCommand(contents.Default))(rpcMessage)
 	}
+	_ = dataPack.Close()
 	contents.RpcLogger.Warn("socket closed...")
 }
 
 // RegisterService
 //
-//	@Description: 把服务注册到注册中心
+//	@Description: 把服务注册到注册中心，之后自动续约，回复的消息体是注册中心发放的租约
 //	@receiver c
 //	@param info 服务的详情信息
 //	@param callBack 注册后的回调方法
@@ -192,18 +665,95 @@ func (c *EvolvingClient) RegisterService(info *model.ServiceInfo, callBack func(
 	if info == nil {
 		return errors.New("info or dataPack is nil")
 	}
+	c.lock.Lock()
+	if _, ok := c.services[info]; !ok {
+		c.services[info] = nil
+	}
+	c.lock.Unlock()
+	if err := c.register(info, callBack); err != nil {
+		return err
+	}
+	c.leaseOnce.Do(func() {
+		go c.keepLeases()
+	})
+	return nil
+}
+
+// DrainService
+//
+//	@Description: 把服务标记为DRAINING，订阅方收到后不再发新的调用过来，服务继续续约直到下线
+//	@receiver c
+//	@param info 注册过的服务的详情信息
+//	@param callBack 标记后的回调方法
+//	@return error 标记失败时的错误信息
+func (c *EvolvingClient) DrainService(info *model.ServiceInfo, callBack func(reply netx.IMessage)) error {
+	c.lock.Lock()
+	if _, ok := c.services[info]; !ok {
+		c.lock.Unlock()
+		return errors.New("service " + info.ServiceName + " is not registered")
+	}
+	if info.AdditionalMeta == nil {
+		info.AdditionalMeta = make(map[string]any)
+	}
+	info.AdditionalMeta[contents.Status.String()] = contents.Draining
+	c.lock.Unlock()
+	return c.register(info, callBack)
+}
+
+// DeregisterService
+//
+//	@Description: 服务主动下线，不再续约，服务信息立即从注册中心移除
+//	@receiver c
+//	@param info 注册过的服务的详情信息
+//	@param callBack 下线后的回调方法
+//	@return error 下线失败时的错误信息
+func (c *EvolvingClient) DeregisterService(info *model.ServiceInfo, callBack func(reply netx.IMessage)) error {
+	if info == nil {
+		return errors.New("info is nil")
+	}
+	c.registerLock.Lock()
+	defer c.registerLock.Unlock()
+	c.lock.Lock()
+	delete(c.services, info)
 	bytes, err := json.Marshal(info)
+	c.lock.Unlock()
 	if err != nil {
 		return err
 	}
-	iMessage := netx.NewDefaultMessage([]byte(contents.Register), bytes)
-	c.Execute(iMessage, callBack)
+	c.Execute(netx.NewDefaultMessage([]byte(contents.DeRegister), bytes), callBack)
 	return nil
 }
 
+// Outstanding
+//
+//	@Description: 已经发出还没有收到回复的调用数
+//	@receiver c
+//	@return int
+func (c *EvolvingClient) Outstanding() int {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return len(c.pending)
+}
+
+// closeWhenIdle
+//
+//	@Description: 等待已经发出的调用都收到回复后再关闭客户端
+//	@receiver c
+//	@param timeout 最长的等待时间，超时后直接关闭
+func (c *EvolvingClient) closeWhenIdle(timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if c.Outstanding() == 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Close()
+}
+
 // DisCover
 //
-//	@Description: 发现服务
+//	@Description: 发现配置的命名空间和环境下的服务
 //	@receiver c
 //	@param serviceName 服务名
 //	@param callBack 发现服务后的回调函数
@@ -212,7 +762,114 @@ func (c *EvolvingClient) DisCover(serviceName string, callBack func(reply netx.I
 	if serviceName == "" {
 		return errors.New("serviceName is nil ")
 	}
-	iMessage := netx.NewDefaultMessage([]byte(contents.DisCover), []byte(serviceName))
-	c.Execute(iMessage, callBack)
+	c.Execute(c.scopedMessage(contents.DisCover, serviceName), callBack)
 	return nil
 }
+
+// scopedMessage
+//
+//	@Description: 创建发现或订阅服务的消息，元信息里带上配置的命名空间和环境
+//	@receiver c
+//	@param command 命令
+//	@param serviceName 服务名
+//	@return *model.RpcMessage
+func (c *EvolvingClient) scopedMessage(command, serviceName string) *model.RpcMessage {
+	message := &model.RpcMessage{IMessage: netx.NewDefaultMessage([]byte(command), []byte(serviceName)), Meta: map[string]string{}}
+	if c.conf.Namespace != "" {
+		message.Meta[contents.Namespace] = c.conf.Namespace
+	}
+	if c.conf.Env != "" {
+		message.Meta[contents.Env] = c.conf.Env
+	}
+	return message
+}
+
+// DisCoverBySelector
+//
+//	@Description: 发现配置的命名空间和环境下满足选择器的服务
+//	@receiver c
+//	@param serviceName 服务名
+//	@param selector 选择器 eg:version=2, zone in (a,b), status=UP
+//	@param callBack 发现服务后的回调函数
+//	@return error 服务名为空或者选择器格式错误时的错误信息
+func (c *EvolvingClient) DisCoverBySelector(serviceName, selector string, callBack func(reply netx.IMessage)) error {
+	if serviceName == "" {
+		return errors.New("serviceName is nil ")
+	}
+	if _, err := model.ParseSelector(selector); err != nil {
+		return err
+	}
+	message := c.scopedMessage(contents.DisCover, serviceName)
+	message.Meta[contents.Selector] = selector
+	c.Execute(message, callBack)
+	return nil
+}
+
+// Watch
+//
+//	@Description: 订阅配置的命名空间和环境下服务的变化，断线重连后自动重新订阅
+//	@receiver c
+//	@param serviceName 服务名
+//	@param callBack 收到订阅时完整服务列表的回调，之后的变化事件按WATCH命令回调，需要通过SetCommand设置
+//	@return error 订阅失败时的错误信息
+func (c *EvolvingClient) Watch(serviceName string, callBack func(reply netx.IMessage)) error {
+	if serviceName == "" {
+		return errors.New("serviceName is nil ")
+	}
+	c.lock.Lock()
+	c.watches[serviceName] = callBack
+	c.lock.Unlock()
+	c.Execute(c.scopedMessage(contents.Watch, serviceName), callBack)
+	return nil
+}
+
+// call
+//
+//	@Description: 在连接上调用服务的方法，入参和结果按调用选项指定的协议编解码
+//	@param ctx
+//	@param client 连接
+//	@param handler 编解码注册表
+//	@param command 命令
+//	@param req 命令入参
+//	@param resp 接收命令结果的指针，为nil时忽略结果
+//	@param o 调用选项
+//	@return error 失败时的错误信息，为*errorx.StatusError
+func call(ctx context.Context, client *EvolvingClient, handler *protocHandler, command string, req any, resp any, o *callOptions) error {
+	bytes, err := handler.marshal(o.protoc, req)
+	if err != nil {
+		return err
+	}
+	reply, err := client.ExecuteContext(ctx, newCallMessage(command, bytes, o))
+	if err != nil {
+		return err
+	}
+	return decodeReply(handler, reply, resp, o)
+}
+
+// newCallMessage
+//
+//	@Description: 创建调用消息，每次发送都要新建，发送时会设置调用序号
+//	@param command 命令
+//	@param bytes 编码后的命令入参
+//	@param o 调用选项
+//	@return *model.RpcMessage
+func newCallMessage(command string, bytes []byte, o *callOptions) *model.RpcMessage {
+	message := model.NewRpcMessage(netx.NewDefaultMessage([]byte(command), bytes), 0)
+	message.Protoc = o.protoc
+	return message
+}
+
+// decodeReply
+//
+//	@Description: 按回复的编码协议解码命令结果，回复里没有指定时使用调用选项的协议
+//	@param handler 编解码注册表
+//	@param reply 回复消息
+//	@param resp 接收命令结果的指针，为nil时忽略结果
+//	@param o 调用选项
+//	@return error
+func decodeReply(handler *protocHandler, reply netx.IMessage, resp any, o *callOptions) error {
+	if resp == nil || len(reply.GetBody()) == 0 {
+		return nil
+	}
+	return handler.unmarshal(fun.IfOr(model.ProtocOf(reply) != "", model.ProtocOf(reply), o.protoc), reply.GetBody(), resp)
+}
@@ -0,0 +1,147 @@
+package evolving_client
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/yuhao-jack/evolving-rpc/contents"
+	"github.com/yuhao-jack/evolving-rpc/model"
+	"github.com/yuhao-jack/go-toolx/netx"
+)
+
+// GetConfig
+//
+//	@Description: 读取配置的命名空间下服务的配置，回复的消息体是json格式的配置
+//	@receiver c
+//	@param serviceName 服务名
+//	@param version 版本，为0时读取最新版本
+//	@param callBack 读取后的回调函数，配置不存在时回复NotFound
+//	@return error
+func (c *EvolvingClient) GetConfig(serviceName string, version uint64, callBack func(reply netx.IMessage)) error {
+	if serviceName == "" {
+		return errors.New("serviceName is nil ")
+	}
+	message := c.scopedMessage(contents.GetConfig, serviceName)
+	if version > 0 {
+		message.Meta[contents.ConfigVersion] = fmt.Sprint(version)
+	}
+	c.Execute(message, callBack)
+	return nil
+}
+
+// WatchConfig
+//
+//	@Description: 订阅配置的命名空间下服务的配置，订阅时和之后每次发布新版本都会回调，断线重连后自动重新订阅
+//	@receiver c
+//	@param serviceName 服务名
+//	@param callBack 配置变化的回调，在收消息的协程里执行，不能阻塞
+//	@return error
+func (c *EvolvingClient) WatchConfig(serviceName string, callBack func(config *model.Config)) error {
+	if serviceName == "" || callBack == nil {
+		return errors.New("serviceName or callBack is nil ")
+	}
+	c.lock.Lock()
+	c.configWatches[serviceName] = callBack
+	c.lock.Unlock()
+	c.Execute(c.scopedMessage(contents.WatchConfig, serviceName), c.onConfig)
+	return nil
+}
+
+// PushConfig
+//
+//	@Description: 在配置的命名空间下发布服务的新版本的配置，回复的消息体是发布的配置
+//	@receiver c
+//	@param serviceName 服务名
+//	@param data 配置内容
+//	@param callBack 发布后的回调函数，可以为nil
+//	@return error
+func (c *EvolvingClient) PushConfig(serviceName string, data map[string]string, callBack func(reply netx.IMessage)) error {
+	return c.executeConfig(contents.PushConfig, &model.Config{ServiceName: serviceName, Data: data}, callBack)
+}
+
+// RollbackConfig
+//
+//	@Description: 把配置的命名空间下服务的配置回滚到之前的版本，原来版本的内容作为新版本发布，回复的消息体是回滚后发布的配置
+//	@receiver c
+//	@param serviceName 服务名
+//	@param version 要回滚到的版本
+//	@param callBack 回滚后的回调函数，版本不存在时回复NotFound，可以为nil
+//	@return error
+func (c *EvolvingClient) RollbackConfig(serviceName string, version uint64, callBack func(reply netx.IMessage)) error {
+	if version == 0 {
+		return errors.New("version is 0 ")
+	}
+	return c.executeConfig(contents.RollbackConfig, &model.Config{ServiceName: serviceName, Version: version}, callBack)
+}
+
+// executeConfig
+//
+//	@Description: 发送修改配置的命令，带上配置的令牌
+//	@receiver c
+//	@param command 命令
+//	@param config 配置，命名空间使用客户端配置的
+//	@param callBack 回调函数，可以为nil
+//	@return error
+func (c *EvolvingClient) executeConfig(command string, config *model.Config, callBack func(reply netx.IMessage)) error {
+	if config.ServiceName == "" {
+		return errors.New("serviceName is nil ")
+	}
+	config.Namespace = c.conf.Namespace
+	bytes, err := json.Marshal(config)
+	if err != nil {
+		return err
+	}
+	message := model.NewRpcMessage(netx.NewDefaultMessage([]byte(command), bytes), 0)
+	if c.conf.ConfigToken != "" {
+		message.Meta = map[string]string{contents.ConfigToken: c.conf.ConfigToken}
+	}
+	c.Execute(message, callBack)
+	return nil
+}
+
+// onConfig
+//
+//	@Description: 收到订阅时的配置或者推送的新版本，版本有变化时回调
+//	@receiver c
+//	@param reply
+func (c *EvolvingClient) onConfig(reply netx.IMessage) {
+	if err := model.StatusOf(reply); err != nil {
+		contents.RpcLogger.Error("watch config failed,err:%v", err)
+		return
+	}
+	var config *model.Config
+	if err := json.Unmarshal(reply.GetBody(), &config); err != nil {
+		contents.RpcLogger.Error("bad config %s,err:%v", string(reply.GetBody()), err)
+		return
+	}
+	if config == nil {
+		//  还没有发布过配置
+		return
+	}
+	c.lock.Lock()
+	callBack := c.configWatches[config.ServiceName]
+	//  注册中心重启后版本会从头开始，只要和上次不同就回调
+	if callBack == nil || c.configVersion[config.ServiceName] == config.Version {
+		c.lock.Unlock()
+		return
+	}
+	c.configVersion[config.ServiceName] = config.Version
+	c.lock.Unlock()
+	callBack(config)
+}
+
+// reWatchConfig
+//
+//	@Description: 重连后重新订阅配置，断线期间发布的版本会在订阅时回调
+//	@receiver c
+func (c *EvolvingClient) reWatchConfig() {
+	c.lock.RLock()
+	serviceNames := make([]string, 0, len(c.configWatches))
+	for serviceName := range c.configWatches {
+		serviceNames = append(serviceNames, serviceName)
+	}
+	c.lock.RUnlock()
+	for _, serviceName := range serviceNames {
+		c.Execute(c.scopedMessage(contents.WatchConfig, serviceName), c.onConfig)
+	}
+}
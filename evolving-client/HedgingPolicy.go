@@ -0,0 +1,141 @@
+package evolving_client
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// latencySamples 每个方法保留最近多少次成功调用的耗时
+const latencySamples = 100
+
+// minLatencySamples 耗时样本不足时按HedgingPolicy.MaxDelay发出第二个调用
+const minLatencySamples = 10
+
+// HedgingPolicy
+// @Description: 对冲调用策略，调用在一段时间内没有回复时再发给另一个服务实例，先成功的回复作为结果，
+// 另一个调用被取消，同一次调用可能被执行两次，只给只读或者幂等的方法开启
+type HedgingPolicy struct {
+	Percentile float64       // 按最近成功调用耗时的哪个分位数作为发出第二个调用的延迟，为0时为0.95
+	MinDelay   time.Duration // 延迟的下限，避免分位数过低时调用量翻倍
+	MaxDelay   time.Duration // 延迟的上限，最近的调用不足10次时也使用这个延迟，为0时为1s
+}
+
+// delay
+//
+//	@Description: 按最近成功调用的耗时计算发出第二个调用的延迟
+//	@receiver p
+//	@param latencies 最近成功调用的耗时
+//	@return time.Duration
+func (p *HedgingPolicy) delay(latencies []time.Duration) time.Duration {
+	maxDelay := p.MaxDelay
+	if maxDelay <= 0 {
+		maxDelay = time.Second
+	}
+	if len(latencies) < minLatencySamples {
+		return maxDelay
+	}
+	percentile := p.Percentile
+	if percentile <= 0 || percentile > 1 {
+		percentile = 0.95
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	d := latencies[int(percentile*float64(len(latencies)-1))]
+	if d < p.MinDelay {
+		return p.MinDelay
+	}
+	if d > maxDelay {
+		return maxDelay
+	}
+	return d
+}
+
+// latencyWindow
+// @Description: 一个方法最近成功调用的耗时，环形缓冲
+type latencyWindow struct {
+	samples []time.Duration
+	next    int
+}
+
+// hedging
+// @Description: 按方法设置的对冲调用策略和方法最近的调用耗时
+type hedging struct {
+	lock      sync.Mutex
+	policies  map[string]*HedgingPolicy
+	latencies map[string]*latencyWindow
+}
+
+func newHedging() *hedging {
+	return &hedging{policies: map[string]*HedgingPolicy{}, latencies: map[string]*latencyWindow{}}
+}
+
+// setPolicy
+//
+//	@Description: 设置方法的对冲调用策略
+//	@receiver h
+//	@param key 方法
+//	@param policy 对冲调用策略，为nil时删除
+func (h *hedging) setPolicy(key string, policy *HedgingPolicy) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if policy == nil {
+		delete(h.policies, key)
+		delete(h.latencies, key)
+		return
+	}
+	h.policies[key] = policy
+}
+
+// policyOf
+//
+//	@Description: 获取方法的对冲调用策略
+//	@receiver h
+//	@param key 方法
+//	@return *HedgingPolicy 没有开启时为nil
+func (h *hedging) policyOf(key string) *HedgingPolicy {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return h.policies[key]
+}
+
+// record
+//
+//	@Description: 记录开启了对冲调用的方法的成功调用耗时
+//	@receiver h
+//	@param key 方法
+//	@param elapsed 调用耗时
+func (h *hedging) record(key string, elapsed time.Duration) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if _, ok := h.policies[key]; !ok {
+		return
+	}
+	w, ok := h.latencies[key]
+	if !ok {
+		w = &latencyWindow{}
+		h.latencies[key] = w
+	}
+	if len(w.samples) < latencySamples {
+		w.samples = append(w.samples, elapsed)
+		return
+	}
+	w.samples[w.next] = elapsed
+	w.next = (w.next + 1) % latencySamples
+}
+
+// delay
+//
+//	@Description: 方法发出第二个调用前的延迟
+//	@receiver h
+//	@param key 方法
+//	@param policy 方法的对冲调用策略
+//	@return time.Duration
+func (h *hedging) delay(key string, policy *HedgingPolicy) time.Duration {
+	h.lock.Lock()
+	var latencies []time.Duration
+	if w, ok := h.latencies[key]; ok {
+		latencies = append(latencies, w.samples...)
+	}
+	h.lock.Unlock()
+	return policy.delay(latencies)
+}
@@ -0,0 +1,100 @@
+package evolving_client
+
+import (
+	"github.com/yuhao-jack/evolving-rpc/codec"
+	"github.com/yuhao-jack/evolving-rpc/contents"
+	"github.com/yuhao-jack/evolving-rpc/errorx"
+	"github.com/yuhao-jack/go-toolx/containerx"
+	"sync"
+)
+
+// protocHandler
+// @Description: 客户端的编解码注册表，默认注册json和protobuf编解码
+type protocHandler struct {
+	protocUnmarshalHandlerMap *containerx.ConcurrentMap[string, func(in []byte, recv any) error]
+	protocMarshalHandlerMap   *containerx.ConcurrentMap[string, func(recv any) ([]byte, error)]
+	defaultProtoc             string
+	lock                      sync.RWMutex
+}
+
+// newProtocHandler
+//
+//	@Description: 创建客户端的编解码注册表
+//	@param defaultProtoc 默认的编码协议，为空时使用json
+//	@return *protocHandler
+func newProtocHandler(defaultProtoc string) *protocHandler {
+	h := &protocHandler{
+		protocUnmarshalHandlerMap: containerx.NewConcurrentMap[string, func(in []byte, recv any) error](),
+		protocMarshalHandlerMap:   containerx.NewConcurrentMap[string, func(recv any) ([]byte, error)](),
+	}
+	h.protocUnmarshalHandlerMap.Set(contents.Json, codec.JsonUnmarshal)
+	h.protocMarshalHandlerMap.Set(contents.Json, codec.JsonMarshal)
+	h.protocUnmarshalHandlerMap.Set(contents.Pb, codec.PbUnmarshal)
+	h.protocMarshalHandlerMap.Set(contents.Pb, codec.PbMarshal)
+	h.setDefaultProtoc(defaultProtoc)
+	return h
+}
+
+// setDefaultProtoc
+//
+//	@Description: 设置默认的编码协议
+//	@receiver h
+//	@param protoc 编码协议，为空时使用json
+func (h *protocHandler) setDefaultProtoc(protoc string) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if protoc == "" {
+		protoc = contents.Json
+	}
+	h.defaultProtoc = protoc
+}
+
+// getDefaultProtoc
+//
+//	@Description: 获取默认的编码协议
+//	@receiver h
+//	@return string
+func (h *protocHandler) getDefaultProtoc() string {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	return h.defaultProtoc
+}
+
+// marshal
+//
+//	@Description: 按协议编码
+//	@receiver h
+//	@param protoc 编码协议
+//	@param recv
+//	@return []byte
+//	@return error 协议没有注册或者编码失败时的错误信息
+func (h *protocHandler) marshal(protoc string, recv any) ([]byte, error) {
+	marshalHandler, ok := h.protocMarshalHandlerMap.Get(protoc)
+	if !ok {
+		return nil, errorx.New(errorx.UnsupportedProtoc, "client has no marshal handler for protoc %s", protoc)
+	}
+	bytes, err := marshalHandler(recv)
+	if err != nil {
+		return nil, errorx.WithCode(errorx.BadRequest, err)
+	}
+	return bytes, nil
+}
+
+// unmarshal
+//
+//	@Description: 按协议解码
+//	@receiver h
+//	@param protoc 编码协议
+//	@param in
+//	@param recv 接收结果的指针
+//	@return error 协议没有注册或者解码失败时的错误信息
+func (h *protocHandler) unmarshal(protoc string, in []byte, recv any) error {
+	unmarshalHandler, ok := h.protocUnmarshalHandlerMap.Get(protoc)
+	if !ok {
+		return errorx.New(errorx.UnsupportedProtoc, "client has no unmarshal handler for protoc %s", protoc)
+	}
+	if err := unmarshalHandler(in, recv); err != nil {
+		return errorx.WithCode(errorx.Internal, err)
+	}
+	return nil
+}
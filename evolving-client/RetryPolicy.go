@@ -0,0 +1,205 @@
+package evolving_client
+
+import (
+	"context"
+	"github.com/yuhao-jack/evolving-rpc/errorx"
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// RetryPolicy
+// @Description: 方法调用失败后的重试策略
+type RetryPolicy struct {
+	MaxAttempts       int           // 最多调用几次，包括第一次，小于2时不重试
+	InitialBackoff    time.Duration // 第一次重试前的最长等待时间，为0时为50ms
+	MaxBackoff        time.Duration // 重试前的最长等待时间，为0时为1s
+	BackoffMultiplier float64       // 每次重试后等待时间的增长倍数，小于1时为2
+	RetryableCodes    []errorx.Code // 哪些状态码的错误需要重试，为空时只重试errorx.Unavailable
+	Idempotent        bool          // 方法是否幂等，不是幂等的方法只在请求确定没有发出时重试
+}
+
+// retryable
+//
+//	@Description: 调用失败后是否可以重试
+//	@receiver p
+//	@param err 调用的错误信息
+//	@return bool
+func (p *RetryPolicy) retryable(err error) bool {
+	if !p.Idempotent && !errorx.IsUnsent(err) {
+		return false
+	}
+	code := errorx.CodeOf(err)
+	if len(p.RetryableCodes) == 0 {
+		return code == errorx.Unavailable
+	}
+	for _, c := range p.RetryableCodes {
+		if c == code {
+			return true
+		}
+	}
+	return false
+}
+
+// backoff
+//
+//	@Description: 第n次重试前的等待时间，在0到指数增长的上限之间随机，避免调用方同时重试
+//	@receiver p
+//	@param n 第几次重试，从1开始
+//	@return time.Duration
+func (p *RetryPolicy) backoff(n int) time.Duration {
+	initial := p.InitialBackoff
+	if initial <= 0 {
+		initial = 50 * time.Millisecond
+	}
+	maxBackoff := p.MaxBackoff
+	if maxBackoff <= 0 {
+		maxBackoff = time.Second
+	}
+	multiplier := p.BackoffMultiplier
+	if multiplier < 1 {
+		multiplier = 2
+	}
+	limit := math.Min(float64(initial)*math.Pow(multiplier, float64(n-1)), float64(maxBackoff))
+	return time.Duration(rand.Int63n(int64(limit) + 1))
+}
+
+// RetryBudget
+// @Description: 客户端所有方法共用的重试预算，每次可重试的失败扣掉一个令牌，每次成功返还tokenRatio个令牌，
+// 令牌不超过总数的一半时不再重试，服务大面积故障时重试不会把调用量放大
+type RetryBudget struct {
+	lock       sync.Mutex
+	maxTokens  float64
+	tokens     float64
+	tokenRatio float64
+}
+
+// NewRetryBudget
+//
+//	@Description: 创建重试预算
+//	@param maxTokens 令牌总数 eg:10
+//	@param tokenRatio 每次成功返还的令牌数 eg:0.1 即持续失败时大约每10次成功的调用允许1次重试
+//	@return *RetryBudget
+func NewRetryBudget(maxTokens, tokenRatio float64) *RetryBudget {
+	return &RetryBudget{maxTokens: maxTokens, tokens: maxTokens, tokenRatio: tokenRatio}
+}
+
+// onSuccess
+//
+//	@Description: 调用成功，返还令牌
+//	@receiver b
+func (b *RetryBudget) onSuccess() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.tokens = math.Min(b.tokens+b.tokenRatio, b.maxTokens)
+}
+
+// onFailure
+//
+//	@Description: 可重试的失败，扣掉一个令牌并返回是否还能重试
+//	@receiver b
+//	@return bool
+func (b *RetryBudget) onFailure() bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.tokens = math.Max(b.tokens-1, 0)
+	return b.tokens > b.maxTokens/2
+}
+
+// retryer
+// @Description: 按方法设置的重试策略和客户端的重试预算执行调用
+type retryer struct {
+	lock     sync.RWMutex
+	policies map[string]*RetryPolicy
+	budget   *RetryBudget
+}
+
+func newRetryer() *retryer {
+	return &retryer{policies: map[string]*RetryPolicy{}, budget: NewRetryBudget(10, 0.1)}
+}
+
+// setPolicy
+//
+//	@Description: 设置重试策略
+//	@receiver r
+//	@param key 方法
+//	@param policy 重试策略，为nil时删除
+func (r *retryer) setPolicy(key string, policy *RetryPolicy) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if policy == nil {
+		delete(r.policies, key)
+		return
+	}
+	r.policies[key] = policy
+}
+
+// policyOf
+//
+//	@Description: 按顺序查找重试策略
+//	@receiver r
+//	@param keys 方法，以及没有单独设置时的默认策略
+//	@return *RetryPolicy 没有时为nil
+func (r *retryer) policyOf(keys ...string) *RetryPolicy {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	for _, key := range keys {
+		if policy, ok := r.policies[key]; ok {
+			return policy
+		}
+	}
+	return nil
+}
+
+// setBudget
+//
+//	@Description: 设置重试预算
+//	@receiver r
+//	@param budget 重试预算，为nil时不限制
+func (r *retryer) setBudget(budget *RetryBudget) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.budget = budget
+}
+
+// do
+//
+//	@Description: 执行调用，失败后按重试策略重试，context取消或超时后不再重试
+//	@receiver r
+//	@param ctx 调用的context
+//	@param policy 重试策略，为nil时不重试
+//	@param attempt 执行一次调用
+//	@return error 最后一次调用的错误信息
+func (r *retryer) do(ctx context.Context, policy *RetryPolicy, attempt func() error) error {
+	err := attempt()
+	if policy == nil {
+		return err
+	}
+	r.lock.RLock()
+	budget := r.budget
+	r.lock.RUnlock()
+	for n := 1; ; n++ {
+		if err == nil {
+			if budget != nil {
+				budget.onSuccess()
+			}
+			return nil
+		}
+		if ctx.Err() != nil || !policy.retryable(err) {
+			return err
+		}
+		allowed := budget == nil || budget.onFailure()
+		if n >= policy.MaxAttempts || !allowed {
+			return err
+		}
+		timer := time.NewTimer(policy.backoff(n))
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		}
+		err = attempt()
+	}
+}
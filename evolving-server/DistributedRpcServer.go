@@ -1,53 +1,29 @@
 package evolving_server
 
 import (
-	"encoding/json"
-	"errors"
-	"fmt"
 	"github.com/yuhao-jack/evolving-rpc/contents"
 	evolvingclient "github.com/yuhao-jack/evolving-rpc/evolving-client"
 	"github.com/yuhao-jack/evolving-rpc/model"
 	"github.com/yuhao-jack/go-toolx/fun"
 	"github.com/yuhao-jack/go-toolx/netx"
-	"go/token"
-	"reflect"
-	"strings"
-	"sync"
+	"time"
 )
 
-var unknownProtocErr = errors.New("error: unknown protoc")
-
 // IRpcServer
 // @Description:
 type IRpcServer interface {
 	Register(rcvr any) error
 }
 
-// methodType
-// @Description:
-type methodType struct {
-	sync.Mutex
-	method    reflect.Method
-	ReqType   reflect.Type
-	ReplyType reflect.Type
-}
-
-// service
-// @Description:
-type service struct {
-	name   string                 // name of service
-	rcvr   reflect.Value          // receiver of methods for the service
-	typ    reflect.Type           // type of the receiver
-	method map[string]*methodType // registered methods
-}
-
 // DistributedRpcServer
 // @Description:
 type DistributedRpcServer struct {
-	serviceMap           map[string]*service
+	dispatcher           *rpcDispatcher
 	registerCenterConfig *model.EvolvingClientConfig
 	serverConfig         *model.ServiceInfo
 	evolvingServer       *EvolvingServer
+	registerCenter       *evolvingclient.EvolvingClient
+	drainTimeout         time.Duration
 }
 
 // NewDistributedRpcServer
@@ -58,7 +34,7 @@ type DistributedRpcServer struct {
 //	@return *RpcServer
 func NewDistributedRpcServer(registerCenterConfig *model.EvolvingClientConfig, serverConfig *model.ServiceInfo) *DistributedRpcServer {
 	rpcServer := DistributedRpcServer{
-		serviceMap:           map[string]*service{},
+		dispatcher:           newRpcDispatcher(),
 		registerCenterConfig: registerCenterConfig,
 		serverConfig:         serverConfig,
 	}
@@ -71,9 +47,11 @@ func NewDistributedRpcServer(registerCenterConfig *model.EvolvingClientConfig, s
 	}); err != nil {
 		panic("register service to register-center failed ,err:" + err.Error())
 	}
+	rpcServer.registerCenter = evolvingClient
 	rpcServer.evolvingServer = NewEvolvingServer(&model.EvolvingServerConf{
-		BindHost:   serverConfig.ServiceHost,
-		ServerPort: serverConfig.ServicePort,
+		BindHost:          serverConfig.ServiceHost,
+		ServerPort:        serverConfig.ServicePort,
+		HeartbeatInterval: evolvingclient.ServiceHeartbeatInterval,
 	})
 	return &rpcServer
 }
@@ -85,125 +63,94 @@ func NewDistributedRpcServer(registerCenterConfig *model.EvolvingClientConfig, s
 //	@param rcvr
 //	@return error
 func (r *DistributedRpcServer) Register(rcvr any) error {
-	s := new(service)
-	s.typ = reflect.TypeOf(rcvr)
-	s.rcvr = reflect.ValueOf(rcvr)
-	s.name = reflect.Indirect(s.rcvr).Type().Name()
-
-	if fun.IsBlank(s.name) {
-		return errors.New("no service name for type " + s.typ.String())
-	}
-	s.method = make(map[string]*methodType)
-	buildMethodMap(s)
-	if len(s.method) == 0 {
-		return errors.New(s.name + " has no exported methods of suitable type")
-	}
-	r.serviceMap[s.name] = s
-	return nil
+	return r.dispatcher.register(rcvr)
 }
 
-// Close
+// Use
 //
-//	@Description: 关闭服务
+//	@Description: 添加拦截器，先添加的拦截器在外层，拦截器和编解码方法panic时这次调用返回内部错误，不影响连接和其他调用
 //	@receiver r
-//	@Author yuhao
-//	@Data 2023-03-02 10:36:18
-func (r *DistributedRpcServer) Close() {
-	r.evolvingServer.Close()
+//	@param interceptors
+func (r *DistributedRpcServer) Use(interceptors ...RpcInterceptor) {
+	r.dispatcher.use(interceptors...)
 }
 
-// Run
+// SetProtocUnmarshalHandler
 //
-//	@Description:
+//	@Description: 设置Unmarshal处理方法
 //	@receiver r
-func (r *DistributedRpcServer) Run() {
-	for n, server := range r.serviceMap {
-		for s := range server.method {
-			r.evolvingServer.SetCommand(fmt.Sprint(n, ".", s), func(dataPack *netx.DataPack, reply netx.IMessage) {
-				splitArr := strings.Split(string(reply.GetCommand()), ".")
-				var reqv reflect.Value
-				ts := r.serviceMap[splitArr[0]]
-				tm := ts.method[splitArr[1]]
-				reqv = reflect.New(tm.ReqType)
-
-				var err error
-				var command = string(reply.GetProtoc())
-				switch command {
-				case contents.Json:
-					if reply.GetBody() != nil {
-						err = json.Unmarshal(reply.GetBody(), reqv.Interface())
-					}
-				default:
-					err = unknownProtocErr
-				}
-				if err != nil {
-					reply.SetBody([]byte(err.Error()))
-					r.evolvingServer.Execute(dataPack, reply, nil)
-					return
-				}
+//	@param protoc
+//	@param handler
+func (r *DistributedRpcServer) SetProtocUnmarshalHandler(protoc string, handler func(in []byte, recv any) error) {
+	r.dispatcher.setProtocUnmarshalHandler(protoc, handler)
+}
 
-				res := tm.method.Func.Call([]reflect.Value{ts.rcvr, reflect.Indirect(reqv)})[0].Interface()
-				if res != nil {
-					var bytes []byte
-					switch command {
-					case contents.Json:
-						bytes, err = json.Marshal(res)
-					default:
-						err = unknownProtocErr
-					}
+// SetProtocMarshalHandler
+//
+//	@Description: 设置Marshal处理方法
+//	@receiver r
+//	@param protoc
+//	@param handler
+func (r *DistributedRpcServer) SetProtocMarshalHandler(protoc string, handler func(recv any) ([]byte, error)) {
+	r.dispatcher.setProtocMarshalHandler(protoc, handler)
+}
 
-					if err != nil {
-						reply.SetBody([]byte(err.Error()))
-					} else {
-						reply.SetBody(bytes)
-					}
-				}
-				r.evolvingServer.Execute(dataPack, reply, nil)
-			})
-		}
+// SetDrainTimeout
+//
+//	@Description: 设置关闭时等待正在处理的调用完成的最长时间
+//	@receiver r
+//	@param timeout 为0时为10s
+func (r *DistributedRpcServer) SetDrainTimeout(timeout time.Duration) {
+	r.drainTimeout = timeout
+}
 
+// Close
+//
+//	@Description: 优雅关闭服务，先标记为DRAINING让调用方不再发新的调用过来，
+//	等正在处理的调用完成后从注册中心下线，最后断开所有连接
+//	@receiver r
+//	@Author yuhao
+//	@Data 2023-03-02 10:36:18
+func (r *DistributedRpcServer) Close() {
+	timeout := fun.IfOr(r.drainTimeout > 0, r.drainTimeout, 10*time.Second)
+	r.waitRegisterCenter(timeout, r.registerCenter.DrainService)
+	if !r.dispatcher.drain(timeout) {
+		contents.RpcLogger.Warn("service %s still has calls in flight after %v.", r.serverConfig.ServiceName, timeout)
 	}
-	r.evolvingServer.Start()
+	r.waitRegisterCenter(timeout, r.registerCenter.DeregisterService)
+	r.registerCenter.Close()
+	r.evolvingServer.Close()
 }
 
-// buildMethodMap
+// waitRegisterCenter
 //
-//	@Description:
-//	@param s
-func buildMethodMap(s *service) {
-	for m := 0; m < s.typ.NumMethod(); m++ {
-		method := s.typ.Method(m)
-		if !method.IsExported() {
-			continue
-		}
-		if method.Type.NumIn() != 2 {
-			continue
-		}
-		reqType := method.Type.In(1)
-		if !isExportedOrBuiltinType(reqType) {
-			continue
-		}
-
-		if method.Type.NumOut() != 1 {
-			continue
-		}
-		replyType := method.Type.Out(0) // must be a pointer.
-		if !isExportedOrBuiltinType(replyType) {
-			continue
+//	@Description: 向注册中心发送服务的状态变化并等待回复
+//	@receiver r
+//	@param timeout 最长的等待时间
+//	@param execute 发送的方法 eg:DrainService
+func (r *DistributedRpcServer) waitRegisterCenter(timeout time.Duration, execute func(info *model.ServiceInfo, callBack func(reply netx.IMessage)) error) {
+	done := make(chan netx.IMessage, 1)
+	if err := execute(r.serverConfig, func(reply netx.IMessage) {
+		done <- reply
+	}); err != nil {
+		contents.RpcLogger.Error(err.Error())
+		return
+	}
+	select {
+	case reply := <-done:
+		if err := model.StatusOf(reply); err != nil {
+			contents.RpcLogger.Error(err.Error())
 		}
-
-		s.method[method.Name] = &methodType{Mutex: sync.Mutex{}, method: method, ReqType: reqType, ReplyType: replyType}
+	case <-time.After(timeout):
+		contents.RpcLogger.Warn("register-center did not reply in %v.", timeout)
 	}
 }
 
-// isExportedOrBuiltinType
+// Run
 //
 //	@Description:
-//	@param t
-//	@return bool
-func isExportedOrBuiltinType(t reflect.Type) bool {
-	for t.Kind() == reflect.Pointer {
-		t = t.Elem()
-	}
-	return token.IsExported(t.Name()) || t.PkgPath() == ""
+//	@receiver r
+func (r *DistributedRpcServer) Run() {
+	r.dispatcher.serve(r.evolvingServer)
+	r.evolvingServer.Start()
 }
@@ -1,7 +1,9 @@
 package evolving_server
 
 import (
+	"crypto/subtle"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/yuhao-jack/evolving-rpc/contents"
 	"github.com/yuhao-jack/evolving-rpc/errorx"
@@ -10,6 +12,10 @@ import (
 	"github.com/yuhao-jack/go-toolx/fun"
 	"github.com/yuhao-jack/go-toolx/netx"
 	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 )
@@ -19,10 +25,16 @@ import (
 type EvolvingServer struct {
 	conf            *model.EvolvingServerConf
 	dataPackChanMap map[*netx.DataPack]chan netx.IMessage
+	writerDone      map[*netx.DataPack]chan struct{} // 连接断开后关闭，发送协程退出，发送队列本身不关闭
+	connectedAt     map[*netx.DataPack]time.Time
 	commands        map[string]func(dataPack *netx.DataPack, reply netx.IMessage)
 	dataPackLock    *sync.RWMutex
 	commandLock     *sync.RWMutex
+	listener        *net.TCPListener
 	closeFlag       bool
+	handlers        sync.WaitGroup      // 正在运行的连接处理协程，关闭时等它们处理完断开再关闭服务管理器
+	serviceMgr      *svr_mgr.ServiceMgr // 注册中心的服务管理器，没有开启注册中心时为nil
+	serviceLost     func(serviceInfo *model.ServiceInfo)
 }
 
 // NewEvolvingServer
@@ -34,6 +46,8 @@ func NewEvolvingServer(conf *model.EvolvingServerConf) *EvolvingServer {
 	evolvingServer := EvolvingServer{
 		conf:            conf,
 		dataPackChanMap: make(map[*netx.DataPack]chan netx.IMessage),
+		writerDone:      make(map[*netx.DataPack]chan struct{}),
+		connectedAt:     make(map[*netx.DataPack]time.Time),
 		commands:        make(map[string]func(dataPack *netx.DataPack, reply netx.IMessage)),
 		commandLock:     &sync.RWMutex{},
 		dataPackLock:    &sync.RWMutex{},
@@ -46,15 +60,80 @@ func NewEvolvingServer(conf *model.EvolvingServerConf) *EvolvingServer {
 	evolvingServer.SetCommand(contents.Default, func(dataPack *netx.DataPack, reply netx.IMessage) {
 		Default(reply, dataPack, evolvingServer.sendMsg)
 	})
+	return &evolvingServer
+}
+
+// EnableRegistry
+//
+//	@Description: 开启注册中心，服务端开始处理注册、续约、发现、订阅和配置，注册信息保存在服务端自己的服务管理器中，可以重复调用，
+//	发布和回滚配置需要带上ConfigToken，没有配置令牌时任何连上的调用方都能修改任何服务的配置
+//	@receiver s
+//	@return *svr_mgr.ServiceMgr 服务端的服务管理器
+func (s *EvolvingServer) EnableRegistry() *svr_mgr.ServiceMgr {
+	s.commandLock.Lock()
+	if s.serviceMgr != nil {
+		s.commandLock.Unlock()
+		return s.serviceMgr
+	}
+	mgr := svr_mgr.NewServiceMgr()
+	s.serviceMgr = mgr
+	if s.serviceLost == nil {
+		s.serviceLost = mgr.MarkServiceDown
+	}
+	s.commandLock.Unlock()
+	//  heartbeat，带租约ID时续约
+	s.SetCommand(contents.ALive, func(dataPack *netx.DataPack, reply netx.IMessage) {
+		if len(reply.GetBody()) == 0 {
+			s.sendMsg(dataPack, netx.NewDefaultMessage([]byte(contents.ALive), []byte(contents.OK)))
+			return
+		}
+		KeepAlive(mgr, reply, dataPack, s.sendMsg)
+	})
 	//  register
-	evolvingServer.SetCommand(contents.Register, func(dataPack *netx.DataPack, reply netx.IMessage) {
-		Register(reply, dataPack, evolvingServer.sendMsg)
+	s.SetCommand(contents.Register, func(dataPack *netx.DataPack, reply netx.IMessage) {
+		Register(mgr, reply, dataPack, s.sendMsg)
 	})
 	// discover
-	evolvingServer.SetCommand(contents.DisCover, func(dataPack *netx.DataPack, reply netx.IMessage) {
-		DisCover(reply, dataPack, evolvingServer.sendMsg)
+	s.SetCommand(contents.DisCover, func(dataPack *netx.DataPack, reply netx.IMessage) {
+		DisCover(mgr, reply, dataPack, s.sendMsg)
 	})
-	return &evolvingServer
+	// deregister
+	s.SetCommand(contents.DeRegister, func(dataPack *netx.DataPack, reply netx.IMessage) {
+		DeRegister(mgr, reply, dataPack, s.sendMsg)
+	})
+	// watch
+	s.SetCommand(contents.Watch, func(dataPack *netx.DataPack, reply netx.IMessage) {
+		Watch(mgr, reply, dataPack, s.sendMsg)
+	})
+	// config
+	s.SetCommand(contents.GetConfig, func(dataPack *netx.DataPack, reply netx.IMessage) {
+		GetConfig(mgr, reply, dataPack, s.sendMsg)
+	})
+	s.SetCommand(contents.WatchConfig, func(dataPack *netx.DataPack, reply netx.IMessage) {
+		WatchConfig(mgr, reply, dataPack, s.sendMsg)
+	})
+	s.SetCommand(contents.PushConfig, func(dataPack *netx.DataPack, reply netx.IMessage) {
+		if s.checkConfigToken(dataPack, reply) {
+			PushConfig(mgr, reply, dataPack, s.sendMsg)
+		}
+	})
+	s.SetCommand(contents.RollbackConfig, func(dataPack *netx.DataPack, reply netx.IMessage) {
+		if s.checkConfigToken(dataPack, reply) {
+			RollbackConfig(mgr, reply, dataPack, s.sendMsg)
+		}
+	})
+	return mgr
+}
+
+// GetServiceMgr
+//
+//	@Description: 获取服务端的服务管理器
+//	@receiver s
+//	@return *svr_mgr.ServiceMgr 没有开启注册中心时为nil
+func (s *EvolvingServer) GetServiceMgr() *svr_mgr.ServiceMgr {
+	s.commandLock.RLock()
+	defer s.commandLock.RUnlock()
+	return s.serviceMgr
 }
 
 // Start
@@ -67,22 +146,88 @@ func (s *EvolvingServer) Start() {
 		contents.RpcLogger.Error("start evolving-server failed,err:%v", err)
 		return
 	}
+	s.dataPackLock.Lock()
+	if s.closeFlag {
+		s.dataPackLock.Unlock()
+		_ = tcpListener.Close()
+		return
+	}
+	s.listener = tcpListener
+	s.dataPackLock.Unlock()
 	contents.RpcLogger.Info("start evolving-server successful.")
 	for {
 		tcpConn, err := tcpListener.AcceptTCP()
 		if err != nil {
+			if s.isClosed() {
+				contents.RpcLogger.Warn("evolving-server closed.")
+				return
+			}
 			contents.RpcLogger.Error("accept tcp conn failed,err:%v", err)
 			continue
 		}
+		s.dataPackLock.Lock()
+		if s.closeFlag {
+			s.dataPackLock.Unlock()
+			_ = tcpConn.Close()
+			return
+		}
+		s.handlers.Add(1)
+		s.dataPackLock.Unlock()
 		go s.connHandler(tcpConn)
 	}
 }
 
+// checkConfigToken
+//
+//	@Description: 检查发布和回滚配置的消息是否带了配置的令牌，不对时回复PermissionDenied
+//	@receiver s
+//	@param dataPack 调用方的连接包
+//	@param message 收到的消息
+//	@return bool 没有配置令牌或者令牌正确时为true
+func (s *EvolvingServer) checkConfigToken(dataPack *netx.DataPack, message netx.IMessage) bool {
+	if s.conf.ConfigToken == "" {
+		return true
+	}
+	var token string
+	if m, ok := message.(*model.RpcMessage); ok {
+		token = m.Meta[contents.ConfigToken]
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(s.conf.ConfigToken)) == 1 {
+		return true
+	}
+	s.sendMsg(dataPack, model.SetStatus(message, errorx.New(errorx.PermissionDenied, "bad config token")))
+	return false
+}
+
+// Close
+//
+//	@Description: 关闭服务端，停止监听并断开所有连接，等连接处理协程把断开的服务标记为下线后再关闭服务管理器
+//	@receiver s
 func (s *EvolvingServer) Close() {
-	for dataPack, _ := range s.dataPackChanMap {
+	s.dataPackLock.Lock()
+	s.closeFlag = true
+	if s.listener != nil {
+		_ = s.listener.Close()
+	}
+	for dataPack := range s.dataPackChanMap {
 		dataPack.Close()
 	}
-	s.closeFlag = true
+	s.dataPackLock.Unlock()
+	s.handlers.Wait()
+	if mgr := s.GetServiceMgr(); mgr != nil {
+		mgr.Close()
+	}
+}
+
+// isClosed
+//
+//	@Description: 服务端是否已经关闭
+//	@receiver s
+//	@return bool
+func (s *EvolvingServer) isClosed() bool {
+	s.dataPackLock.RLock()
+	defer s.dataPackLock.RUnlock()
+	return s.closeFlag
 }
 
 // connHandler
@@ -90,51 +235,110 @@ func (s *EvolvingServer) Close() {
 //	@Description: 新建连接处理
 //	@param conn 客户端连接
 func (s *EvolvingServer) connHandler(conn *net.TCPConn) {
+	defer s.handlers.Done()
 	dataPack := netx.DataPack{Conn: conn}
-	svr_mgr.GetServiceMgrInstance().AddDataPack(&dataPack)
+	c, done := make(chan netx.IMessage, 1024), make(chan struct{})
+	s.dataPackLock.Lock()
+	s.dataPackChanMap[&dataPack] = c
+	s.connectedAt[&dataPack] = time.Now()
+	s.writerDone[&dataPack] = done
+	if s.closeFlag {
+		//  Close已经断开了当时的所有连接，这个连接需要自己断开，读消息失败后按正常断开处理
+		_ = conn.Close()
+	}
+	s.dataPackLock.Unlock()
+	go s.writeMsg(&dataPack, c, done)
 	var serviceInfo model.ServiceInfo
 	defer func() { // 客户端端开后广播到其他客户端
-		svr_mgr.GetServiceMgrInstance().DelDataPack(&dataPack)
-		if !fun.IsBlank(serviceInfo) {
-			svr_mgr.GetServiceMgrInstance().ServiceInfoList.ForEach(func(info *model.ServiceInfo) {
-				if info.ServiceName == serviceInfo.ServiceName &&
-					info.ServiceHost == serviceInfo.ServiceHost &&
-					info.ServicePort == serviceInfo.ServicePort {
-					info.AdditionalMeta[contents.Status.String()] = contents.Down
-					info.AdditionalMeta[contents.LostTime.String()] = time.Now()
-				}
-			})
+		if mgr := s.GetServiceMgr(); mgr != nil {
+			mgr.Unwatch(&dataPack)
+		}
+		if f := s.getServiceLostHandler(); f != nil && !fun.IsBlank(serviceInfo) {
+			f(&serviceInfo)
 		}
 		err := conn.Close()
 		if err != nil {
 			contents.RpcLogger.Error(err.Error())
 		}
-		if s.dataPackChanMap[&dataPack] != nil {
-			close(s.dataPackChanMap[&dataPack])
-		}
-		delete(s.dataPackChanMap, &dataPack)
+		s.delDataPackChanMap(&dataPack)
 		s.broadCast(netx.NewDefaultMessage([]byte(contents.ConnectClosed), []byte(dataPack.RemoteAddr().String()+" disconnected")))
 	}()
+	idleTimeout := s.idleTimeout()
 	for {
+		//  任何消息都说明连接还活着，超过若干个心跳间隔没有收到消息就认为对端已经死掉
+		if idleTimeout > 0 {
+			_ = conn.SetReadDeadline(time.Now().Add(idleTimeout))
+		}
 		message, err := dataPack.UnPackMessage()
 		if err != nil {
-			if err.Error() != "EOF" {
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				contents.RpcLogger.Warn("%s missed %d heartbeats, closing.", dataPack.RemoteAddr().String(), s.maxMissedHeartbeats())
+			} else if err.Error() != "EOF" {
 				contents.RpcLogger.Error(err.Error())
 			}
 			break
 		}
+		rpcMessage, err := model.UnPackRpcMessage(message)
+		if err != nil {
+			contents.RpcLogger.Error(err.Error())
+		}
 		command := string(message.GetCommand())
-		if command == contents.Register {
+		//  集群中转发过来的注册属于别的连接
+		if command == contents.Register && rpcMessage.Meta[contents.ForwardedBy] == "" {
 			err = json.Unmarshal(message.GetBody(), &serviceInfo)
 			if err != nil {
 				contents.RpcLogger.Error(err.Error())
 			}
 		}
 		f := s.GetCommand(command)
-		fun.IfOr(f != nil, f, s.GetCommand(contents.Default))(&dataPack, message)
+		//  同一连接上的命令按收到的顺序处理，注册、下线、续约、订阅不会互相超车，
+		//  命令的处理方法不能阻塞，RPC方法的调用由分发器另起协程处理
+		fun.IfOr(f != nil, f, s.GetCommand(contents.Default))(&dataPack, rpcMessage)
 	}
 }
 
+// SetServiceLostHandler
+//
+//	@Description: 设置注册过服务的连接断开时的处理方法，开启注册中心后默认把服务标记为下线
+//	@receiver s
+//	@param f
+func (s *EvolvingServer) SetServiceLostHandler(f func(serviceInfo *model.ServiceInfo)) {
+	s.commandLock.Lock()
+	defer s.commandLock.Unlock()
+	if f != nil {
+		s.serviceLost = f
+	}
+}
+
+// getServiceLostHandler
+//
+//	@Description: 获取注册过服务的连接断开时的处理方法
+//	@receiver s
+//	@return func(serviceInfo *model.ServiceInfo)
+func (s *EvolvingServer) getServiceLostHandler() func(serviceInfo *model.ServiceInfo) {
+	s.commandLock.RLock()
+	defer s.commandLock.RUnlock()
+	return s.serviceLost
+}
+
+// maxMissedHeartbeats
+//
+//	@Description: 连续多少次没有收到心跳后断开连接
+//	@receiver s
+//	@return int
+func (s *EvolvingServer) maxMissedHeartbeats() int {
+	return fun.IfOr(s.conf.MaxMissedHeartbeats > 0, s.conf.MaxMissedHeartbeats, 3)
+}
+
+// idleTimeout
+//
+//	@Description: 连接最长的空闲时间，为0时不检测
+//	@receiver s
+//	@return time.Duration
+func (s *EvolvingServer) idleTimeout() time.Duration {
+	return s.conf.HeartbeatInterval * time.Duration(s.maxMissedHeartbeats())
+}
+
 // Execute
 //
 //	@Description: 执行命令
@@ -201,108 +405,328 @@ func (s *EvolvingServer) GetDataPackChanMap(dataPack *netx.DataPack) (c chan net
 	return c
 }
 
+// delDataPackChanMap
+//
+//	@Description: 删除连接的发送队列并让发送协程退出，发送队列不关闭，正在往里放消息的调用方不会panic
+//	@receiver s
+//	@param dataPack
+func (s *EvolvingServer) delDataPackChanMap(dataPack *netx.DataPack) {
+	s.dataPackLock.Lock()
+	defer s.dataPackLock.Unlock()
+	if done := s.writerDone[dataPack]; done != nil {
+		close(done)
+	}
+	delete(s.dataPackChanMap, dataPack)
+	delete(s.writerDone, dataPack)
+	delete(s.connectedAt, dataPack)
+}
+
+// Clients
+//
+//	@Description: 获取所有连接着的客户端
+//	@receiver s
+//	@return clients 按连接时间排序
+func (s *EvolvingServer) Clients() (clients []*model.ClientInfo) {
+	s.dataPackLock.RLock()
+	defer s.dataPackLock.RUnlock()
+	for dataPack, connectedAt := range s.connectedAt {
+		clients = append(clients, &model.ClientInfo{Addr: dataPack.RemoteAddr().String(), ConnectedAt: connectedAt})
+	}
+	sort.Slice(clients, func(i, j int) bool { return clients[i].ConnectedAt.Before(clients[j].ConnectedAt) })
+	return clients
+}
+
 // broadCast
 //
 //	@Description:  广播
 //	@param msg 需要广播的消息
 func (s *EvolvingServer) broadCast(msg netx.IMessage) {
-	svr_mgr.GetServiceMgrInstance().DataPackMap.Each(func(key string, val *netx.DataPack) {
-		s.sendMsg(val, msg)
-	})
+	s.dataPackLock.RLock()
+	dataPacks := make([]*netx.DataPack, 0, len(s.dataPackChanMap))
+	for dataPack := range s.dataPackChanMap {
+		dataPacks = append(dataPacks, dataPack)
+	}
+	s.dataPackLock.RUnlock()
+	for _, dataPack := range dataPacks {
+		s.sendMsg(dataPack, msg)
+	}
 }
 
 // sendMsg
 //
-//	@Description: 消息发送
+//	@Description: 消息发送，消息放入连接的发送队列，不会阻塞，调用方可以持有锁。连接已断开时丢弃，
+//	发送队列满了说明对端读得太慢或者已经死掉，断开连接，不让它拖住其它连接
 //	@param dataPack
 //	@param message
 func (s *EvolvingServer) sendMsg(dataPack *netx.DataPack, message netx.IMessage) {
-	dataPackChanMap := s.GetDataPackChanMap(dataPack)
-	if dataPackChanMap == nil {
-		s.SetDataPackChanMap(dataPack, make(chan netx.IMessage, 1024))
-		go func() {
-			for !s.closeFlag {
-				select {
-				case msg, ok := <-s.GetDataPackChanMap(dataPack):
-					if ok {
-						err := dataPack.PackMessage(msg)
-						if err != nil {
-							contents.RpcLogger.Error(err.Error())
-						}
-					} else {
-						contents.RpcLogger.Warn(dataPack.RemoteAddr().String() + ": closed")
-						break
-					}
-				}
+	s.dataPackLock.RLock()
+	c := s.dataPackChanMap[dataPack]
+	s.dataPackLock.RUnlock()
+	if c == nil {
+		contents.RpcLogger.Warn(dataPack.RemoteAddr().String() + ": closed, message dropped")
+		return
+	}
+	select {
+	case c <- message:
+	default:
+		contents.RpcLogger.Warn(dataPack.RemoteAddr().String() + ": send queue is full, closing")
+		_ = dataPack.Close()
+	}
+}
+
+// writeMsg
+//
+//	@Description: 从连接的发送队列中取出消息，这里真正将数据包发送到网络上
+//	@receiver s
+//	@param dataPack
+//	@param c 连接的发送队列
+//	@param done 连接断开后关闭
+func (s *EvolvingServer) writeMsg(dataPack *netx.DataPack, c chan netx.IMessage, done chan struct{}) {
+	for {
+		select {
+		case msg := <-c:
+			if err := model.PackRpcMessage(dataPack, msg); err != nil {
+				contents.RpcLogger.Error(err.Error())
 			}
-			contents.RpcLogger.Warn("Server closed...")
-		}()
+		case <-done:
+			contents.RpcLogger.Warn(dataPack.RemoteAddr().String() + ": closed")
+			return
+		}
 	}
-	s.GetDataPackChanMap(dataPack) <- message
 }
 
 // KeepAlive
 //
-//	@Description:
+//	@Description: 续约，消息体是需要续约的租约ID列表，回复不存在或者已经过期的租约ID列表，
+//	被管理员强制下线的租约放在回复的元信息里
+//	@param mgr 注册中心的服务管理器
 //	@param message
 //	@param dataPack
-func KeepAlive(message netx.IMessage, dataPack *netx.DataPack, sendMsg func(dataPack *netx.DataPack, message netx.IMessage)) {
+func KeepAlive(mgr *svr_mgr.ServiceMgr, message netx.IMessage, dataPack *netx.DataPack, sendMsg func(dataPack *netx.DataPack, message netx.IMessage)) {
+	var leaseIds []string
+	err := json.Unmarshal(message.GetBody(), &leaseIds)
+	if err != nil {
+		contents.RpcLogger.Error(err.Error())
+		sendMsg(dataPack, model.SetStatus(message, errorx.WithCode(errorx.BadRequest, err)))
+		return
+	}
+	bytes, err := json.Marshal(mgr.KeepAlive(leaseIds...))
+	if err != nil {
+		sendMsg(dataPack, model.SetStatus(message, err))
+		return
+	}
+	if revoked := mgr.RevokedLeases(leaseIds...); len(revoked) > 0 {
+		if m, ok := message.(*model.RpcMessage); ok {
+			if m.Meta == nil {
+				m.Meta = map[string]string{}
+			}
+			m.Meta[contents.RevokedLeases] = strings.Join(revoked, ",")
+		}
+	}
+	message.SetBody(bytes)
 	sendMsg(dataPack, message)
 }
 
 // Register
 //
-//	@Description:
+//	@Description: 注册服务，回复注册中心发放的租约
+//	@param mgr 注册中心的服务管理器
 //	@param message
 //	@param dataPack
-func Register(message netx.IMessage, dataPack *netx.DataPack, sendMsg func(dataPack *netx.DataPack, message netx.IMessage)) {
+func Register(mgr *svr_mgr.ServiceMgr, message netx.IMessage, dataPack *netx.DataPack, sendMsg func(dataPack *netx.DataPack, message netx.IMessage)) {
 	var serviceInfo model.ServiceInfo
 	err := json.Unmarshal(message.GetBody(), &serviceInfo)
 	if err != nil {
 		contents.RpcLogger.Error(err.Error())
 		contents.RpcLogger.Warn(string(message.GetBody()))
+		sendMsg(dataPack, model.SetStatus(message, errorx.WithCode(errorx.BadRequest, err)))
 		return
 	}
-	needInsert := true
-	svr_mgr.GetServiceMgrInstance().ServiceInfoList.ForEach(func(info *model.ServiceInfo) {
-		if info.ServiceName == serviceInfo.ServiceName &&
-			info.ServiceHost == serviceInfo.ServiceHost &&
-			info.ServicePort == serviceInfo.ServicePort {
-			info.AdditionalMeta = serviceInfo.AdditionalMeta
-			info.AdditionalMeta[contents.Status.String()] = contents.Up
-			delete(info.AdditionalMeta, contents.LostTime.String())
-			info.ServiceProtoc = serviceInfo.ServiceProtoc
-			needInsert = false
-		}
-	})
-	if needInsert {
-		svr_mgr.GetServiceMgrInstance().AddServiceInfo(&serviceInfo)
+	bytes, err := json.Marshal(mgr.RegisterServiceInfo(&serviceInfo))
+	if err != nil {
+		sendMsg(dataPack, model.SetStatus(message, err))
+		return
 	}
-	KeepAlive(message, dataPack, sendMsg)
+	message.SetBody(bytes)
+	sendMsg(dataPack, message)
+}
+
+// DeRegister
+//
+//	@Description: 服务主动下线，服务信息立即从注册中心移除
+//	@param mgr 注册中心的服务管理器
+//	@param message
+//	@param dataPack
+func DeRegister(mgr *svr_mgr.ServiceMgr, message netx.IMessage, dataPack *netx.DataPack, sendMsg func(dataPack *netx.DataPack, message netx.IMessage)) {
+	var serviceInfo model.ServiceInfo
+	err := json.Unmarshal(message.GetBody(), &serviceInfo)
+	if err != nil {
+		contents.RpcLogger.Error(err.Error())
+		sendMsg(dataPack, model.SetStatus(message, errorx.WithCode(errorx.BadRequest, err)))
+		return
+	}
+	if !mgr.DeregisterServiceInfo(&serviceInfo) {
+		contents.RpcLogger.Warn("deregister service %s %s not found.", serviceInfo.ServiceName, serviceInfo.Addr())
+	}
+	message.SetBody([]byte(contents.OK))
+	sendMsg(dataPack, message)
 }
 
 // DisCover
 //
-//	@Description:
+//	@Description: 发现服务，只返回元信息里指定的命名空间和环境下、满足选择器的服务
+//	@param mgr 注册中心的服务管理器
 //	@param message
 //	@param dataPack
-func DisCover(message netx.IMessage, dataPack *netx.DataPack, sendMsg func(dataPack *netx.DataPack, message netx.IMessage)) {
-	list := svr_mgr.GetServiceMgrInstance().FindServiceInfosByServiceName(string(message.GetBody()))
+func DisCover(mgr *svr_mgr.ServiceMgr, message netx.IMessage, dataPack *netx.DataPack, sendMsg func(dataPack *netx.DataPack, message netx.IMessage)) {
+	namespace, env := scopeOf(message)
+	var selector model.Selector
+	if m, ok := message.(*model.RpcMessage); ok {
+		var err error
+		if selector, err = model.ParseSelector(m.Meta[contents.Selector]); err != nil {
+			sendMsg(dataPack, model.SetStatus(message, errorx.WithCode(errorx.BadRequest, err)))
+			return
+		}
+	}
+	list := selector.Filter(mgr.FindServiceInfos(namespace, env, string(message.GetBody())))
 	bytes, err := json.Marshal(list)
 	if err != nil {
 		contents.RpcLogger.Error(err.Error())
+		sendMsg(dataPack, model.SetStatus(message, err))
+		return
+	}
+	message.SetBody(bytes)
+	sendMsg(dataPack, message)
+}
+
+// Watch
+//
+//	@Description: 订阅元信息里指定的命名空间和环境下服务的变化，回复订阅时的服务列表，之后的变化以WATCH命令推送
+//	@param mgr 注册中心的服务管理器
+//	@param message
+//	@param dataPack
+func Watch(mgr *svr_mgr.ServiceMgr, message netx.IMessage, dataPack *netx.DataPack, sendMsg func(dataPack *netx.DataPack, message netx.IMessage)) {
+	namespace, env := scopeOf(message)
+	mgr.Watch(namespace, env, string(message.GetBody()), dataPack, sendMsg, func(list []*model.ServiceInfo) {
+		bytes, err := json.Marshal(list)
+		if err != nil {
+			contents.RpcLogger.Error(err.Error())
+			sendMsg(dataPack, model.SetStatus(message, err))
+			return
+		}
+		message.SetBody(bytes)
+		sendMsg(dataPack, message)
+	})
+}
+
+// GetConfig
+//
+//	@Description: 读取元信息里指定的命名空间下服务的配置，元信息里没有指定版本时读取最新版本
+//	@param mgr 注册中心的服务管理器
+//	@param message 消息体是服务名
+//	@param dataPack
+func GetConfig(mgr *svr_mgr.ServiceMgr, message netx.IMessage, dataPack *netx.DataPack, sendMsg func(dataPack *netx.DataPack, message netx.IMessage)) {
+	namespace, _ := scopeOf(message)
+	var version uint64
+	if m, ok := message.(*model.RpcMessage); ok && m.Meta[contents.ConfigVersion] != "" {
+		var err error
+		if version, err = strconv.ParseUint(m.Meta[contents.ConfigVersion], 10, 64); err != nil {
+			sendMsg(dataPack, model.SetStatus(message, errorx.WithCode(errorx.BadRequest, err)))
+			return
+		}
+	}
+	config, err := mgr.GetConfig(namespace, string(message.GetBody()), version)
+	if err != nil {
+		sendMsg(dataPack, model.SetStatus(message, err))
+		return
+	}
+	replyJson(message, dataPack, sendMsg, config)
+}
+
+// WatchConfig
+//
+//	@Description: 订阅元信息里指定的命名空间下服务的配置，回复订阅时的最新版本，还没有配置时回复null，之后发布的版本以WATCH_CONFIG命令推送
+//	@param mgr 注册中心的服务管理器
+//	@param message 消息体是服务名
+//	@param dataPack
+func WatchConfig(mgr *svr_mgr.ServiceMgr, message netx.IMessage, dataPack *netx.DataPack, sendMsg func(dataPack *netx.DataPack, message netx.IMessage)) {
+	namespace, _ := scopeOf(message)
+	mgr.WatchConfig(namespace, string(message.GetBody()), dataPack, sendMsg, func(config *model.Config) {
+		replyJson(message, dataPack, sendMsg, config)
+	})
+}
+
+// PushConfig
+//
+//	@Description: 发布新版本的配置，回复发布的配置
+//	@param mgr 注册中心的服务管理器
+//	@param message 消息体是json格式的配置，只需要命名空间、服务名和配置内容
+//	@param dataPack
+func PushConfig(mgr *svr_mgr.ServiceMgr, message netx.IMessage, dataPack *netx.DataPack, sendMsg func(dataPack *netx.DataPack, message netx.IMessage)) {
+	var config model.Config
+	if err := json.Unmarshal(message.GetBody(), &config); err != nil || config.ServiceName == "" {
+		sendMsg(dataPack, model.SetStatus(message, errorx.New(errorx.BadRequest, "bad config %s", string(message.GetBody()))))
+		return
+	}
+	replyJson(message, dataPack, sendMsg, mgr.PushConfig(config.Namespace, config.ServiceName, config.Data))
+}
+
+// RollbackConfig
+//
+//	@Description: 把配置回滚到之前的版本，回复回滚后发布的配置
+//	@param mgr 注册中心的服务管理器
+//	@param message 消息体是json格式的配置，只需要命名空间、服务名和要回滚到的版本
+//	@param dataPack
+func RollbackConfig(mgr *svr_mgr.ServiceMgr, message netx.IMessage, dataPack *netx.DataPack, sendMsg func(dataPack *netx.DataPack, message netx.IMessage)) {
+	var config model.Config
+	if err := json.Unmarshal(message.GetBody(), &config); err != nil || config.ServiceName == "" || config.Version == 0 {
+		sendMsg(dataPack, model.SetStatus(message, errorx.New(errorx.BadRequest, "bad config %s", string(message.GetBody()))))
+		return
+	}
+	rollback, err := mgr.RollbackConfig(config.Namespace, config.ServiceName, config.Version)
+	if err != nil {
+		sendMsg(dataPack, model.SetStatus(message, err))
+		return
+	}
+	replyJson(message, dataPack, sendMsg, rollback)
+}
+
+// replyJson
+//
+//	@Description: 以json格式回复
+//	@param message 收到的消息
+//	@param dataPack
+//	@param sendMsg
+//	@param v 回复的内容
+func replyJson(message netx.IMessage, dataPack *netx.DataPack, sendMsg func(dataPack *netx.DataPack, message netx.IMessage), v any) {
+	bytes, err := json.Marshal(v)
+	if err != nil {
+		contents.RpcLogger.Error(err.Error())
+		sendMsg(dataPack, model.SetStatus(message, err))
 		return
 	}
 	message.SetBody(bytes)
 	sendMsg(dataPack, message)
 }
 
+// scopeOf
+//
+//	@Description: 从消息的元信息里获取发现和订阅的命名空间和环境
+//	@param message
+//	@return namespace 命名空间，没有指定时为空
+//	@return env 环境
+func scopeOf(message netx.IMessage) (namespace, env string) {
+	if m, ok := message.(*model.RpcMessage); ok {
+		return m.Meta[contents.Namespace], m.Meta[contents.Env]
+	}
+	return "", ""
+}
+
 // Default
 //
 //	@Description:
 //	@param message
 //	@param dataPack
 func Default(message netx.IMessage, dataPack *netx.DataPack, sendMsg func(dataPack *netx.DataPack, message netx.IMessage)) {
-	message.SetBody([]byte(errorx.UnknownCommandErr.Error()))
-	sendMsg(dataPack, message)
+	sendMsg(dataPack, model.SetStatus(message, errorx.UnknownCommandErr))
 }
@@ -0,0 +1,492 @@
+package evolving_server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/yuhao-jack/evolving-rpc/codec"
+	"github.com/yuhao-jack/evolving-rpc/contents"
+	"github.com/yuhao-jack/evolving-rpc/errorx"
+	"github.com/yuhao-jack/evolving-rpc/model"
+	"github.com/yuhao-jack/go-toolx/containerx"
+	"github.com/yuhao-jack/go-toolx/fun"
+	"github.com/yuhao-jack/go-toolx/netx"
+	"go/token"
+	"reflect"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RpcHandler
+// @Description: 服务方法的调用，req为入参的指针
+type RpcHandler func(ctx context.Context, req any) (reply any, err error)
+
+// RpcInterceptor
+// @Description: 服务端拦截器，在服务方法调用前后做日志、鉴权、统计等处理，需要继续调用时执行handler
+type RpcInterceptor func(ctx context.Context, command string, req any, handler RpcHandler) (reply any, err error)
+
+// rpcDispatcher
+// @Description: RPC服务的方法分发器和编解码注册表，直连模式和分布式模式的服务端共用
+type rpcDispatcher struct {
+	serviceMap                map[string]*service
+	protocUnmarshalHandlerMap *containerx.ConcurrentMap[string, func(in []byte, recv any) error]
+	protocMarshalHandlerMap   *containerx.ConcurrentMap[string, func(recv any) ([]byte, error)]
+	interceptors              []RpcInterceptor
+	inflightLock              sync.Mutex
+	inflight                  int  // 正在处理的调用数
+	draining                  bool // 是否正在下线，下线时不再接收新的调用
+	callsLock                 sync.Mutex
+	calls                     map[callKey]context.CancelFunc // 正在处理的调用，调用方放弃时取消
+}
+
+// callKey
+// @Description: 一次调用的标识，调用序号只在一个连接内唯一
+type callKey struct {
+	dataPack *netx.DataPack
+	seq      uint64
+}
+
+// newRpcDispatcher
+//
+//	@Description: 创建方法分发器，默认注册json和protobuf编解码
+//	@return *rpcDispatcher
+func newRpcDispatcher() *rpcDispatcher {
+	d := &rpcDispatcher{serviceMap: map[string]*service{}, calls: map[callKey]context.CancelFunc{}}
+	d.protocUnmarshalHandlerMap = containerx.NewConcurrentMap[string, func(in []byte, recv any) error]()
+	d.protocMarshalHandlerMap = containerx.NewConcurrentMap[string, func(recv any) ([]byte, error)]()
+	d.setProtocUnmarshalHandler(contents.Json, codec.JsonUnmarshal)
+	d.setProtocMarshalHandler(contents.Json, codec.JsonMarshal)
+	d.setProtocUnmarshalHandler(contents.Pb, codec.PbUnmarshal)
+	d.setProtocMarshalHandler(contents.Pb, codec.PbMarshal)
+	return d
+}
+
+// register
+//
+//	@Description: 注册服务
+//	@receiver d
+//	@param rcvr 具体服务对象的指针
+//	@return error 注册失败时的错误信息
+func (d *rpcDispatcher) register(rcvr any) error {
+	s := new(service)
+	s.typ = reflect.TypeOf(rcvr)
+	s.rcvr = reflect.ValueOf(rcvr)
+	s.name = reflect.Indirect(s.rcvr).Type().Name()
+
+	if fun.IsBlank(s.name) {
+		return errors.New("no service name for type " + s.typ.String())
+	}
+	s.method = make(map[string]*methodType)
+	buildMethodMap(s)
+	if len(s.method) == 0 {
+		return errors.New(s.name + " has no exported methods of suitable type")
+	}
+	d.serviceMap[s.name] = s
+	return nil
+}
+
+// use
+//
+//	@Description: 添加拦截器，先添加的拦截器在外层
+//	@receiver d
+//	@param interceptors
+func (d *rpcDispatcher) use(interceptors ...RpcInterceptor) {
+	d.interceptors = append(d.interceptors, interceptors...)
+}
+
+// setProtocUnmarshalHandler
+//
+//	@Description: 设置Unmarshal处理方法
+//	@receiver d
+//	@param protoc
+//	@param handler
+func (d *rpcDispatcher) setProtocUnmarshalHandler(protoc string, handler func(in []byte, recv any) error) {
+	d.protocUnmarshalHandlerMap.Set(protoc, handler)
+	_, b := d.protocMarshalHandlerMap.Get(protoc)
+	if !b {
+		contents.RpcLogger.Warn("WARNING %s MarshalHandler is empty.", protoc)
+	} else {
+		contents.RpcLogger.Info("%s protoc both MarshalHandler and UnmarshalHandler are ready.", protoc)
+	}
+}
+
+// setProtocMarshalHandler
+//
+//	@Description: 设置Marshal处理方法
+//	@receiver d
+//	@param protoc
+//	@param handler
+func (d *rpcDispatcher) setProtocMarshalHandler(protoc string, handler func(recv any) ([]byte, error)) {
+	d.protocMarshalHandlerMap.Set(protoc, handler)
+	_, b := d.protocUnmarshalHandlerMap.Get(protoc)
+	if !b {
+		contents.RpcLogger.Warn("WARNING %s UnmarshalHandler is empty.", protoc)
+	} else {
+		contents.RpcLogger.Info("%s protoc both MarshalHandler and UnmarshalHandler are ready.", protoc)
+	}
+}
+
+// serve
+//
+//	@Description: 把注册的服务方法设置为服务端连接的命令，每个调用在连接的读协程上登记后单独起协程处理，
+//	之后收到的取消消息一定能找到这次调用
+//	@receiver d
+//	@param server 服务端连接
+func (d *rpcDispatcher) serve(server *EvolvingServer) {
+	for n, s := range d.serviceMap {
+		for m := range s.method {
+			server.SetCommand(fmt.Sprint(n, ".", m), func(dataPack *netx.DataPack, reply netx.IMessage) {
+				ctx, cancel := model.ContextOf(dataPack, reply)
+				untrack := d.track(dataPack, reply, cancel)
+				go func() {
+					defer cancel()
+					defer untrack()
+					d.dispatch(ctx, server, dataPack, reply)
+				}()
+			})
+		}
+	}
+	server.SetCommand(contents.Cancel, d.cancel)
+}
+
+// track
+//
+//	@Description: 记录正在处理的调用，调用方放弃时可以取消
+//	@receiver d
+//	@param dataPack 调用方的连接包
+//	@param message 收到的调用消息
+//	@param cancel 取消处理这次调用的context
+//	@return func() 调用处理完成后删除记录
+func (d *rpcDispatcher) track(dataPack *netx.DataPack, message netx.IMessage, cancel context.CancelFunc) func() {
+	m, ok := message.(*model.RpcMessage)
+	if !ok || m.Seq == 0 {
+		return func() {}
+	}
+	key := callKey{dataPack: dataPack, seq: m.Seq}
+	d.callsLock.Lock()
+	d.calls[key] = cancel
+	d.callsLock.Unlock()
+	return func() {
+		d.callsLock.Lock()
+		delete(d.calls, key)
+		d.callsLock.Unlock()
+	}
+}
+
+// cancel
+//
+//	@Description: 调用方放弃了调用，取消处理这次调用的context，调用已经处理完时忽略
+//	@receiver d
+//	@param dataPack 调用方的连接包
+//	@param message 取消消息，序号为要取消的调用的序号
+func (d *rpcDispatcher) cancel(dataPack *netx.DataPack, message netx.IMessage) {
+	m, ok := message.(*model.RpcMessage)
+	if !ok {
+		return
+	}
+	d.callsLock.Lock()
+	cancel := d.calls[callKey{dataPack: dataPack, seq: m.Seq}]
+	d.callsLock.Unlock()
+	if cancel != nil {
+		cancel()
+	}
+}
+
+// dispatch
+//
+//	@Description: 处理一次调用并回复调用方
+//	@receiver d
+//	@param ctx 处理调用的context，调用方取消或者超时后结束
+//	@param server 服务端连接
+//	@param dataPack 调用方的连接包
+//	@param reply 收到的调用消息，处理后作为回复消息
+func (d *rpcDispatcher) dispatch(ctx context.Context, server *EvolvingServer, dataPack *netx.DataPack, reply netx.IMessage) {
+	var bytes []byte
+	var err error
+	if d.begin() {
+		//  回复放入发送队列后才算处理完
+		defer d.end()
+		bytes, err = d.handle(ctx, reply)
+	} else {
+		err = errorx.New(errorx.Unavailable, "server is draining")
+	}
+	if m, ok := reply.(*model.RpcMessage); ok {
+		//  只有请求需要携带的信息，不再带回给调用方
+		m.Timeout = 0
+		m.Meta = nil
+	}
+	if err != nil {
+		model.SetStatus(reply, err)
+	} else {
+		reply.SetBody(bytes)
+	}
+	server.Execute(dataPack, reply, nil)
+}
+
+// begin
+//
+//	@Description: 开始处理一次调用
+//	@receiver d
+//	@return bool 正在下线时为false，不再处理新的调用
+func (d *rpcDispatcher) begin() bool {
+	d.inflightLock.Lock()
+	defer d.inflightLock.Unlock()
+	if d.draining {
+		return false
+	}
+	d.inflight++
+	return true
+}
+
+// end
+//
+//	@Description: 一次调用处理完成
+//	@receiver d
+func (d *rpcDispatcher) end() {
+	d.inflightLock.Lock()
+	defer d.inflightLock.Unlock()
+	d.inflight--
+}
+
+// drain
+//
+//	@Description: 不再接收新的调用，等待正在处理的调用完成
+//	@receiver d
+//	@param timeout 最长的等待时间
+//	@return bool 是否在超时前全部完成
+func (d *rpcDispatcher) drain(timeout time.Duration) bool {
+	d.inflightLock.Lock()
+	d.draining = true
+	d.inflightLock.Unlock()
+	deadline := time.Now().Add(timeout)
+	for {
+		d.inflightLock.Lock()
+		inflight := d.inflight
+		d.inflightLock.Unlock()
+		if inflight == 0 {
+			return true
+		}
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// handle
+//
+//	@Description: 解码入参，经过拦截器调用服务方法，编码返回结果，拦截器和编解码方法panic时恢复并记录堆栈，返回内部错误，
+//	不影响连接和其他调用
+//	@receiver d
+//	@param ctx 调用的context
+//	@param message 收到的调用消息
+//	@return bytes 编码后的返回结果
+//	@return err 失败时的错误信息
+func (d *rpcDispatcher) handle(ctx context.Context, message netx.IMessage) (bytes []byte, err error) {
+	command := string(message.GetCommand())
+	defer func() {
+		if r := recover(); r != nil {
+			contents.RpcLogger.Error("handle %s panic: %v\n%s", command, r, debug.Stack())
+			bytes, err = nil, errorx.New(errorx.Internal, "%s panic: %v", command, r)
+		}
+	}()
+	//  调用方已经放弃的调用不再处理
+	if ctx.Err() != nil {
+		return nil, errorx.FromContextError(ctx.Err())
+	}
+	serviceName, methodName, _ := strings.Cut(command, ".")
+	ts, ok := d.serviceMap[serviceName]
+	if !ok {
+		return nil, errorx.UnknownCommandErr
+	}
+	tm, ok := ts.method[methodName]
+	if !ok {
+		return nil, errorx.UnknownCommandErr
+	}
+
+	protoc := model.ProtocOf(message)
+	unmarshalHandler, ok := d.protocUnmarshalHandlerMap.Get(protoc)
+	if !ok {
+		return nil, d.unsupportedProtocErr(protoc)
+	}
+	reqv := reflect.New(tm.ReqType)
+	if len(message.GetBody()) > 0 {
+		if err := unmarshalHandler(message.GetBody(), reqv.Interface()); err != nil {
+			return nil, errorx.WithCode(errorx.BadRequest, err)
+		}
+	}
+
+	handler := func(ctx context.Context, req any) (any, error) {
+		return tm.call(ctx, ts.rcvr, reflect.ValueOf(req).Elem())
+	}
+	for i := len(d.interceptors) - 1; i >= 0; i-- {
+		interceptor, next := d.interceptors[i], handler
+		handler = func(ctx context.Context, req any) (any, error) {
+			return interceptor(ctx, command, req, next)
+		}
+	}
+	res, err := handler(ctx, reqv.Interface())
+	if err != nil {
+		return nil, errorx.FromError(err)
+	}
+	if ctx.Err() != nil {
+		return nil, errorx.FromContextError(ctx.Err())
+	}
+	if res == nil {
+		return nil, nil
+	}
+	marshalHandler, ok := d.protocMarshalHandlerMap.Get(protoc)
+	if !ok {
+		return nil, d.unsupportedProtocErr(protoc)
+	}
+	if bytes, err = marshalHandler(res); err != nil {
+		return nil, errorx.FromError(err)
+	}
+	return bytes, nil
+}
+
+// methodType
+// @Description:
+type methodType struct {
+	sync.Mutex
+	method    reflect.Method
+	ReqType   reflect.Type
+	ReplyType reflect.Type // 方法没有返回结果时为nil
+	hasCtx    bool         // 方法的第一个参数是否为context.Context
+	hasErr    bool         // 方法的最后一个返回值是否为error
+}
+
+var (
+	typeOfContext = reflect.TypeOf((*context.Context)(nil)).Elem()
+	typeOfError   = reflect.TypeOf((*error)(nil)).Elem()
+)
+
+// call
+//
+//	@Description: 调用服务的方法，方法panic时恢复并记录堆栈，返回内部错误，不影响连接和其他调用
+//	@receiver m
+//	@param ctx 调用的context，方法需要时传入
+//	@param rcvr 服务对象
+//	@param req 入参
+//	@return res 方法的返回结果，方法没有返回结果时为nil
+//	@return err 方法返回的错误或者panic时的错误信息
+func (m *methodType) call(ctx context.Context, rcvr, req reflect.Value) (res any, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			contents.RpcLogger.Error("call %s panic: %v\n%s", m.method.Name, r, debug.Stack())
+			err = errorx.New(errorx.Internal, "%s panic: %v", m.method.Name, r)
+		}
+	}()
+	in := []reflect.Value{rcvr}
+	if m.hasCtx {
+		in = append(in, reflect.ValueOf(ctx))
+	}
+	out := m.method.Func.Call(append(in, req))
+	if m.hasErr {
+		if e := out[len(out)-1].Interface(); e != nil {
+			return nil, errorx.FromError(e.(error))
+		}
+	}
+	if m.ReplyType != nil {
+		res = out[0].Interface()
+	}
+	return res, nil
+}
+
+// service
+// @Description:
+type service struct {
+	name   string                 // name of service
+	rcvr   reflect.Value          // receiver of methods for the service
+	typ    reflect.Type           // type of the receiver
+	method map[string]*methodType // registered methods
+}
+
+// unsupportedProtocErr
+//
+//	@Description: 服务端没有调用方要求的编码协议时的错误，详情里带有服务端支持的协议，调用方可以据此换一个协议
+//	@receiver d
+//	@param protoc 调用方要求的编码协议
+//	@return *errorx.StatusError
+func (d *rpcDispatcher) unsupportedProtocErr(protoc string) *errorx.StatusError {
+	var supported []string
+	d.protocUnmarshalHandlerMap.Each(func(key string, _ func(in []byte, recv any) error) {
+		if _, ok := d.protocMarshalHandlerMap.Get(key); ok {
+			supported = append(supported, key)
+		}
+	})
+	sort.Strings(supported)
+	err := errorx.New(errorx.UnsupportedProtoc, "server does not support protoc %q", protoc)
+	err.Details = map[string]string{"supported": strings.Join(supported, ",")}
+	return err
+}
+
+// buildMethodMap
+//
+//	@Description: 找出服务对象上可以调用的方法，支持以下几种方法签名：
+//	func(req) reply
+//	func(req) (reply, error)
+//	func(req) error
+//	func(ctx, req) reply
+//	func(ctx, req) (reply, error)
+//	func(ctx, req) error
+//	@param s
+func buildMethodMap(s *service) {
+	for m := 0; m < s.typ.NumMethod(); m++ {
+		method := s.typ.Method(m)
+		if !method.IsExported() {
+			continue
+		}
+		mt := &methodType{Mutex: sync.Mutex{}, method: method}
+		reqIndex := 1
+		if method.Type.NumIn() == 3 && method.Type.In(1) == typeOfContext {
+			mt.hasCtx = true
+			reqIndex = 2
+		}
+		if method.Type.NumIn() != reqIndex+1 {
+			continue
+		}
+		reqType := method.Type.In(reqIndex)
+		if reqType == typeOfContext || !isExportedOrBuiltinType(reqType) {
+			continue
+		}
+		mt.ReqType = reqType
+
+		switch method.Type.NumOut() {
+		case 1:
+			if method.Type.Out(0) == typeOfError {
+				mt.hasErr = true
+			} else {
+				mt.ReplyType = method.Type.Out(0)
+			}
+		case 2:
+			if method.Type.Out(1) != typeOfError {
+				continue
+			}
+			mt.ReplyType = method.Type.Out(0)
+			mt.hasErr = true
+		default:
+			continue
+		}
+		if mt.ReplyType != nil && !isExportedOrBuiltinType(mt.ReplyType) {
+			continue
+		}
+
+		s.method[method.Name] = mt
+	}
+}
+
+// isExportedOrBuiltinType
+//
+//	@Description:
+//	@param t
+//	@return bool
+func isExportedOrBuiltinType(t reflect.Type) bool {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	return token.IsExported(t.Name()) || t.PkgPath() == ""
+}
@@ -0,0 +1,363 @@
+package admin
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"github.com/yuhao-jack/evolving-rpc/contents"
+	evolvingserver "github.com/yuhao-jack/evolving-rpc/evolving-server"
+	"github.com/yuhao-jack/evolving-rpc/evolving-server/svr_mgr"
+	"github.com/yuhao-jack/evolving-rpc/model"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// AdminHandler
+// @Description: 注册中心的管理接口，请求和回复都是json，出错时回复对应的http状态码和{"error":"..."}
+//
+//	GET    /api/services            查看服务，可以按namespace、env、name、selector参数过滤
+//	GET    /api/instances           查看一个服务实例，按namespace、env、name、host、port参数指定实例，下同
+//	DELETE /api/instances           强制下线服务实例
+//	PUT    /api/instances/status    修改服务实例的状态，请求体 {"status":"UP|DRAINING|DISABLED"}
+//	PATCH  /api/instances/meta      修改服务实例的附加元信息，请求体是要修改的标签，值为null的标签会被删除
+//	GET    /api/clients             查看连接着的客户端
+//
+// 设置了令牌时修改服务实例的请求需要带上请求头 Authorization: Bearer <令牌>，否则回复401，
+// 集群中只有主节点能修改服务实例，副本回复421和主节点的地址 {"error":"...","leader":"host:port"}
+type AdminHandler struct {
+	server  *evolvingserver.EvolvingServer
+	mux     *http.ServeMux
+	cluster Cluster // 单机运行时为nil
+	token   string  // 修改服务实例需要的令牌，为空时不校验
+}
+
+// Cluster
+// @Description: 注册中心所在的集群，cluster.Node实现了这个接口
+type Cluster interface {
+	IsLeader() bool
+	Leader() string
+}
+
+// NewAdminHandler
+//
+//	@Description: 创建注册中心的管理接口
+//	@param server 开启了注册中心的服务端
+//	@return *AdminHandler
+func NewAdminHandler(server *evolvingserver.EvolvingServer) *AdminHandler {
+	h := &AdminHandler{server: server, mux: http.NewServeMux()}
+	h.mux.HandleFunc("/api/services", h.withMgr(h.services, http.MethodGet))
+	h.mux.HandleFunc("/api/instances", h.withMgr(h.instance, http.MethodGet, http.MethodDelete))
+	h.mux.HandleFunc("/api/instances/status", h.withMgr(h.instanceStatus, http.MethodPut))
+	h.mux.HandleFunc("/api/instances/meta", h.withMgr(h.instanceMeta, http.MethodPatch))
+	h.mux.HandleFunc("/api/clients", h.clients)
+	return h
+}
+
+// SetCluster
+//
+//	@Description: 设置注册中心所在的集群，之后副本拒绝修改服务实例的请求，需要在处理请求前调用
+//	@receiver h
+//	@param cluster 注册中心所在的集群
+func (h *AdminHandler) SetCluster(cluster Cluster) {
+	h.cluster = cluster
+}
+
+// SetToken
+//
+//	@Description: 设置修改服务实例需要的令牌，需要在处理请求前调用
+//	@receiver h
+//	@param token 令牌，为空时不校验
+func (h *AdminHandler) SetToken(token string) {
+	h.token = token
+}
+
+// ServeHTTP
+//
+//	@Description: 实现http.Handler
+//	@receiver h
+//	@param w
+//	@param r
+func (h *AdminHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mux.ServeHTTP(w, r)
+}
+
+// withMgr
+//
+//	@Description: 检查请求方法和注册中心是否开启，修改服务实例的请求还要检查令牌，集群中还要检查本节点是不是主节点
+//	@receiver h
+//	@param f 处理方法
+//	@param methods 允许的请求方法
+//	@return http.HandlerFunc
+func (h *AdminHandler) withMgr(f func(mgr *svr_mgr.ServiceMgr, w http.ResponseWriter, r *http.Request), methods ...string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !allowMethod(w, r, methods...) {
+			return
+		}
+		mgr := h.server.GetServiceMgr()
+		if mgr == nil {
+			writeError(w, http.StatusServiceUnavailable, "registry is not enabled")
+			return
+		}
+		if r.Method != http.MethodGet && (!h.checkToken(w, r) || !h.checkLeader(w)) {
+			return
+		}
+		f(mgr, w, r)
+	}
+}
+
+// checkToken
+//
+//	@Description: 检查请求头里的令牌，没有设置令牌时不校验
+//	@receiver h
+//	@param w
+//	@param r
+//	@return bool 令牌正确时为true，否则回复401
+func (h *AdminHandler) checkToken(w http.ResponseWriter, r *http.Request) bool {
+	if h.token == "" {
+		return true
+	}
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(h.token)) == 1 {
+		return true
+	}
+	w.Header().Set("WWW-Authenticate", "Bearer")
+	writeError(w, http.StatusUnauthorized, "invalid admin token")
+	return false
+}
+
+// checkLeader
+//
+//	@Description: 检查本节点能不能修改服务实例，副本的修改会被主节点同步过来的变化覆盖，
+//	选出主节点时回复421和主节点的地址，还没有选出时回复503
+//	@receiver h
+//	@param w
+//	@return bool 单机运行或者是主节点时为true
+func (h *AdminHandler) checkLeader(w http.ResponseWriter) bool {
+	if h.cluster == nil || h.cluster.IsLeader() {
+		return true
+	}
+	leader := h.cluster.Leader()
+	if leader == "" {
+		writeError(w, http.StatusServiceUnavailable, "cluster has no leader")
+		return false
+	}
+	writeJson(w, http.StatusMisdirectedRequest, map[string]string{"error": "not the cluster leader, send it to the leader", "leader": leader})
+	return false
+}
+
+// services
+//
+//	@Description: 查看服务，参数为空时不按这个参数过滤
+//	@receiver h
+//	@param mgr
+//	@param w
+//	@param r
+func (h *AdminHandler) services(mgr *svr_mgr.ServiceMgr, w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	selector, err := model.ParseSelector(query.Get("selector"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	serviceList := make([]*model.ServiceInfo, 0)
+	for _, info := range selector.Filter(mgr.ServiceInfos()) {
+		if query.Has("namespace") && info.GetNamespace() != query.Get("namespace") ||
+			query.Has("env") && info.Env != query.Get("env") ||
+			query.Has("name") && info.ServiceName != query.Get("name") {
+			continue
+		}
+		serviceList = append(serviceList, info)
+	}
+	writeJson(w, http.StatusOK, serviceList)
+}
+
+// instance
+//
+//	@Description: 查看或者强制下线一个服务实例，强制下线后服务的持有者不会通过续约自动重新注册
+//	@receiver h
+//	@param mgr
+//	@param w
+//	@param r
+func (h *AdminHandler) instance(mgr *svr_mgr.ServiceMgr, w http.ResponseWriter, r *http.Request) {
+	serviceInfo, ok := instanceOf(w, r)
+	if !ok {
+		return
+	}
+	if r.Method == http.MethodDelete {
+		if !mgr.RevokeServiceInfo(serviceInfo) {
+			writeNotFound(w, serviceInfo)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	info := mgr.GetServiceInfo(serviceInfo)
+	if info == nil {
+		writeNotFound(w, serviceInfo)
+		return
+	}
+	writeJson(w, http.StatusOK, info)
+}
+
+// instanceStatus
+//
+//	@Description: 修改服务实例的状态
+//	@receiver h
+//	@param mgr
+//	@param w
+//	@param r
+func (h *AdminHandler) instanceStatus(mgr *svr_mgr.ServiceMgr, w http.ResponseWriter, r *http.Request) {
+	serviceInfo, ok := instanceOf(w, r)
+	if !ok {
+		return
+	}
+	var req struct {
+		Status contents.ServiceStatus `json:"status"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "bad request body: %v", err)
+		return
+	}
+	switch req.Status {
+	case contents.Up, contents.Draining, contents.Disabled:
+	default:
+		writeError(w, http.StatusBadRequest, "status must be one of %s, %s, %s", contents.Up, contents.Draining, contents.Disabled)
+		return
+	}
+	info := mgr.SetServiceStatus(serviceInfo, req.Status)
+	if info == nil {
+		writeNotFound(w, serviceInfo)
+		return
+	}
+	writeJson(w, http.StatusOK, info)
+}
+
+// instanceMeta
+//
+//	@Description: 修改服务实例的附加元信息，状态和断开时间由注册中心维护，不能修改
+//	@receiver h
+//	@param mgr
+//	@param w
+//	@param r
+func (h *AdminHandler) instanceMeta(mgr *svr_mgr.ServiceMgr, w http.ResponseWriter, r *http.Request) {
+	serviceInfo, ok := instanceOf(w, r)
+	if !ok {
+		return
+	}
+	var meta map[string]any
+	if err := json.NewDecoder(r.Body).Decode(&meta); err != nil {
+		writeError(w, http.StatusBadRequest, "bad request body: %v", err)
+		return
+	}
+	for _, key := range []contents.AdditionalMetaKey{contents.Status, contents.LostTime} {
+		if _, ok := meta[key.String()]; ok {
+			writeError(w, http.StatusBadRequest, "meta %s is managed by the register center", key)
+			return
+		}
+	}
+	info := mgr.UpdateServiceMeta(serviceInfo, meta)
+	if info == nil {
+		writeNotFound(w, serviceInfo)
+		return
+	}
+	writeJson(w, http.StatusOK, info)
+}
+
+// clients
+//
+//	@Description: 查看连接着的客户端
+//	@receiver h
+//	@param w
+//	@param r
+func (h *AdminHandler) clients(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	clients := h.server.Clients()
+	if clients == nil {
+		clients = make([]*model.ClientInfo, 0)
+	}
+	writeJson(w, http.StatusOK, clients)
+}
+
+// instanceOf
+//
+//	@Description: 从请求参数中获取服务实例，参数不合法时回复400
+//	@param w
+//	@param r
+//	@return *model.ServiceInfo
+//	@return bool 参数是否合法
+func instanceOf(w http.ResponseWriter, r *http.Request) (*model.ServiceInfo, bool) {
+	query := r.URL.Query()
+	port, err := strconv.ParseInt(query.Get("port"), 10, 32)
+	if query.Get("name") == "" || query.Get("host") == "" || err != nil {
+		writeError(w, http.StatusBadRequest, "name, host and port are required")
+		return nil, false
+	}
+	return &model.ServiceInfo{
+		Namespace:   query.Get("namespace"),
+		Env:         query.Get("env"),
+		ServiceName: query.Get("name"),
+		ServiceHost: query.Get("host"),
+		ServicePort: int32(port),
+	}, true
+}
+
+// allowMethod
+//
+//	@Description: 检查请求方法，不允许时回复405
+//	@param w
+//	@param r
+//	@param methods 允许的请求方法
+//	@return bool
+func allowMethod(w http.ResponseWriter, r *http.Request, methods ...string) bool {
+	for _, method := range methods {
+		if r.Method == method {
+			return true
+		}
+	}
+	for _, method := range methods {
+		w.Header().Add("Allow", method)
+	}
+	writeError(w, http.StatusMethodNotAllowed, "method %s not allowed", r.Method)
+	return false
+}
+
+// writeNotFound
+//
+//	@Description: 回复服务实例不存在
+//	@param w
+//	@param serviceInfo
+func writeNotFound(w http.ResponseWriter, serviceInfo *model.ServiceInfo) {
+	writeError(w, http.StatusNotFound, "instance %s %s not found", serviceInfo.Key(), serviceInfo.Addr())
+}
+
+// writeError
+//
+//	@Description: 回复错误信息
+//	@param w
+//	@param status http状态码
+//	@param format 错误信息
+//	@param args
+func writeError(w http.ResponseWriter, status int, format string, args ...any) {
+	writeJson(w, status, map[string]string{"error": fmt.Sprintf(format, args...)})
+}
+
+// writeJson
+//
+//	@Description: 以json格式回复
+//	@param w
+//	@param status http状态码
+//	@param v 回复的内容
+func writeJson(w http.ResponseWriter, status int, v any) {
+	bytes, err := json.Marshal(v)
+	if err != nil {
+		contents.RpcLogger.Error(err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, _ = w.Write(bytes)
+}
@@ -0,0 +1,853 @@
+package cluster
+
+import (
+	"encoding/json"
+	"github.com/yuhao-jack/evolving-rpc/contents"
+	"github.com/yuhao-jack/evolving-rpc/errorx"
+	evolvingclient "github.com/yuhao-jack/evolving-rpc/evolving-client"
+	evolvingserver "github.com/yuhao-jack/evolving-rpc/evolving-server"
+	"github.com/yuhao-jack/evolving-rpc/evolving-server/svr_mgr"
+	"github.com/yuhao-jack/evolving-rpc/model"
+	"github.com/yuhao-jack/go-toolx/fun"
+	"github.com/yuhao-jack/go-toolx/netx"
+	"math/rand"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Node
+// @Description: 注册中心集群的节点，主备复制：节点按任期选主，得到多数节点投票的节点成为这个任期的主节点，
+// 副本把注册、下线、续约转发给主节点，主节点把每个变化按序号同步给副本，每个节点都可以提供DISCOVER和WATCH。
+// 主节点联系不上多数节点时退位，网络分区时只有多数节点的一侧有主节点。
+//
+// 复制是异步的：主节点在本地应用变化后就回复调用方，之后才同步给副本，不等多数节点确认。
+// 主节点在同步出去之前挂掉时，新的主节点会缺少这段时间已经回复成功的变化，通常不超过一个心跳间隔：
+// 缺少的注册和续约在服务下一次续约时发现租约不存在，由客户端重新注册补回；
+// 缺少的下线会让服务在新的主节点上保留到租约过期；缺少的配置版本会丢失，需要重新发布
+type Node struct {
+	conf       *model.ClusterConf
+	server     *evolvingserver.EvolvingServer
+	mgr        *svr_mgr.ServiceMgr
+	peers      map[string]*evolvingclient.EvolvingClient
+	peerLock   sync.RWMutex
+	isLeader   int32
+	indexLock  sync.Mutex
+	index      uint64 // 作为主节点时已经产生的变化序号
+	leaderTerm uint64 // 作为主节点时的任期
+	queueLock  sync.Mutex
+	queue      [][]byte      // 主节点等待同步给副本的变化
+	queued     chan struct{} // 有新的变化等待同步
+	closeOnce  sync.Once
+	closeChan  chan struct{}
+
+	followerLock sync.Mutex
+	random       *rand.Rand
+	term         uint64                           // 当前任期
+	votedFor     string                           // 当前任期投票给了哪个节点
+	votes        int                              // 作为候选节点在当前任期得到的票数
+	heardAt      time.Time                        // 最后一次收到主节点的消息或者投出票的时间
+	timeout      time.Duration                    // 超过这段时间没有收到主节点的消息时发起选举
+	acks         map[string]time.Time             // 作为主节点时每个副本最后一次确认心跳的时间
+	leader       string                           // 当前任期的主节点，还没有选出时为空
+	dataTerm     uint64                           // 本地的服务信息来自哪个任期的主节点
+	synced       bool                             // 是否已经从主节点拉取过所有服务信息
+	applied      uint64                           // 已经应用的变化序号
+	latest       uint64                           // 收到的最大的变化序号
+	stalled      int                              // 连续多少个心跳间隔没有跟上主节点
+	pending      map[uint64]*model.ClusterMessage // 乱序到达，还不能应用的变化
+}
+
+// NewClusterNode
+//
+//	@Description: 把注册中心变成集群的节点，服务端没有开启注册中心时自动开启，需要在服务端启动前调用
+//	@param server 注册中心的服务端
+//	@param conf 集群的配置
+//	@return *Node
+func NewClusterNode(server *evolvingserver.EvolvingServer, conf *model.ClusterConf) *Node {
+	n := &Node{
+		conf:      conf,
+		server:    server,
+		mgr:       server.EnableRegistry(),
+		peers:     make(map[string]*evolvingclient.EvolvingClient),
+		queued:    make(chan struct{}, 1),
+		closeChan: make(chan struct{}),
+		random:    rand.New(rand.NewSource(time.Now().UnixNano())),
+		pending:   make(map[uint64]*model.ClusterMessage),
+	}
+	//  选出主节点之前先当作副本，不清理过期的服务
+	n.mgr.SetReplica(true)
+	n.mgr.SetChangeListener(n.replicate)
+	n.mgr.SetConfigListener(n.replicateConfig)
+	for _, command := range []string{contents.Register, contents.DeRegister, contents.ALive, contents.PushConfig, contents.RollbackConfig} {
+		server.SetCommand(command, n.forwardOrHandle(server.GetCommand(command)))
+	}
+	server.SetCommand(contents.MarkDown, n.forwardOrHandle(n.handleMarkDown))
+	server.SetCommand(contents.ClusterSync, n.handleSync)
+	server.SetCommand(contents.ClusterEvent, n.handleEvent)
+	server.SetCommand(contents.ClusterVote, n.handleVote)
+	server.SetServiceLostHandler(n.serviceLost)
+	return n
+}
+
+// Start
+//
+//	@Description: 开始连接其它节点并选主
+//	@receiver n
+func (n *Node) Start() {
+	n.followerLock.Lock()
+	n.heardAt, n.timeout = time.Now(), n.randomTimeoutLocked()
+	n.followerLock.Unlock()
+	go n.loop()
+	go n.sendQueued()
+}
+
+// Close
+//
+//	@Description: 断开和其它节点的连接
+//	@receiver n
+func (n *Node) Close() {
+	n.closeOnce.Do(func() {
+		close(n.closeChan)
+		n.peerLock.RLock()
+		defer n.peerLock.RUnlock()
+		for _, client := range n.peers {
+			client.Close()
+		}
+	})
+}
+
+// Leader
+//
+//	@Description: 当前认为的主节点
+//	@receiver n
+//	@return string 主节点的地址，正在选主时为空
+func (n *Node) Leader() string {
+	n.followerLock.Lock()
+	defer n.followerLock.Unlock()
+	return n.leader
+}
+
+// Term
+//
+//	@Description: 当前任期
+//	@receiver n
+//	@return uint64
+func (n *Node) Term() uint64 {
+	n.followerLock.Lock()
+	defer n.followerLock.Unlock()
+	return n.term
+}
+
+// IsLeader
+//
+//	@Description: 本节点是否是主节点
+//	@receiver n
+//	@return bool
+func (n *Node) IsLeader() bool {
+	return atomic.LoadInt32(&n.isLeader) == 1
+}
+
+// interval
+//
+//	@Description: 主节点心跳的间隔
+//	@receiver n
+//	@return time.Duration
+func (n *Node) interval() time.Duration {
+	return fun.IfOr(n.conf.ElectionInterval > 0, n.conf.ElectionInterval, 300*time.Millisecond)
+}
+
+// randomTimeoutLocked
+//
+//	@Description: 随机的选举超时时间，3到6个心跳间隔，避免多个节点同时发起选举，调用方需要持有followerLock
+//	@receiver n
+//	@return time.Duration
+func (n *Node) randomTimeoutLocked() time.Duration {
+	return 3*n.interval() + time.Duration(n.random.Int63n(int64(3*n.interval())))
+}
+
+// quorum
+//
+//	@Description: 包括本节点在内的多数节点数
+//	@receiver n
+//	@return int
+func (n *Node) quorum() int {
+	return (len(n.conf.Peers)+1)/2 + 1
+}
+
+// loop
+//
+//	@Description: 定时连接其它节点，主节点发心跳并检查是否还联系得上多数节点，副本检查是否跟上了主节点，
+//	超时没有收到主节点的消息时发起选举
+//	@receiver n
+func (n *Node) loop() {
+	ticker := time.NewTicker(n.interval())
+	defer ticker.Stop()
+	for i := 0; ; i++ {
+		if i%5 == 0 {
+			n.dialPeers()
+		}
+		if n.IsLeader() {
+			n.checkQuorum()
+			n.heartbeat()
+		} else if n.electionDue() {
+			n.campaign()
+		} else {
+			n.checkSync()
+		}
+		select {
+		case <-n.closeChan:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// dialPeers
+//
+//	@Description: 连接还没有连上过的节点，连上之后由客户端自己重连
+//	@receiver n
+func (n *Node) dialPeers() {
+	for _, addr := range n.conf.Peers {
+		if n.getPeer(addr) != nil {
+			continue
+		}
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			contents.RpcLogger.Error("bad peer addr %s,err:%v", addr, err)
+			continue
+		}
+		p, _ := strconv.Atoi(port)
+		client := evolvingclient.NewEvolvingClient(&model.EvolvingClientConfig{
+			EvolvingServerHost:   host,
+			EvolvingServerPort:   int32(p),
+			HeartbeatInterval:    n.interval(),
+			ReconnectInterval:    n.interval(),
+			MaxReconnectInterval: 4 * n.interval(),
+		})
+		if client == nil {
+			continue
+		}
+		n.peerLock.Lock()
+		n.peers[addr] = client
+		n.peerLock.Unlock()
+	}
+}
+
+// getPeer
+//
+//	@Description: 获取到其它节点的连接
+//	@receiver n
+//	@param addr 节点的地址
+//	@return *evolvingclient.EvolvingClient 还没有连上过时为nil
+func (n *Node) getPeer(addr string) *evolvingclient.EvolvingClient {
+	n.peerLock.RLock()
+	defer n.peerLock.RUnlock()
+	return n.peers[addr]
+}
+
+// electionDue
+//
+//	@Description: 是否已经超时没有收到主节点的消息
+//	@receiver n
+//	@return bool
+func (n *Node) electionDue() bool {
+	n.followerLock.Lock()
+	defer n.followerLock.Unlock()
+	return time.Since(n.heardAt) >= n.timeout
+}
+
+// campaign
+//
+//	@Description: 发起选举，进入下一个任期并投票给自己，再向其它节点请求投票
+//	@receiver n
+func (n *Node) campaign() {
+	n.followerLock.Lock()
+	n.becomeFollowerLocked(n.term+1, "")
+	n.votedFor, n.votes = n.conf.NodeAddr, 1
+	vote := model.ClusterVote{Term: n.term, Candidate: n.conf.NodeAddr}
+	vote.DataTerm, vote.Applied = n.positionLocked()
+	if n.votes >= n.quorum() {
+		n.becomeLeaderLocked()
+	}
+	n.followerLock.Unlock()
+	bytes, err := json.Marshal(&vote)
+	if err != nil {
+		contents.RpcLogger.Error(err.Error())
+		return
+	}
+	n.broadcast(contents.ClusterVote, bytes, func(addr string, reply netx.IMessage) {
+		n.onVote(vote.Term, reply)
+	})
+}
+
+// onVote
+//
+//	@Description: 候选节点收到投票的回复，得到多数节点的投票后成为主节点，有节点的任期更大时放弃选举
+//	@receiver n
+//	@param term 发起选举时的任期
+//	@param reply 投票节点的回复
+func (n *Node) onVote(term uint64, reply netx.IMessage) {
+	if model.StatusOf(reply) != nil {
+		return
+	}
+	var vote model.ClusterVote
+	if err := json.Unmarshal(reply.GetBody(), &vote); err != nil {
+		contents.RpcLogger.Error(err.Error())
+		return
+	}
+	n.followerLock.Lock()
+	defer n.followerLock.Unlock()
+	if vote.Term > n.term {
+		n.becomeFollowerLocked(vote.Term, "")
+		return
+	}
+	if !vote.Granted || term != n.term || n.leader != "" || n.votedFor != n.conf.NodeAddr {
+		return
+	}
+	if n.votes++; n.votes >= n.quorum() {
+		n.becomeLeaderLocked()
+	}
+}
+
+// handleVote
+//
+//	@Description: 处理候选节点的投票请求，每个任期只投一票，只投给服务信息不比本节点旧的候选节点
+//	@receiver n
+//	@param dataPack
+//	@param message
+func (n *Node) handleVote(dataPack *netx.DataPack, message netx.IMessage) {
+	var vote model.ClusterVote
+	if err := json.Unmarshal(message.GetBody(), &vote); err != nil {
+		n.server.Execute(dataPack, model.SetStatus(message, errorx.WithCode(errorx.BadRequest, err)), nil)
+		return
+	}
+	n.followerLock.Lock()
+	if vote.Term > n.term {
+		n.becomeFollowerLocked(vote.Term, "")
+	}
+	dataTerm, applied := n.positionLocked()
+	vote.Granted = vote.Term == n.term && (n.votedFor == "" || n.votedFor == vote.Candidate) &&
+		(vote.DataTerm > dataTerm || (vote.DataTerm == dataTerm && vote.Applied >= applied))
+	if vote.Granted {
+		n.votedFor = vote.Candidate
+		n.heardAt = time.Now()
+	}
+	vote.Term = n.term
+	n.followerLock.Unlock()
+	bytes, err := json.Marshal(&vote)
+	if err != nil {
+		n.server.Execute(dataPack, model.SetStatus(message, err), nil)
+		return
+	}
+	message.SetBody(bytes)
+	n.server.Execute(dataPack, message, nil)
+}
+
+// positionLocked
+//
+//	@Description: 本地的服务信息来自哪个任期的主节点以及应用到的变化序号，选主时用来比较服务信息的新旧，调用方需要持有followerLock
+//	@receiver n
+//	@return dataTerm
+//	@return applied
+func (n *Node) positionLocked() (dataTerm, applied uint64) {
+	if n.IsLeader() {
+		n.indexLock.Lock()
+		defer n.indexLock.Unlock()
+		return n.leaderTerm, n.index
+	}
+	return n.dataTerm, n.applied
+}
+
+// becomeFollowerLocked
+//
+//	@Description: 进入新的任期或者跟随当前任期的主节点，作为主节点时退位，之后需要重新从主节点拉取所有服务信息，
+//	调用方需要持有followerLock
+//	@receiver n
+//	@param term 任期
+//	@param leader 主节点，还不知道时为空
+func (n *Node) becomeFollowerLocked(term uint64, leader string) {
+	if term > n.term {
+		n.term, n.votedFor, n.votes = term, "", 0
+	}
+	n.leader = leader
+	n.heardAt, n.timeout = time.Now(), n.randomTimeoutLocked()
+	n.synced, n.latest, n.stalled = false, 0, 0
+	n.pending = make(map[uint64]*model.ClusterMessage)
+	if atomic.CompareAndSwapInt32(&n.isLeader, 1, 0) {
+		contents.RpcLogger.Warn("%s: step down at term %d.", n.conf.NodeAddr, n.term)
+		n.mgr.SetReplica(true)
+	}
+	if leader != "" {
+		contents.RpcLogger.Info("%s: cluster leader is %s at term %d.", n.conf.NodeAddr, leader, term)
+	}
+}
+
+// becomeLeaderLocked
+//
+//	@Description: 得到多数节点的投票后成为当前任期的主节点，调用方需要持有followerLock
+//	@receiver n
+func (n *Node) becomeLeaderLocked() {
+	n.leader, n.dataTerm = n.conf.NodeAddr, n.term
+	//  刚当选时认为其它节点都联系得上，之后按心跳的确认判断
+	n.acks = make(map[string]time.Time)
+	for _, addr := range n.conf.Peers {
+		n.acks[addr] = time.Now()
+	}
+	n.indexLock.Lock()
+	if n.index < n.applied {
+		n.index = n.applied
+	}
+	n.leaderTerm = n.term
+	n.indexLock.Unlock()
+	atomic.StoreInt32(&n.isLeader, 1)
+	n.mgr.SetReplica(false)
+	contents.RpcLogger.Info("%s: cluster leader is %s at term %d.", n.conf.NodeAddr, n.conf.NodeAddr, n.term)
+}
+
+// checkQuorum
+//
+//	@Description: 主节点超过3个心跳间隔联系不上多数节点时退位，网络分区时少数节点一侧的主节点不再接受注册
+//	@receiver n
+func (n *Node) checkQuorum() {
+	n.followerLock.Lock()
+	defer n.followerLock.Unlock()
+	if !n.IsLeader() {
+		return
+	}
+	reachable := 1
+	for _, ackAt := range n.acks {
+		if time.Since(ackAt) < 3*n.interval() {
+			reachable++
+		}
+	}
+	if reachable < n.quorum() {
+		contents.RpcLogger.Warn("%s: only %d nodes reachable at term %d.", n.conf.NodeAddr, reachable, n.term)
+		n.becomeFollowerLocked(n.term, "")
+	}
+}
+
+// replicate
+//
+//	@Description: 主节点给服务变化分配序号并放入同步队列，由sendQueued发给副本，在ServiceMgr持有锁时调用，顺序和变化的顺序一致
+//	@receiver n
+//	@param event 服务变化
+func (n *Node) replicate(event *model.ServiceEvent) {
+	n.enqueue(&model.ClusterMessage{Event: event})
+}
+
+// replicateConfig
+//
+//	@Description: 主节点给发布的配置分配序号并放入同步队列，和服务变化共用序号，在ServiceMgr持有锁时调用
+//	@receiver n
+//	@param config 新版本的配置
+func (n *Node) replicateConfig(config *model.Config) {
+	n.enqueue(&model.ClusterMessage{Config: config})
+}
+
+// enqueue
+//
+//	@Description: 主节点给变化分配序号，序列化后放入同步队列
+//	@receiver n
+//	@param clusterMessage 只带变化内容的消息，任期、主节点和序号在这里填上
+func (n *Node) enqueue(clusterMessage *model.ClusterMessage) {
+	if !n.IsLeader() {
+		return
+	}
+	n.indexLock.Lock()
+	n.index++
+	clusterMessage.Term, clusterMessage.Leader, clusterMessage.Index = n.leaderTerm, n.conf.NodeAddr, n.index
+	bytes, err := json.Marshal(clusterMessage)
+	n.indexLock.Unlock()
+	if err != nil {
+		contents.RpcLogger.Error(err.Error())
+		return
+	}
+	n.queueLock.Lock()
+	n.queue = append(n.queue, bytes)
+	n.queueLock.Unlock()
+	select {
+	case n.queued <- struct{}{}:
+	default:
+	}
+}
+
+// sendQueued
+//
+//	@Description: 按顺序把同步队列里的变化发给副本，发送时不占用ServiceMgr的锁
+//	@receiver n
+func (n *Node) sendQueued() {
+	for {
+		select {
+		case <-n.closeChan:
+			return
+		case <-n.queued:
+		}
+		n.queueLock.Lock()
+		queue := n.queue
+		n.queue = nil
+		n.queueLock.Unlock()
+		for _, bytes := range queue {
+			n.broadcast(contents.ClusterEvent, bytes, nil)
+		}
+	}
+}
+
+// heartbeat
+//
+//	@Description: 主节点把任期和当前的变化序号发给副本，副本据此发现漏掉的变化，副本的确认说明还联系得上
+//	@receiver n
+func (n *Node) heartbeat() {
+	n.indexLock.Lock()
+	term := n.leaderTerm
+	bytes, err := json.Marshal(&model.ClusterMessage{Term: term, Leader: n.conf.NodeAddr, Index: n.index})
+	n.indexLock.Unlock()
+	if err != nil {
+		contents.RpcLogger.Error(err.Error())
+		return
+	}
+	n.broadcast(contents.ClusterEvent, bytes, func(addr string, reply netx.IMessage) {
+		n.onHeartbeatReply(addr, term, reply)
+	})
+}
+
+// onHeartbeatReply
+//
+//	@Description: 主节点收到副本对心跳的确认，副本的任期更大时退位
+//	@receiver n
+//	@param addr 副本的地址
+//	@param term 发出心跳时的任期
+//	@param reply 副本的回复
+func (n *Node) onHeartbeatReply(addr string, term uint64, reply netx.IMessage) {
+	if model.StatusOf(reply) != nil {
+		return
+	}
+	var clusterMessage model.ClusterMessage
+	if err := json.Unmarshal(reply.GetBody(), &clusterMessage); err != nil {
+		contents.RpcLogger.Error(err.Error())
+		return
+	}
+	n.followerLock.Lock()
+	defer n.followerLock.Unlock()
+	if clusterMessage.Term > n.term {
+		n.becomeFollowerLocked(clusterMessage.Term, "")
+		return
+	}
+	if n.IsLeader() && clusterMessage.Term == term && term == n.term {
+		n.acks[addr] = time.Now()
+	}
+}
+
+// broadcast
+//
+//	@Description: 把消息发给所有连接正常的节点
+//	@receiver n
+//	@param command 命令
+//	@param bytes 消息体
+//	@param callBack 每个节点回复后的回调，为nil时不等回复
+func (n *Node) broadcast(command string, bytes []byte, callBack func(addr string, reply netx.IMessage)) {
+	n.peerLock.RLock()
+	defer n.peerLock.RUnlock()
+	for addr, client := range n.peers {
+		if client.GetState() != contents.Connected {
+			continue
+		}
+		if callBack == nil {
+			client.Execute(netx.NewDefaultMessage([]byte(command), bytes), nil)
+			continue
+		}
+		addr := addr
+		client.Execute(netx.NewDefaultMessage([]byte(command), bytes), func(reply netx.IMessage) {
+			callBack(addr, reply)
+		})
+	}
+}
+
+// handleEvent
+//
+//	@Description: 副本收到主节点同步过来的变化或者心跳，拒绝任期比自己小的主节点，按序号顺序应用变化，心跳需要回复
+//	@receiver n
+//	@param dataPack
+//	@param message
+func (n *Node) handleEvent(dataPack *netx.DataPack, message netx.IMessage) {
+	var clusterMessage model.ClusterMessage
+	if err := json.Unmarshal(message.GetBody(), &clusterMessage); err != nil {
+		contents.RpcLogger.Error(err.Error())
+		return
+	}
+	n.followerLock.Lock()
+	accepted, changed := n.acceptLocked(&clusterMessage)
+	if accepted {
+		if clusterMessage.Index > n.latest {
+			n.latest = clusterMessage.Index
+		}
+		if !clusterMessage.IsHeartbeat() && clusterMessage.Index > n.applied {
+			n.pending[clusterMessage.Index] = &clusterMessage
+		}
+		n.applyPendingLocked()
+	}
+	term := n.term
+	n.followerLock.Unlock()
+	if changed {
+		n.requestSync()
+	}
+	if !clusterMessage.IsHeartbeat() {
+		return
+	}
+	bytes, err := json.Marshal(&model.ClusterMessage{Term: term})
+	if err != nil {
+		n.server.Execute(dataPack, model.SetStatus(message, err), nil)
+		return
+	}
+	message.SetBody(bytes)
+	n.server.Execute(dataPack, message, nil)
+}
+
+// acceptLocked
+//
+//	@Description: 检查主节点的消息，任期比本节点小时拒绝，任期更大或者是当前任期新选出的主节点时跟随它，调用方需要持有followerLock
+//	@receiver n
+//	@param clusterMessage 主节点的消息
+//	@return accepted 是否接受
+//	@return changed 是否换了主节点，需要重新拉取所有服务信息
+func (n *Node) acceptLocked(clusterMessage *model.ClusterMessage) (accepted, changed bool) {
+	if clusterMessage.Term < n.term || clusterMessage.Leader == n.conf.NodeAddr {
+		return false, false
+	}
+	if clusterMessage.Term > n.term || clusterMessage.Leader != n.leader {
+		n.becomeFollowerLocked(clusterMessage.Term, clusterMessage.Leader)
+		changed = true
+	}
+	n.heardAt = time.Now()
+	return true, changed
+}
+
+// applyPendingLocked
+//
+//	@Description: 按序号顺序应用能应用的变化，调用方需要持有followerLock
+//	@receiver n
+func (n *Node) applyPendingLocked() {
+	if !n.synced {
+		return
+	}
+	for index := range n.pending {
+		if index <= n.applied {
+			delete(n.pending, index)
+		}
+	}
+	for {
+		clusterMessage, ok := n.pending[n.applied+1]
+		if !ok {
+			return
+		}
+		delete(n.pending, n.applied+1)
+		if clusterMessage.Config != nil {
+			n.mgr.ApplyConfig(clusterMessage.Config)
+		} else {
+			n.mgr.ApplyEvent(clusterMessage.Event)
+		}
+		n.applied++
+	}
+}
+
+// checkSync
+//
+//	@Description: 副本连续两个心跳间隔没有跟上主节点时重新拉取所有服务信息
+//	@receiver n
+func (n *Node) checkSync() {
+	n.followerLock.Lock()
+	if n.leader == "" || (n.synced && n.latest <= n.applied) {
+		n.stalled = 0
+		n.followerLock.Unlock()
+		return
+	}
+	n.stalled++
+	if n.stalled < 2 {
+		n.followerLock.Unlock()
+		return
+	}
+	n.stalled = 0
+	n.synced = false
+	n.followerLock.Unlock()
+	n.requestSync()
+}
+
+// requestSync
+//
+//	@Description: 副本向主节点拉取所有服务信息
+//	@receiver n
+func (n *Node) requestSync() {
+	client := n.getPeer(n.Leader())
+	if client == nil {
+		return
+	}
+	client.Execute(netx.NewDefaultMessage([]byte(contents.ClusterSync), nil), n.onSync)
+}
+
+// onSync
+//
+//	@Description: 副本收到主节点的所有服务信息和配置，替换本地的服务信息和配置后接着应用之后的变化
+//	@receiver n
+//	@param reply 主节点的回复
+func (n *Node) onSync(reply netx.IMessage) {
+	if err := model.StatusOf(reply); err != nil {
+		contents.RpcLogger.Warn("%s: sync from leader failed,err:%v", n.conf.NodeAddr, err)
+		return
+	}
+	var clusterMessage model.ClusterMessage
+	if err := json.Unmarshal(reply.GetBody(), &clusterMessage); err != nil {
+		contents.RpcLogger.Error(err.Error())
+		return
+	}
+	n.followerLock.Lock()
+	defer n.followerLock.Unlock()
+	if clusterMessage.Term != n.term || clusterMessage.Leader != n.leader {
+		return
+	}
+	n.mgr.ApplySnapshot(clusterMessage.ServiceList, clusterMessage.Configs)
+	n.dataTerm, n.applied = clusterMessage.Term, clusterMessage.Index
+	if n.latest < n.applied {
+		n.latest = n.applied
+	}
+	n.synced = true
+	n.stalled = 0
+	n.applyPendingLocked()
+	contents.RpcLogger.Info("%s: synced %d services and %d configs from leader %s at %d.", n.conf.NodeAddr, len(clusterMessage.ServiceList), len(clusterMessage.Configs), n.leader, n.applied)
+}
+
+// handleSync
+//
+//	@Description: 主节点回复所有服务信息、配置、任期和当前的变化序号
+//	@receiver n
+//	@param dataPack
+//	@param message
+func (n *Node) handleSync(dataPack *netx.DataPack, message netx.IMessage) {
+	if !n.IsLeader() {
+		n.server.Execute(dataPack, model.SetStatus(message, n.notLeaderErr()), nil)
+		return
+	}
+	n.mgr.Sync(func(serviceList []*model.ServiceInfo, configs map[string][]*model.Config) {
+		n.indexLock.Lock()
+		bytes, err := json.Marshal(&model.ClusterMessage{Term: n.leaderTerm, Leader: n.conf.NodeAddr, Index: n.index, ServiceList: serviceList, Configs: configs})
+		n.indexLock.Unlock()
+		if err != nil {
+			n.server.Execute(dataPack, model.SetStatus(message, err), nil)
+			return
+		}
+		message.SetBody(bytes)
+		n.server.Execute(dataPack, message, nil)
+	})
+}
+
+// forwardOrHandle
+//
+//	@Description: 会修改服务信息或者配置的命令，主节点自己处理，副本转发给主节点，
+//	主节点处理完就回复，不等副本确认，见Node的说明
+//	@receiver n
+//	@param handle 本地的处理方法
+//	@return func(dataPack *netx.DataPack, message netx.IMessage)
+func (n *Node) forwardOrHandle(handle func(dataPack *netx.DataPack, message netx.IMessage)) func(dataPack *netx.DataPack, message netx.IMessage) {
+	return func(dataPack *netx.DataPack, message netx.IMessage) {
+		//  单纯的心跳不用转发
+		if n.IsLeader() || (string(message.GetCommand()) == contents.ALive && len(message.GetBody()) == 0) {
+			handle(dataPack, message)
+			return
+		}
+		if m, ok := message.(*model.RpcMessage); ok && m.Meta[contents.ForwardedBy] != "" {
+			//  转发过来的消息不再转发，避免节点之间对主节点的看法不一致时来回转发
+			n.server.Execute(dataPack, model.SetStatus(message, n.notLeaderErr()), nil)
+			return
+		}
+		n.forward(message, func(reply netx.IMessage) {
+			if err := model.StatusOf(reply); err != nil {
+				model.SetStatus(message, err)
+			} else {
+				message.SetBody(reply.GetBody())
+			}
+			//  续约的回复里带着被强制下线的租约
+			r, ok := reply.(*model.RpcMessage)
+			m, isRpc := message.(*model.RpcMessage)
+			if ok && isRpc && r.Meta[contents.RevokedLeases] != "" {
+				if m.Meta == nil {
+					m.Meta = map[string]string{}
+				}
+				m.Meta[contents.RevokedLeases] = r.Meta[contents.RevokedLeases]
+			}
+			n.server.Execute(dataPack, message, nil)
+		})
+	}
+}
+
+// forward
+//
+//	@Description: 把消息转发给主节点，原来的元信息一起转发，主节点据此校验配置的令牌
+//	@receiver n
+//	@param message 需要转发的消息
+//	@param callBack 主节点回复后的回调，主节点不可用时立即回调
+func (n *Node) forward(message netx.IMessage, callBack func(reply netx.IMessage)) {
+	leader := n.Leader()
+	client := n.getPeer(leader)
+	forwarded := model.NewRpcMessage(netx.NewDefaultMessage(message.GetCommand(), message.GetBody()), 0)
+	forwarded.Meta = map[string]string{}
+	if m, ok := message.(*model.RpcMessage); ok {
+		for key, value := range m.Meta {
+			forwarded.Meta[key] = value
+		}
+	}
+	forwarded.Meta[contents.ForwardedBy] = n.conf.NodeAddr
+	if client == nil {
+		callBack(model.SetStatus(forwarded, errorx.New(errorx.Unavailable, "cluster leader %s is unavailable", leader)))
+		return
+	}
+	client.Execute(forwarded, callBack)
+}
+
+// serviceLost
+//
+//	@Description: 注册过服务的连接断开时，主节点把服务标记为下线，副本转发给主节点
+//	@receiver n
+//	@param serviceInfo
+func (n *Node) serviceLost(serviceInfo *model.ServiceInfo) {
+	if n.IsLeader() {
+		n.mgr.MarkServiceDown(serviceInfo)
+		return
+	}
+	bytes, err := json.Marshal(serviceInfo)
+	if err != nil {
+		contents.RpcLogger.Error(err.Error())
+		return
+	}
+	n.forward(netx.NewDefaultMessage([]byte(contents.MarkDown), bytes), func(reply netx.IMessage) {
+		if err := model.StatusOf(reply); err != nil {
+			contents.RpcLogger.Warn("%s: mark service %s down failed,err:%v", n.conf.NodeAddr, serviceInfo.ServiceName, err)
+		}
+	})
+}
+
+// handleMarkDown
+//
+//	@Description: 主节点处理副本转发过来的服务断开
+//	@receiver n
+//	@param dataPack
+//	@param message
+func (n *Node) handleMarkDown(dataPack *netx.DataPack, message netx.IMessage) {
+	var serviceInfo model.ServiceInfo
+	if err := json.Unmarshal(message.GetBody(), &serviceInfo); err != nil {
+		n.server.Execute(dataPack, model.SetStatus(message, errorx.WithCode(errorx.BadRequest, err)), nil)
+		return
+	}
+	n.mgr.MarkServiceDown(&serviceInfo)
+	message.SetBody([]byte(contents.OK))
+	n.server.Execute(dataPack, message, nil)
+}
+
+// notLeaderErr
+//
+//	@Description: 本节点不是主节点时的错误信息
+//	@receiver n
+//	@return error
+func (n *Node) notLeaderErr() error {
+	return errorx.New(errorx.Unavailable, "%s is not the cluster leader", n.conf.NodeAddr)
+}
@@ -0,0 +1,210 @@
+package svr_mgr
+
+import (
+	"encoding/json"
+	"github.com/yuhao-jack/evolving-rpc/contents"
+	"github.com/yuhao-jack/evolving-rpc/errorx"
+	"github.com/yuhao-jack/evolving-rpc/model"
+	"github.com/yuhao-jack/go-toolx/fun"
+	"github.com/yuhao-jack/go-toolx/netx"
+	"time"
+)
+
+// maxConfigVersions 每份配置最多保留的历史版本数
+const maxConfigVersions = 100
+
+// PushConfig
+//
+//	@Description: 发布新版本的配置并推送给订阅方，开启持久化时写入变更日志，集群的主节点会同步给副本
+//	@receiver m
+//	@param namespace 命名空间，为空时为default
+//	@param serviceName 服务名
+//	@param data 配置内容
+//	@return *model.Config 发布的配置
+func (m *ServiceMgr) PushConfig(namespace, serviceName string, data map[string]string) *model.Config {
+	m.lock.Lock()
+	defer m.unlock()
+	return m.pushConfigLocked((&model.Config{Namespace: namespace, ServiceName: serviceName, Data: data}).Clone())
+}
+
+// RollbackConfig
+//
+//	@Description: 把配置回滚到之前的版本，原来版本的内容作为新版本发布，订阅方会收到变化
+//	@receiver m
+//	@param namespace 命名空间，为空时为default
+//	@param serviceName 服务名
+//	@param version 要回滚到的版本
+//	@return *model.Config 回滚后发布的配置
+//	@return error 版本不存在时为NotFound
+func (m *ServiceMgr) RollbackConfig(namespace, serviceName string, version uint64) (*model.Config, error) {
+	m.lock.Lock()
+	defer m.unlock()
+	old := m.findConfigLocked(model.ConfigKey(namespace, serviceName), version)
+	if old == nil {
+		return nil, errorx.New(errorx.NotFound, "config %s version %d not found", model.ConfigKey(namespace, serviceName), version)
+	}
+	config := old.Clone()
+	config.RollbackOf = old.Version
+	return m.pushConfigLocked(config), nil
+}
+
+// GetConfig
+//
+//	@Description: 读取配置
+//	@receiver m
+//	@param namespace 命名空间，为空时为default
+//	@param serviceName 服务名
+//	@param version 版本，为0时读取最新版本
+//	@return *model.Config 配置的副本
+//	@return error 配置或者版本不存在时为NotFound
+func (m *ServiceMgr) GetConfig(namespace, serviceName string, version uint64) (*model.Config, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	config := m.findConfigLocked(model.ConfigKey(namespace, serviceName), version)
+	if config == nil {
+		return nil, errorx.New(errorx.NotFound, "config %s version %d not found", model.ConfigKey(namespace, serviceName), version)
+	}
+	return config.Clone(), nil
+}
+
+// ConfigHistory
+//
+//	@Description: 获取配置保留的所有版本
+//	@receiver m
+//	@param namespace 命名空间，为空时为default
+//	@param serviceName 服务名
+//	@return history 从旧到新的所有版本的副本
+func (m *ServiceMgr) ConfigHistory(namespace, serviceName string) (history []*model.Config) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	for _, config := range m.configs[model.ConfigKey(namespace, serviceName)] {
+		history = append(history, config.Clone())
+	}
+	return history
+}
+
+// WatchConfig
+//
+//	@Description: 订阅配置，之后发布的版本都会通过WATCH_CONFIG命令推送给订阅方
+//	@receiver m
+//	@param namespace 命名空间，为空时为default
+//	@param serviceName 服务名
+//	@param pack 订阅方的连接包
+//	@param sendMsg 推送消息的方法
+//	@param snapshot 拿到订阅时的最新版本后的回调，在推送任何变化之前执行，还没有配置时为nil
+func (m *ServiceMgr) WatchConfig(namespace, serviceName string, pack *netx.DataPack, sendMsg func(dataPack *netx.DataPack, message netx.IMessage), snapshot func(config *model.Config)) {
+	m.lock.Lock()
+	defer m.unlock()
+	key := model.ConfigKey(namespace, serviceName)
+	if m.configWatchers[key] == nil {
+		m.configWatchers[key] = make(map[*netx.DataPack]func(dataPack *netx.DataPack, message netx.IMessage))
+	}
+	m.configWatchers[key][pack] = sendMsg
+	if config := m.findConfigLocked(key, 0); config != nil {
+		snapshot(config.Clone())
+		return
+	}
+	snapshot(nil)
+}
+
+// findConfigLocked
+//
+//	@Description: 查找配置的版本，调用方需要持有锁
+//	@receiver m
+//	@param key 配置的唯一标识
+//	@param version 版本，为0时为最新版本
+//	@return *model.Config 不存在时为nil
+func (m *ServiceMgr) findConfigLocked(key string, version uint64) *model.Config {
+	history := m.configs[key]
+	if len(history) == 0 {
+		return nil
+	}
+	if version == 0 {
+		return history[len(history)-1]
+	}
+	for _, config := range history {
+		if config.Version == version {
+			return config
+		}
+	}
+	return nil
+}
+
+// pushConfigLocked
+//
+//	@Description: 生成新版本的版本号和发布时间并保存，调用方需要持有写锁
+//	@receiver m
+//	@param config 新版本的配置
+//	@return *model.Config 发布的配置的副本
+func (m *ServiceMgr) pushConfigLocked(config *model.Config) *model.Config {
+	config.Namespace = fun.IfOr(config.Namespace == "", contents.DefaultNamespace, config.Namespace)
+	if config.Data == nil {
+		config.Data = make(map[string]string)
+	}
+	config.Version = 1
+	if latest := m.findConfigLocked(config.Key(), 0); latest != nil {
+		config.Version = latest.Version + 1
+	}
+	config.UpdateTime = time.Now()
+	m.putConfigLocked(config)
+	contents.RpcLogger.Info("config %s published version %d.", config.Key(), config.Version)
+	return config.Clone()
+}
+
+// putConfigLocked
+//
+//	@Description: 保存配置的新版本并写日志，释放写锁时推送给订阅方，集群的主节点还会同步给副本，
+//	版本不比最新版本新时忽略，调用方需要持有写锁
+//	@receiver m
+//	@param config 新版本的配置
+func (m *ServiceMgr) putConfigLocked(config *model.Config) {
+	key := config.Key()
+	history, added := appendConfig(m.configs[key], config)
+	if !added {
+		return
+	}
+	m.configs[key] = history
+	m.appendConfigLocked(config)
+	m.notifyConfigLocked(config)
+	if m.configListener != nil {
+		m.configListener(config)
+	}
+}
+
+// notifyConfigLocked
+//
+//	@Description: 把配置的新版本放入待推送的消息，调用方需要持有写锁，释放写锁时推送给订阅方
+//	@receiver m
+//	@param config 新版本的配置
+func (m *ServiceMgr) notifyConfigLocked(config *model.Config) {
+	watchers := m.configWatchers[config.Key()]
+	if len(watchers) == 0 {
+		return
+	}
+	bytes, err := json.Marshal(config)
+	if err != nil {
+		contents.RpcLogger.Error(err.Error())
+		return
+	}
+	for pack, sendMsg := range watchers {
+		m.outbox = append(m.outbox, &delivery{pack: pack, sendMsg: sendMsg, message: netx.NewDefaultMessage([]byte(contents.WatchConfig), bytes)})
+	}
+}
+
+// appendConfig
+//
+//	@Description: 把新版本加到历史版本的最后，最多保留maxConfigVersions个版本
+//	@param history 从旧到新的历史版本
+//	@param config 新版本的配置
+//	@return []*model.Config 新的历史版本
+//	@return bool 版本不比最新版本新时为false，历史版本不变
+func appendConfig(history []*model.Config, config *model.Config) ([]*model.Config, bool) {
+	if len(history) > 0 && history[len(history)-1].Version >= config.Version {
+		return history, false
+	}
+	history = append(history, config)
+	if len(history) > maxConfigVersions {
+		history = append([]*model.Config(nil), history[len(history)-maxConfigVersions:]...)
+	}
+	return history, true
+}
@@ -0,0 +1,181 @@
+package svr_mgr
+
+import (
+	"github.com/yuhao-jack/evolving-rpc/contents"
+	"github.com/yuhao-jack/evolving-rpc/model"
+	"time"
+)
+
+// SetReplica
+//
+//	@Description: 设置是否是集群中的副本，副本成为主节点时所有租约重新计时，让服务有时间向新的主节点续约
+//	@receiver m
+//	@param replica
+func (m *ServiceMgr) SetReplica(replica bool) {
+	m.lock.Lock()
+	defer m.unlock()
+	if m.replica && !replica {
+		now := time.Now()
+		for _, l := range m.leases {
+			l.expireAt = now.Add(l.ttl)
+		}
+	}
+	m.replica = replica
+}
+
+// SetChangeListener
+//
+//	@Description: 设置服务有变化时的回调，回调在持有锁时同步执行，顺序和变化的顺序一致，
+//	回调只能记录变化，不能阻塞或者发网络请求，发送要放到锁外，回调里也不能再调用ServiceMgr的方法
+//	@receiver m
+//	@param f 回调方法，事件里的服务信息只能在回调里使用
+func (m *ServiceMgr) SetChangeListener(f func(event *model.ServiceEvent)) {
+	m.lock.Lock()
+	defer m.unlock()
+	m.changeListener = f
+}
+
+// SetConfigListener
+//
+//	@Description: 设置发布配置时的回调，回调在持有锁时同步执行，顺序和发布的顺序一致，
+//	回调只能记录配置，不能阻塞或者发网络请求，发送要放到锁外，回调里也不能再调用ServiceMgr的方法
+//	@receiver m
+//	@param f 回调方法，配置只能在回调里使用
+func (m *ServiceMgr) SetConfigListener(f func(config *model.Config)) {
+	m.lock.Lock()
+	defer m.unlock()
+	m.configListener = f
+}
+
+// Sync
+//
+//	@Description: 获取所有服务信息和配置，回调在持有锁时执行，这期间不会有新的变化
+//	@receiver m
+//	@param f 拿到所有服务信息和配置后的回调，配置只能在回调里使用
+func (m *ServiceMgr) Sync(f func(serviceList []*model.ServiceInfo, configs map[string][]*model.Config)) {
+	m.lock.Lock()
+	defer m.unlock()
+	serviceList := make([]*model.ServiceInfo, 0, m.ServiceInfoList.Size())
+	m.ServiceInfoList.ForEach(func(info *model.ServiceInfo) {
+		serviceList = append(serviceList, info.Clone())
+	})
+	f(serviceList, m.configs)
+}
+
+// ApplyEvent
+//
+//	@Description: 应用主节点同步过来的服务变化
+//	@receiver m
+//	@param event 服务变化事件
+func (m *ServiceMgr) ApplyEvent(event *model.ServiceEvent) {
+	m.lock.Lock()
+	defer m.unlock()
+	if event.Type == contents.ServiceRemove {
+		if info := m.findLocked(event.ServiceInfo); info != nil {
+			m.removeLocked(info)
+		}
+		return
+	}
+	m.putLocked(event.ServiceInfo)
+}
+
+// ApplyConfig
+//
+//	@Description: 应用主节点同步过来的配置的新版本，原样保存版本号和发布时间
+//	@receiver m
+//	@param config 新版本的配置
+func (m *ServiceMgr) ApplyConfig(config *model.Config) {
+	m.lock.Lock()
+	defer m.unlock()
+	m.putConfigLocked(config.Clone())
+}
+
+// ApplySnapshot
+//
+//	@Description: 用主节点同步过来的所有服务信息和配置替换本地的服务信息和配置
+//	@receiver m
+//	@param serviceList 主节点的所有服务信息
+//	@param configs 主节点的所有配置的历史版本
+func (m *ServiceMgr) ApplySnapshot(serviceList []*model.ServiceInfo, configs map[string][]*model.Config) {
+	m.lock.Lock()
+	defer m.unlock()
+	var removed []*model.ServiceInfo
+	m.ServiceInfoList.ForEach(func(info *model.ServiceInfo) {
+		for _, serviceInfo := range serviceList {
+			if info.SameInstance(serviceInfo) {
+				return
+			}
+		}
+		removed = append(removed, info)
+	})
+	for _, info := range removed {
+		m.removeLocked(info)
+	}
+	for _, serviceInfo := range serviceList {
+		m.putLocked(serviceInfo)
+	}
+	for key := range m.configs {
+		if _, ok := configs[key]; !ok {
+			delete(m.configs, key)
+		}
+	}
+	for key, history := range configs {
+		if len(history) == 0 {
+			continue
+		}
+		replaced := make([]*model.Config, 0, len(history))
+		for _, config := range history {
+			replaced = append(replaced, config.Clone())
+		}
+		latest := replaced[len(replaced)-1]
+		if local := m.findConfigLocked(key, 0); local == nil || local.Version != latest.Version {
+			m.notifyConfigLocked(latest)
+		}
+		m.configs[key] = replaced
+	}
+	if m.wal != nil {
+		if err := m.snapshotLocked(); err != nil {
+			contents.RpcLogger.Error("snapshot failed,err:%v", err)
+		}
+	}
+}
+
+// putLocked
+//
+//	@Description: 原样保存服务信息和租约，调用方需要持有写锁
+//	@receiver m
+//	@param serviceInfo 服务信息
+func (m *ServiceMgr) putLocked(serviceInfo *model.ServiceInfo) {
+	eventType := contents.ServiceUpdate
+	info := m.findLocked(serviceInfo)
+	if info == nil {
+		eventType = contents.ServiceAdd
+		info = serviceInfo.Clone()
+		m.ServiceInfoList.Add(info)
+	} else {
+		if info.LeaseId != serviceInfo.LeaseId {
+			delete(m.leases, info.LeaseId)
+		}
+		*info = *serviceInfo.Clone()
+	}
+	normalizeMeta(info)
+	if info.LeaseId != "" {
+		m.leases[info.LeaseId] = &lease{info: info, ttl: info.LeaseTTL, expireAt: time.Now().Add(info.LeaseTTL)}
+	}
+	m.changedLocked(eventType, info)
+}
+
+// normalizeMeta
+//
+//	@Description: 经过json传输后附加元信息里的状态和断开时间是字符串，还原成原来的类型
+//	@param info
+func normalizeMeta(info *model.ServiceInfo) {
+	info.AdditionalMeta[contents.Status.String()] = info.GetStatus()
+	if lostTime, ok := info.AdditionalMeta[contents.LostTime.String()].(string); ok {
+		if t, err := time.Parse(time.RFC3339Nano, lostTime); err == nil {
+			info.AdditionalMeta[contents.LostTime.String()] = t
+		} else {
+			delete(info.AdditionalMeta, contents.LostTime.String())
+		}
+	}
+}
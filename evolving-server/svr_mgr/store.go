@@ -0,0 +1,285 @@
+package svr_mgr
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/yuhao-jack/evolving-rpc/contents"
+	"github.com/yuhao-jack/evolving-rpc/model"
+	"github.com/yuhao-jack/go-toolx/fun"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	snapshotFile = "snapshot.json" // 快照文件，内容是所有服务信息和配置
+	walFile      = "wal.log"       // 变更日志，每行一个服务变化事件或者配置的新版本
+)
+
+// snapshotData
+// @Description: 快照文件的内容
+type snapshotData struct {
+	Services []*model.ServiceInfo       `json:"services"`
+	Configs  map[string][]*model.Config `json:"configs"` // 按配置的唯一标识保存的历史版本
+}
+
+// walRecord
+// @Description: 变更日志的一行，是服务变化事件或者配置的新版本
+type walRecord struct {
+	Type        contents.ServiceEventType `json:"type,omitempty"`
+	ServiceInfo *model.ServiceInfo        `json:"service_info,omitempty"`
+	Config      *model.Config             `json:"config,omitempty"`
+}
+
+// EnablePersistence
+//
+//	@Description: 开启持久化，先从目录下的快照和变更日志恢复注册信息和配置，之后的变化都追加到变更日志，并定期生成快照
+//	@receiver m
+//	@param dataDir 持久化的目录
+//	@param snapshotInterval 生成快照的间隔，为0时为5分钟
+//	@param grace 恢复的租约的有效期，服务需要在这段时间内重新续约，为0时使用租约本身的有效期
+//	@return error 恢复失败时的错误信息
+func (m *ServiceMgr) EnablePersistence(dataDir string, snapshotInterval, grace time.Duration) error {
+	m.lock.Lock()
+	defer m.unlock()
+	if m.wal != nil {
+		return errors.New("persistence is already enabled")
+	}
+	if err := os.MkdirAll(dataDir, 0755); err != nil {
+		return err
+	}
+	data, err := loadSnapshot(filepath.Join(dataDir, snapshotFile))
+	if err != nil {
+		return err
+	}
+	records, err := loadWal(filepath.Join(dataDir, walFile))
+	if err != nil {
+		return err
+	}
+	data = replay(data, records)
+	now := time.Now()
+	for _, info := range data.Services {
+		//  注册中心重启期间连接都断开了，不再按断开时间清理，等租约过期
+		if info.AdditionalMeta == nil {
+			info.AdditionalMeta = make(map[string]any)
+		}
+		delete(info.AdditionalMeta, contents.LostTime.String())
+		normalizeMeta(info)
+		info.LeaseTTL = fun.IfOr(info.LeaseTTL > 0, info.LeaseTTL, m.leaseTTLLocked())
+		if info.LeaseId == "" {
+			info.LeaseId = newLeaseId()
+		}
+		m.leases[info.LeaseId] = &lease{info: info, ttl: info.LeaseTTL, expireAt: now.Add(fun.IfOr(grace > 0, grace, info.LeaseTTL))}
+		m.ServiceInfoList.Add(info)
+	}
+	for key, history := range data.Configs {
+		if _, ok := m.configs[key]; !ok {
+			m.configs[key] = history
+		}
+	}
+	contents.RpcLogger.Info("restored %d services and %d configs from %s.", len(m.leases), len(data.Configs), dataDir)
+	m.wal, err = os.OpenFile(filepath.Join(dataDir, walFile), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	m.dataDir = dataDir
+	//  恢复后马上生成一次快照，变更日志从头开始
+	if err = m.snapshotLocked(); err != nil {
+		return err
+	}
+	go func() {
+		ticker := time.NewTicker(fun.IfOr(snapshotInterval > 0, snapshotInterval, 5*time.Minute))
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-m.closeChan:
+				return
+			}
+			m.lock.Lock()
+			if m.wal != nil {
+				if err := m.snapshotLocked(); err != nil {
+					contents.RpcLogger.Error("snapshot failed,err:%v", err)
+				}
+			}
+			m.lock.Unlock()
+		}
+	}()
+	return nil
+}
+
+// appendLocked
+//
+//	@Description: 把服务的变化追加到变更日志，调用方需要持有写锁
+//	@receiver m
+//	@param eventType 事件类型
+//	@param info 变化后的服务信息
+func (m *ServiceMgr) appendLocked(eventType contents.ServiceEventType, info *model.ServiceInfo) {
+	m.appendRecordLocked(&walRecord{Type: eventType, ServiceInfo: info})
+}
+
+// appendConfigLocked
+//
+//	@Description: 把配置的新版本追加到变更日志，调用方需要持有写锁
+//	@receiver m
+//	@param config 新版本的配置
+func (m *ServiceMgr) appendConfigLocked(config *model.Config) {
+	m.appendRecordLocked(&walRecord{Config: config})
+}
+
+// appendRecordLocked
+//
+//	@Description: 追加一行变更日志并刷盘，调用方需要持有写锁
+//	@receiver m
+//	@param record
+func (m *ServiceMgr) appendRecordLocked(record *walRecord) {
+	if m.wal == nil {
+		return
+	}
+	bytes, err := json.Marshal(record)
+	if err == nil {
+		_, err = m.wal.Write(append(bytes, '\n'))
+	}
+	if err == nil {
+		err = m.wal.Sync()
+	}
+	if err != nil {
+		contents.RpcLogger.Error("append wal failed,err:%v", err)
+	}
+}
+
+// snapshotLocked
+//
+//	@Description: 把所有服务信息和配置写入快照并清空变更日志，调用方需要持有写锁
+//	@receiver m
+//	@return error
+func (m *ServiceMgr) snapshotLocked() error {
+	data := snapshotData{Services: make([]*model.ServiceInfo, 0, m.ServiceInfoList.Size()), Configs: m.configs}
+	m.ServiceInfoList.ForEach(func(info *model.ServiceInfo) {
+		data.Services = append(data.Services, info)
+	})
+	bytes, err := json.Marshal(&data)
+	if err != nil {
+		return err
+	}
+	//  先写临时文件再改名，写到一半时崩溃不会损坏原来的快照
+	path := filepath.Join(m.dataDir, snapshotFile)
+	f, err := os.Create(path + ".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(bytes)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if err = os.Rename(path+".tmp", path); err != nil {
+		return err
+	}
+	//  在这之前崩溃时变更日志会在新的快照上重放一遍，结果是一样的
+	return m.wal.Truncate(0)
+}
+
+// loadSnapshot
+//
+//	@Description: 读取快照，兼容只有服务信息列表的旧格式
+//	@param path 快照文件
+//	@return *snapshotData 快照中的服务信息和配置，文件不存在时为空
+//	@return error
+func loadSnapshot(path string) (*snapshotData, error) {
+	data := &snapshotData{Configs: make(map[string][]*model.Config)}
+	bytes, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return data, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if trimmed := strings.TrimSpace(string(bytes)); strings.HasPrefix(trimmed, "[") {
+		return data, json.Unmarshal(bytes, &data.Services)
+	}
+	if err = json.Unmarshal(bytes, data); err != nil {
+		return nil, err
+	}
+	if data.Configs == nil {
+		data.Configs = make(map[string][]*model.Config)
+	}
+	return data, nil
+}
+
+// loadWal
+//
+//	@Description: 读取变更日志，最后一行没有换行符说明写到一半时崩溃了，解析失败时忽略，其它行解析失败说明日志损坏，返回错误
+//	@param path 变更日志文件
+//	@return []*walRecord 快照之后的服务变化事件和配置的新版本，文件不存在时为空
+//	@return error
+func loadWal(path string) ([]*walRecord, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var records []*walRecord
+	reader := bufio.NewReader(f)
+	for line := 1; ; line++ {
+		bytes, err := reader.ReadBytes('\n')
+		if err != nil && !errors.Is(err, io.EOF) {
+			return nil, err
+		}
+		complete := err == nil
+		if len(bytes) == 0 {
+			return records, nil
+		}
+		var record walRecord
+		if err := json.Unmarshal(bytes, &record); err != nil || (record.ServiceInfo == nil && record.Config == nil) {
+			if !complete {
+				contents.RpcLogger.Warn("skip truncated wal record: %s", string(bytes))
+				return records, nil
+			}
+			return nil, fmt.Errorf("broken wal record at line %d of %s: %s", line, path, string(bytes))
+		}
+		records = append(records, &record)
+		if !complete {
+			return records, nil
+		}
+	}
+}
+
+// replay
+//
+//	@Description: 在快照上按顺序重放服务变化事件和配置的新版本，快照里已经有的配置版本不会重复添加
+//	@param data 快照中的服务信息和配置
+//	@param records 变更日志
+//	@return *snapshotData 重放后的服务信息和配置
+func replay(data *snapshotData, records []*walRecord) *snapshotData {
+	for _, record := range records {
+		if record.Config != nil {
+			key := record.Config.Key()
+			data.Configs[key], _ = appendConfig(data.Configs[key], record.Config)
+			continue
+		}
+		var replayed []*model.ServiceInfo
+		for _, info := range data.Services {
+			if !info.SameInstance(record.ServiceInfo) {
+				replayed = append(replayed, info)
+			}
+		}
+		if record.Type != contents.ServiceRemove {
+			replayed = append(replayed, record.ServiceInfo)
+		}
+		data.Services = replayed
+	}
+	return data
+}
@@ -1,68 +1,258 @@
 package svr_mgr
 
 import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
 	"github.com/yuhao-jack/evolving-rpc/contents"
 	"github.com/yuhao-jack/evolving-rpc/model"
 	"github.com/yuhao-jack/go-toolx/containerx"
 	"github.com/yuhao-jack/go-toolx/fun"
 	"github.com/yuhao-jack/go-toolx/netx"
+	"os"
 	"sync"
 	"time"
 )
 
+// lease
+// @Description: 注册中心内部保存的租约
+type lease struct {
+	info     *model.ServiceInfo
+	ttl      time.Duration
+	expireAt time.Time
+}
+
+// delivery
+// @Description: 持有写锁时产生的一条推送，释放写锁后再发送
+type delivery struct {
+	pack    *netx.DataPack
+	sendMsg func(dataPack *netx.DataPack, message netx.IMessage)
+	message netx.IMessage
+}
+
 // ServiceMgr
-// @Description: 服务管理器，管理注册过来的服务
+// @Description: 服务管理器，管理注册过来的服务，每个开启了注册中心的服务端各有一个
 type ServiceMgr struct {
 	ServiceInfoList containerx.ISet[*model.ServiceInfo]
-	DataPackMap     *containerx.ConcurrentMap[string, *netx.DataPack]
 	lock            sync.RWMutex
+	closeChan       chan struct{}
 	keepDuration    time.Duration
+	leaseTTL        time.Duration
+	leases          map[string]*lease
+	revoked         map[string]*lease // 被管理员强制下线的租约，持有者还在续约时一直保留，持有者不再续约一个有效期后清理
+	// 按服务的唯一标识分组的订阅方
+	watchers       map[string]map[*netx.DataPack]func(dataPack *netx.DataPack, message netx.IMessage)
+	dataDir        string                          // 持久化的目录，为空时不持久化
+	wal            *os.File                        // 追加写的变更日志
+	replica        bool                            // 是否是集群中的副本，副本只接收主节点同步过来的变化，不自己清理过期的服务
+	changeListener func(event *model.ServiceEvent) // 服务有变化时的回调，集群的主节点用来同步给副本
+	configs        map[string][]*model.Config      // 按配置的唯一标识保存的历史版本，最后一个是最新版本
+	configListener func(config *model.Config)      // 发布配置时的回调，集群的主节点用来同步给副本
+	// 按配置的唯一标识分组的订阅方
+	configWatchers map[string]map[*netx.DataPack]func(dataPack *netx.DataPack, message netx.IMessage)
+	outbox         []*delivery // 持有写锁时产生的推送，释放写锁后发送，一个订阅方很慢时不会卡住注册中心
+	deliverLock    sync.Mutex  // 发送推送时持有，推送的顺序和变化的顺序一致
 }
 
-var once sync.Once
-var serviceMgrInstance = &ServiceMgr{
-	ServiceInfoList: containerx.NewConcurrentSet[*model.ServiceInfo](),
-	DataPackMap:     containerx.NewConcurrentMap[string, *netx.DataPack](),
-	lock:            sync.RWMutex{},
-}
-
-// GetServiceMgrInstance
+// NewServiceMgr
 //
-//	@Description:  获取一个单例的服务管理器
+//	@Description: 创建一个服务管理器，每秒清理一次过期的服务，不再使用时需要Close
 //	@return *ServiceMgr
-func GetServiceMgrInstance() *ServiceMgr {
-	once.Do(func() {
-		go func() {
-			ticker := time.NewTicker(time.Second)
-			for range ticker.C {
-				serviceMgrInstance.ServiceInfoList.ForEach(func(info *model.ServiceInfo) {
-					lostTime, ok := info.AdditionalMeta[contents.LostTime.String()]
-					if !ok {
-						return
-					}
-					if time.Since(lostTime.(time.Time)) > serviceMgrInstance.GetKeepDuration() {
-						serviceMgrInstance.ServiceInfoList.Remove(info)
-					} else {
-						info.AdditionalMeta[contents.Status.String()] = contents.Down
-					}
-				})
+func NewServiceMgr() *ServiceMgr {
+	m := &ServiceMgr{
+		ServiceInfoList: containerx.NewConcurrentSet[*model.ServiceInfo](),
+		lock:            sync.RWMutex{},
+		closeChan:       make(chan struct{}),
+		leases:          make(map[string]*lease),
+		revoked:         make(map[string]*lease),
+		watchers:        make(map[string]map[*netx.DataPack]func(dataPack *netx.DataPack, message netx.IMessage)),
+		configs:         make(map[string][]*model.Config),
+		configWatchers:  make(map[string]map[*netx.DataPack]func(dataPack *netx.DataPack, message netx.IMessage)),
+	}
+	go func() {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				m.removeExpired()
+			case <-m.closeChan:
+				return
 			}
+		}
+	}()
+	return m
+}
 
-		}()
+// Close
+//
+//	@Description: 停止清理过期服务和生成快照，关闭变更日志，可以重复调用
+//	@receiver m
+func (m *ServiceMgr) Close() {
+	m.lock.Lock()
+	defer m.unlock()
+	select {
+	case <-m.closeChan:
+		return
+	default:
+		close(m.closeChan)
+	}
+	if m.wal != nil {
+		if err := m.wal.Close(); err != nil {
+			contents.RpcLogger.Error("close wal failed,err:%v", err)
+		}
+		m.wal = nil
+	}
+}
+
+// unlock
+//
+//	@Description: 释放写锁并发送持有锁时产生的推送，先拿到deliverLock再释放写锁，后面的变化的推送不会先发出去
+//	@receiver m
+func (m *ServiceMgr) unlock() {
+	outbox := m.outbox
+	m.outbox = nil
+	if len(outbox) == 0 {
+		m.lock.Unlock()
+		return
+	}
+	m.deliverLock.Lock()
+	m.lock.Unlock()
+	defer m.deliverLock.Unlock()
+	for _, d := range outbox {
+		d.sendMsg(d.pack, d.message)
+	}
+}
+
+// removeExpired
+//
+//	@Description: 移除租约过期的服务，以及断开连接超过保存时间的服务
+//	@receiver m
+func (m *ServiceMgr) removeExpired() {
+	m.lock.Lock()
+	defer m.unlock()
+	if m.replica {
+		return
+	}
+	now := time.Now()
+	for leaseId, l := range m.revoked {
+		if now.After(l.expireAt) {
+			delete(m.revoked, leaseId)
+		}
+	}
+	var expired []*model.ServiceInfo
+	for leaseId, l := range m.leases {
+		if now.After(l.expireAt) {
+			contents.RpcLogger.Warn("lease %s of %s expired.", leaseId, l.info.ServiceName)
+			expired = append(expired, l.info)
+		}
+	}
+	keepDuration := m.keepDurationLocked()
+	m.ServiceInfoList.ForEach(func(info *model.ServiceInfo) {
+		lostTime, ok := info.AdditionalMeta[contents.LostTime.String()].(time.Time)
+		if ok && now.Sub(lostTime) > keepDuration {
+			expired = append(expired, info)
+		}
+	})
+	for _, info := range expired {
+		m.removeLocked(info)
+	}
+}
+
+// removeLocked
+//
+//	@Description: 移除服务及其租约，调用方需要持有写锁
+//	@receiver m
+//	@param info
+func (m *ServiceMgr) removeLocked(info *model.ServiceInfo) {
+	if info.LeaseId != "" {
+		delete(m.leases, info.LeaseId)
+	}
+	m.ServiceInfoList.Remove(info)
+	m.changedLocked(contents.ServiceRemove, info)
+}
+
+// findLocked
+//
+//	@Description: 查找同一个服务实例，调用方需要持有锁
+//	@receiver m
+//	@param serviceInfo
+//	@return found
+func (m *ServiceMgr) findLocked(serviceInfo *model.ServiceInfo) (found *model.ServiceInfo) {
+	m.ServiceInfoList.ForEach(func(info *model.ServiceInfo) {
+		if info.SameInstance(serviceInfo) {
+			found = info
+		}
 	})
-	return serviceMgrInstance
+	return found
 }
 
 // FindServiceInfosByServiceName
 //
-//	@Description: 通过服务的名字获取所有可用的服务的信息
+//	@Description: 通过服务的名字获取默认命名空间下所有可用的服务的信息
 //	@receiver m
 //	@param serviceName 服务名
-//	@return serviceList 所有可用的服务的信息
+//	@return serviceList 所有可用的服务的信息，是注册信息的副本
 func (m *ServiceMgr) FindServiceInfosByServiceName(serviceName string) (serviceList []*model.ServiceInfo) {
+	return m.FindServiceInfos("", "", serviceName)
+}
+
+// FindServiceInfos
+//
+//	@Description: 获取指定命名空间和环境下的服务的信息
+//	@receiver m
+//	@param namespace 命名空间，为空时为default
+//	@param env 环境
+//	@param serviceName 服务名
+//	@return serviceList 服务信息的副本
+func (m *ServiceMgr) FindServiceInfos(namespace, env, serviceName string) (serviceList []*model.ServiceInfo) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	return m.findByKeyLocked(model.ServiceKey(namespace, env, serviceName))
+}
+
+// findByKeyLocked
+//
+//	@Description: 获取同一个服务的所有实例，调用方需要持有锁
+//	@receiver m
+//	@param key 服务的唯一标识
+//	@return serviceList 服务信息的副本
+func (m *ServiceMgr) findByKeyLocked(key string) (serviceList []*model.ServiceInfo) {
 	m.ServiceInfoList.ForEach(func(info *model.ServiceInfo) {
-		if info.ServiceName == serviceName {
-			serviceList = append(serviceList, info)
+		if info.Key() == key {
+			serviceList = append(serviceList, info.Clone())
+		}
+	})
+	return serviceList
+}
+
+// ServiceInfos
+//
+//	@Description: 获取所有的服务信息
+//	@receiver m
+//	@return serviceList 所有服务信息的副本
+func (m *ServiceMgr) ServiceInfos() (serviceList []*model.ServiceInfo) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	m.ServiceInfoList.ForEach(func(info *model.ServiceInfo) {
+		serviceList = append(serviceList, info.Clone())
+	})
+	return serviceList
+}
+
+// ServiceInfosInScope
+//
+//	@Description: 获取指定命名空间和环境下所有的服务信息
+//	@receiver m
+//	@param namespace 命名空间，为空时为default
+//	@param env 环境
+//	@return serviceList 服务信息的副本
+func (m *ServiceMgr) ServiceInfosInScope(namespace, env string) (serviceList []*model.ServiceInfo) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	m.ServiceInfoList.ForEach(func(info *model.ServiceInfo) {
+		if info.InScope(namespace, env) {
+			serviceList = append(serviceList, info.Clone())
 		}
 	})
 	return serviceList
@@ -75,7 +265,7 @@ func (m *ServiceMgr) FindServiceInfosByServiceName(serviceName string) (serviceL
 //	@param duration　时间
 func (m *ServiceMgr) SetKeepDuration(duration time.Duration) {
 	m.lock.Lock()
-	defer m.lock.Unlock()
+	defer m.unlock()
 	m.keepDuration = duration
 }
 
@@ -87,7 +277,37 @@ func (m *ServiceMgr) SetKeepDuration(duration time.Duration) {
 func (m *ServiceMgr) GetKeepDuration() time.Duration {
 	m.lock.RLock()
 	defer m.lock.RUnlock()
-	return fun.IfOr(serviceMgrInstance.keepDuration == 0, time.Second*30, serviceMgrInstance.keepDuration)
+	return m.keepDurationLocked()
+}
+
+func (m *ServiceMgr) keepDurationLocked() time.Duration {
+	return fun.IfOr(m.keepDuration == 0, time.Second*30, m.keepDuration)
+}
+
+// SetLeaseTTL
+//
+//	@Description: 设置默认的租约有效期，服务注册时没有指定有效期时使用
+//	@receiver m
+//	@param ttl
+func (m *ServiceMgr) SetLeaseTTL(ttl time.Duration) {
+	m.lock.Lock()
+	defer m.unlock()
+	m.leaseTTL = ttl
+}
+
+// GetLeaseTTL
+//
+//	@Description: 获取默认的租约有效期
+//	@receiver m
+//	@return time.Duration
+func (m *ServiceMgr) GetLeaseTTL() time.Duration {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	return m.leaseTTLLocked()
+}
+
+func (m *ServiceMgr) leaseTTLLocked() time.Duration {
+	return fun.IfOr(m.leaseTTL == 0, time.Second*30, m.leaseTTL)
 }
 
 // AddServiceInfo
@@ -97,35 +317,296 @@ func (m *ServiceMgr) GetKeepDuration() time.Duration {
 //	@param serviceInfo 服务信息
 func (m *ServiceMgr) AddServiceInfo(serviceInfo *model.ServiceInfo) {
 	m.lock.Lock()
-	defer m.lock.Unlock()
+	defer m.unlock()
+	if serviceInfo.AdditionalMeta == nil {
+		serviceInfo.AdditionalMeta = make(map[string]any)
+	}
+	serviceInfo.Namespace = serviceInfo.GetNamespace()
 	serviceInfo.AdditionalMeta[contents.Status.String()] = contents.Up
 	m.ServiceInfoList.Add(serviceInfo)
+	m.changedLocked(contents.ServiceAdd, serviceInfo)
 }
 
-// AddDataPack
+// RegisterServiceInfo
 //
-//	@Description: 添加一个连接包
+//	@Description: 注册服务并发放租约，同一个服务实例重复注册时更新服务信息并续约原来的租约，
+//	服务信息里的状态为DRAINING时保留，被管理员停用的服务保持DISABLED，其它情况都认为服务已经上线
 //	@receiver m
-//	@param pack 连接包
-func (m *ServiceMgr) AddDataPack(pack *netx.DataPack) {
-	m.DataPackMap.Set(pack.RemoteAddr().String(), pack)
+//	@param serviceInfo 服务信息
+//	@return *model.Lease 租约，需要在有效期内通过KeepAlive续约
+func (m *ServiceMgr) RegisterServiceInfo(serviceInfo *model.ServiceInfo) *model.Lease {
+	m.lock.Lock()
+	defer m.unlock()
+	info := m.findLocked(serviceInfo)
+	eventType := contents.ServiceUpdate
+	status := fun.IfOr(serviceInfo.GetStatus() == contents.Draining, contents.Draining, contents.Up)
+	if info == nil {
+		eventType = contents.ServiceAdd
+		info = serviceInfo.Clone()
+		info.Namespace = info.GetNamespace()
+		info.LeaseId = ""
+		m.ServiceInfoList.Add(info)
+	} else {
+		if info.GetStatus() == contents.Disabled {
+			status = contents.Disabled
+		}
+		info.AdditionalMeta = serviceInfo.Clone().AdditionalMeta
+		info.ServiceProtoc = serviceInfo.ServiceProtoc
+	}
+	info.AdditionalMeta[contents.Status.String()] = status
+	delete(info.AdditionalMeta, contents.LostTime.String())
+	info.LeaseTTL = fun.IfOr(serviceInfo.LeaseTTL > 0, serviceInfo.LeaseTTL, m.leaseTTLLocked())
+	if _, ok := m.leases[info.LeaseId]; !ok {
+		info.LeaseId = newLeaseId()
+	}
+	m.leases[info.LeaseId] = &lease{info: info, ttl: info.LeaseTTL, expireAt: time.Now().Add(info.LeaseTTL)}
+	m.changedLocked(eventType, info)
+	return &model.Lease{LeaseId: info.LeaseId, TTL: info.LeaseTTL}
 }
 
-// DelDataPack
+// KeepAlive
 //
-//	@Description: 删除一个连接包
+//	@Description: 续约
 //	@receiver m
-//	@param pack
-func (m *ServiceMgr) DelDataPack(pack *netx.DataPack) {
-	m.DataPackMap.Remove(pack.RemoteAddr().String())
+//	@param leaseIds 需要续约的租约
+//	@return unknown 不存在或者已经过期的租约，持有者需要重新注册，被强制下线的租约不在其中
+func (m *ServiceMgr) KeepAlive(leaseIds ...string) (unknown []string) {
+	m.lock.Lock()
+	defer m.unlock()
+	now := time.Now()
+	for _, leaseId := range leaseIds {
+		l, ok := m.leases[leaseId]
+		if !ok {
+			if r, revoked := m.revoked[leaseId]; revoked {
+				r.expireAt = now.Add(r.ttl)
+				continue
+			}
+			unknown = append(unknown, leaseId)
+			continue
+		}
+		l.expireAt = now.Add(l.ttl)
+	}
+	return unknown
 }
 
-// PushConfig
+// RevokedLeases
 //
-//	@Description: 主动推送配置给客户
-//	@author yuhao<154826195@qq.com>
-//	@Data 2023-06-27 20:41:13
+//	@Description: 找出被管理员强制下线的租约，持有者收到后不再续约，也不会重新注册
 //	@receiver m
-func (m *ServiceMgr) PushConfig() {
+//	@param leaseIds 租约ID列表
+//	@return revoked 其中被强制下线的租约ID
+func (m *ServiceMgr) RevokedLeases(leaseIds ...string) (revoked []string) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	for _, leaseId := range leaseIds {
+		if _, ok := m.revoked[leaseId]; ok {
+			revoked = append(revoked, leaseId)
+		}
+	}
+	return revoked
+}
 
+// RevokeServiceInfo
+//
+//	@Description: 管理员强制下线服务，和DeregisterServiceInfo不同的是会记下服务的租约，
+//	持有者续约时不会被当作过期的租约，不会自动重新注册
+//	@receiver m
+//	@param serviceInfo 服务信息
+//	@return bool 服务是否存在
+func (m *ServiceMgr) RevokeServiceInfo(serviceInfo *model.ServiceInfo) bool {
+	m.lock.Lock()
+	defer m.unlock()
+	info := m.findLocked(serviceInfo)
+	if info == nil {
+		return false
+	}
+	if l, ok := m.leases[info.LeaseId]; ok {
+		m.revoked[info.LeaseId] = &lease{ttl: l.ttl, expireAt: time.Now().Add(l.ttl)}
+	}
+	m.removeLocked(info)
+	return true
+}
+
+// DeregisterServiceInfo
+//
+//	@Description: 服务主动下线，立即移除服务信息和租约
+//	@receiver m
+//	@param serviceInfo 服务信息
+//	@return bool 服务是否存在
+func (m *ServiceMgr) DeregisterServiceInfo(serviceInfo *model.ServiceInfo) bool {
+	m.lock.Lock()
+	defer m.unlock()
+	info := m.findLocked(serviceInfo)
+	if info == nil {
+		return false
+	}
+	m.removeLocked(info)
+	return true
+}
+
+// MarkServiceDown
+//
+//	@Description: 服务的连接断开时标记为下线，超过保存时间后移除
+//	@receiver m
+//	@param serviceInfo
+func (m *ServiceMgr) MarkServiceDown(serviceInfo *model.ServiceInfo) {
+	m.lock.Lock()
+	defer m.unlock()
+	info := m.findLocked(serviceInfo)
+	if info == nil {
+		return
+	}
+	//  停用的服务断开后仍然保持停用，只记录断开时间
+	if info.GetStatus() != contents.Disabled {
+		info.AdditionalMeta[contents.Status.String()] = contents.Down
+	}
+	info.AdditionalMeta[contents.LostTime.String()] = time.Now()
+	m.changedLocked(contents.ServiceUpdate, info)
+}
+
+// GetServiceInfo
+//
+//	@Description: 获取一个服务实例的信息
+//	@receiver m
+//	@param serviceInfo 服务实例，按命名空间、环境、服务名、地址和端口查找
+//	@return *model.ServiceInfo 服务信息的副本，不存在时为nil
+func (m *ServiceMgr) GetServiceInfo(serviceInfo *model.ServiceInfo) *model.ServiceInfo {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	if info := m.findLocked(serviceInfo); info != nil {
+		return info.Clone()
+	}
+	return nil
+}
+
+// SetServiceStatus
+//
+//	@Description: 管理员修改服务实例的状态，订阅方会收到变化
+//	@receiver m
+//	@param serviceInfo 服务实例
+//	@param status 新的状态
+//	@return *model.ServiceInfo 修改后的服务信息的副本，不存在时为nil
+func (m *ServiceMgr) SetServiceStatus(serviceInfo *model.ServiceInfo, status contents.ServiceStatus) *model.ServiceInfo {
+	m.lock.Lock()
+	defer m.unlock()
+	info := m.findLocked(serviceInfo)
+	if info == nil {
+		return nil
+	}
+	info.AdditionalMeta[contents.Status.String()] = status
+	m.changedLocked(contents.ServiceUpdate, info)
+	return info.Clone()
+}
+
+// UpdateServiceMeta
+//
+//	@Description: 管理员修改服务实例的附加元信息，值为nil的标签会被删除，订阅方会收到变化
+//	@receiver m
+//	@param serviceInfo 服务实例
+//	@param meta 要修改的标签
+//	@return *model.ServiceInfo 修改后的服务信息的副本，不存在时为nil
+func (m *ServiceMgr) UpdateServiceMeta(serviceInfo *model.ServiceInfo, meta map[string]any) *model.ServiceInfo {
+	m.lock.Lock()
+	defer m.unlock()
+	info := m.findLocked(serviceInfo)
+	if info == nil {
+		return nil
+	}
+	for k, v := range meta {
+		if v == nil {
+			delete(info.AdditionalMeta, k)
+		} else {
+			info.AdditionalMeta[k] = v
+		}
+	}
+	m.changedLocked(contents.ServiceUpdate, info)
+	return info.Clone()
+}
+
+// Watch
+//
+//	@Description: 订阅服务的变化，之后服务的新增、更新、移除都会通过WATCH命令推送给订阅方
+//	@receiver m
+//	@param namespace 命名空间，为空时为default
+//	@param env 环境
+//	@param serviceName 服务名
+//	@param pack 订阅方的连接包
+//	@param sendMsg 推送消息的方法
+//	@param snapshot 拿到订阅时服务的信息后的回调，在推送任何事件之前执行
+func (m *ServiceMgr) Watch(namespace, env, serviceName string, pack *netx.DataPack, sendMsg func(dataPack *netx.DataPack, message netx.IMessage), snapshot func(serviceList []*model.ServiceInfo)) {
+	m.lock.Lock()
+	defer m.unlock()
+	key := model.ServiceKey(namespace, env, serviceName)
+	if m.watchers[key] == nil {
+		m.watchers[key] = make(map[*netx.DataPack]func(dataPack *netx.DataPack, message netx.IMessage))
+	}
+	m.watchers[key][pack] = sendMsg
+	snapshot(m.findByKeyLocked(key))
+}
+
+// Unwatch
+//
+//	@Description: 取消连接上所有服务和配置的订阅
+//	@receiver m
+//	@param pack 订阅方的连接包
+func (m *ServiceMgr) Unwatch(pack *netx.DataPack) {
+	m.lock.Lock()
+	defer m.unlock()
+	for key, watchers := range m.watchers {
+		delete(watchers, pack)
+		if len(watchers) == 0 {
+			delete(m.watchers, key)
+		}
+	}
+	for key, watchers := range m.configWatchers {
+		delete(watchers, pack)
+		if len(watchers) == 0 {
+			delete(m.configWatchers, key)
+		}
+	}
+}
+
+// changedLocked
+//
+//	@Description: 服务有变化后写日志并推送给订阅方，调用方需要持有写锁
+//	@receiver m
+//	@param eventType 事件类型
+//	@param info 变化后的服务信息
+func (m *ServiceMgr) changedLocked(eventType contents.ServiceEventType, info *model.ServiceInfo) {
+	m.appendLocked(eventType, info)
+	m.notifyLocked(eventType, info)
+	if m.changeListener != nil {
+		m.changeListener(&model.ServiceEvent{Type: eventType, ServiceInfo: info})
+	}
+}
+
+// notifyLocked
+//
+//	@Description: 把服务的变化放入待推送的消息，调用方需要持有写锁，释放写锁时推送给订阅方
+//	@receiver m
+//	@param eventType 事件类型
+//	@param info 变化后的服务信息
+func (m *ServiceMgr) notifyLocked(eventType contents.ServiceEventType, info *model.ServiceInfo) {
+	watchers := m.watchers[info.Key()]
+	if len(watchers) == 0 {
+		return
+	}
+	bytes, err := json.Marshal(&model.ServiceEvent{Type: eventType, ServiceInfo: info})
+	if err != nil {
+		contents.RpcLogger.Error(err.Error())
+		return
+	}
+	for pack, sendMsg := range watchers {
+		m.outbox = append(m.outbox, &delivery{pack: pack, sendMsg: sendMsg, message: netx.NewDefaultMessage([]byte(contents.Watch), bytes)})
+	}
+}
+
+// newLeaseId
+//
+//	@Description: 生成一个随机的租约ID
+//	@return string
+func newLeaseId() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
 }
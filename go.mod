@@ -2,6 +2,9 @@ module github.com/yuhao-jack/evolving-rpc
 
 go 1.19
 
-require github.com/yuhao-jack/go-toolx v0.0.5
+require (
+	github.com/yuhao-jack/go-toolx v0.0.5
+	google.golang.org/protobuf v1.33.0
+)
 
 require github.com/yuhao-jack/go-log v0.0.0-20230302074839-a12ab059ec29 // indirect
@@ -0,0 +1,42 @@
+package model
+
+import "time"
+
+// ClusterConf
+// @Description: 注册中心集群的配置
+type ClusterConf struct {
+	NodeAddr         string        `json:"node_addr"`         //本节点供其它节点连接的地址 host:port，同时作为节点ID
+	Peers            []string      `json:"peers"`             //其它节点的地址，得到包括本节点在内的多数节点的投票才能成为主节点
+	ElectionInterval time.Duration `json:"election_interval"` //主节点心跳的间隔，为0时为300ms，副本3到6个间隔没有收到心跳时发起选举
+}
+
+// ClusterMessage
+// @Description: 集群节点之间同步的消息
+type ClusterMessage struct {
+	Term        uint64               `json:"term"`                   //主节点的任期，副本拒绝任期比自己小的消息，心跳的回复里是副本的任期
+	Leader      string               `json:"leader"`                 //主节点的地址
+	Index       uint64               `json:"index"`                  //主节点产生的变化序号，副本按序号顺序应用
+	Event       *ServiceEvent        `json:"event,omitempty"`        //服务变化，和Config都为空时是主节点的心跳
+	Config      *Config              `json:"config,omitempty"`       //发布的配置的新版本
+	ServiceList []*ServiceInfo       `json:"service_list,omitempty"` //副本拉取时主节点的所有服务信息
+	Configs     map[string][]*Config `json:"configs,omitempty"`      //副本拉取时主节点的所有配置的历史版本
+}
+
+// IsHeartbeat
+//
+//	@Description: 是否是主节点的心跳，心跳不带变化
+//	@receiver m
+//	@return bool
+func (m *ClusterMessage) IsHeartbeat() bool {
+	return m.Event == nil && m.Config == nil
+}
+
+// ClusterVote
+// @Description: 集群选主时的投票请求和回复
+type ClusterVote struct {
+	Term      uint64 `json:"term"`      //候选节点的任期，回复里是投票节点的任期
+	Candidate string `json:"candidate"` //候选节点的地址
+	DataTerm  uint64 `json:"data_term"` //候选节点的服务信息来自哪个任期的主节点
+	Applied   uint64 `json:"applied"`   //候选节点已经应用的变化序号，服务信息比投票节点旧时不投票
+	Granted   bool   `json:"granted"`   //是否投票
+}
@@ -0,0 +1,52 @@
+package model
+
+import (
+	"fmt"
+	"github.com/yuhao-jack/evolving-rpc/contents"
+	"github.com/yuhao-jack/go-toolx/fun"
+	"time"
+)
+
+// Config
+// @Description: 配置中心里一个服务的一个版本的配置
+type Config struct {
+	Namespace   string            `json:"namespace,omitempty"`   //命名空间，为空时为default
+	ServiceName string            `json:"service_name"`          //服务名
+	Version     uint64            `json:"version,omitempty"`     //版本号，从1开始，每次发布或者回滚加1
+	Data        map[string]string `json:"data"`                  //配置内容
+	RollbackOf  uint64            `json:"rollback_of,omitempty"` //回滚产生的版本对应的原来的版本
+	UpdateTime  time.Time         `json:"update_time"`           //发布时间
+}
+
+// Key
+//
+//	@Description: 配置的唯一标识，同一个命名空间下同名服务的配置是同一份配置
+//	@receiver c
+//	@return string
+func (c *Config) Key() string {
+	return ConfigKey(c.Namespace, c.ServiceName)
+}
+
+// Clone
+//
+//	@Description: 复制一份配置，配置内容也会复制
+//	@receiver c
+//	@return *Config
+func (c *Config) Clone() *Config {
+	config := *c
+	config.Data = make(map[string]string, len(c.Data))
+	for k, v := range c.Data {
+		config.Data[k] = v
+	}
+	return &config
+}
+
+// ConfigKey
+//
+//	@Description: 配置的唯一标识
+//	@param namespace 命名空间，为空时为default
+//	@param serviceName 服务名
+//	@return string namespace/serviceName
+func ConfigKey(namespace, serviceName string) string {
+	return fmt.Sprintf("%s/%s", fun.IfOr(namespace == "", contents.DefaultNamespace, namespace), serviceName)
+}
@@ -1,6 +1,11 @@
 package model
 
+import "time"
+
 type EvolvingServerConf struct {
-	BindHost   string `json:"bind_host"`
-	ServerPort int32  `json:"server_port"`
+	BindHost            string        `json:"bind_host"`
+	ServerPort          int32         `json:"server_port"`
+	HeartbeatInterval   time.Duration `json:"heartbeat_interval"`    //客户端的心跳间隔，为0时不检测心跳，需要不小于客户端配置的心跳间隔
+	MaxMissedHeartbeats int           `json:"max_missed_heartbeats"` //连续多少次没有收到心跳后断开连接，为0时为3
+	ConfigToken         string        `json:"config_token"`          //开启注册中心时发布和回滚配置需要的令牌，为空时不校验，这时注册中心的端口只能开放给可信的调用方
 }
@@ -5,7 +5,13 @@ import "time"
 // EvolvingClientConfig
 // @Description:
 type EvolvingClientConfig struct {
-	EvolvingServerHost string        `json:"evolving_server_host"`
-	EvolvingServerPort int32         `json:"evolving_server_port"`
-	HeartbeatInterval  time.Duration `json:"heartbeat_interval"`
+	EvolvingServerHost   string        `json:"evolving_server_host"`
+	EvolvingServerPort   int32         `json:"evolving_server_port"`
+	HeartbeatInterval    time.Duration `json:"heartbeat_interval"`
+	ReconnectInterval    time.Duration `json:"reconnect_interval"`     //断线后首次重连的等待时间，之后每次翻倍，为0时为500ms
+	MaxReconnectInterval time.Duration `json:"max_reconnect_interval"` //重连等待时间的上限，为0时为30s
+	Namespace            string        `json:"namespace"`              //通过注册中心发现和订阅服务时的命名空间，为空时为default
+	Env                  string        `json:"env"`                    //通过注册中心发现和订阅服务时的环境
+	CallTimeout          time.Duration `json:"call_timeout"`           //ExecuteCommand同步调用的超时时间，为0时为10s
+	ConfigToken          string        `json:"config_token"`           //发布和回滚配置时带上的令牌，和注册中心配置的一致
 }
@@ -0,0 +1,10 @@
+package model
+
+import "time"
+
+// Lease
+// @Description: 注册中心发给服务的租约，服务需要在TTL内续约，否则注册信息会被移除
+type Lease struct {
+	LeaseId string        `json:"lease_id"` //租约ID
+	TTL     time.Duration `json:"ttl"`      //租约有效期
+}
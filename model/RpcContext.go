@@ -0,0 +1,51 @@
+package model
+
+import "context"
+
+type rpcContextKey int
+
+const (
+	outgoingMetaKey rpcContextKey = iota
+	incomingMetaKey
+	peerAddrKey
+)
+
+// WithOutgoingMeta
+//
+//	@Description: 给调用附加元信息，调用时随请求一起发给服务端
+//	@param ctx
+//	@param meta 元信息
+//	@return context.Context
+func WithOutgoingMeta(ctx context.Context, meta map[string]string) context.Context {
+	return context.WithValue(ctx, outgoingMetaKey, meta)
+}
+
+// OutgoingMeta
+//
+//	@Description: 获取调用附加的元信息
+//	@param ctx
+//	@return map[string]string
+func OutgoingMeta(ctx context.Context) map[string]string {
+	meta, _ := ctx.Value(outgoingMetaKey).(map[string]string)
+	return meta
+}
+
+// IncomingMeta
+//
+//	@Description: 服务端获取调用方发来的元信息
+//	@param ctx 服务方法的ctx
+//	@return map[string]string
+func IncomingMeta(ctx context.Context) map[string]string {
+	meta, _ := ctx.Value(incomingMetaKey).(map[string]string)
+	return meta
+}
+
+// PeerAddr
+//
+//	@Description: 服务端获取调用方的地址
+//	@param ctx 服务方法的ctx
+//	@return string 调用方的地址 eg:127.0.0.1:52110
+func PeerAddr(ctx context.Context) string {
+	addr, _ := ctx.Value(peerAddrKey).(string)
+	return addr
+}
@@ -0,0 +1,178 @@
+package model
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"github.com/yuhao-jack/evolving-rpc/errorx"
+	"github.com/yuhao-jack/go-toolx/netx"
+	"time"
+)
+
+// envelopeMagic 带信封的消息体的开头，json和protobuf编码的消息体不会以0开头，没有这个开头的是不带信封的原始消息体
+var envelopeMagic = []byte{0x00, 'E'}
+
+// RpcHeader
+// @Description: 网络上传输的消息头，放在真正的消息体前面，
+// 格式是 envelopeMagic + 4字节大端的消息头长度 + json编码的消息头 + 原样的消息体
+type RpcHeader struct {
+	Seq     uint64              `json:"seq,omitempty"`     //调用序号，服务端原样带回
+	Timeout time.Duration       `json:"timeout,omitempty"` //调用方剩余的等待时间，为0时不限时
+	Protoc  string              `json:"protoc,omitempty"`  //消息体的编码协议 eg:json pb
+	Meta    map[string]string   `json:"meta,omitempty"`    //调用附加的元信息
+	Status  *errorx.StatusError `json:"status,omitempty"`  //调用失败时的状态，成功时为空
+}
+
+// empty
+//
+//	@Description: 消息头是否什么都没有带，这样的消息不加信封，和不认识信封的旧版本兼容
+//	@receiver h
+//	@return bool
+func (h *RpcHeader) empty() bool {
+	return h.Seq == 0 && h.Timeout == 0 && h.Protoc == "" && len(h.Meta) == 0 && h.Status == nil
+}
+
+// RpcMessage
+// @Description: 携带调用序号的消息
+type RpcMessage struct {
+	netx.IMessage
+	Seq      uint64
+	Timeout  time.Duration
+	Deadline time.Time //收到消息时根据Timeout算出的截止时间，只在本地使用
+	Protoc   string
+	Meta     map[string]string
+	Status   *errorx.StatusError
+}
+
+// NewRpcMessage
+//
+//	@Description: 给消息附加调用序号
+//	@param message 原始消息
+//	@param seq 调用序号
+//	@return *RpcMessage
+func NewRpcMessage(message netx.IMessage, seq uint64) *RpcMessage {
+	if m, ok := message.(*RpcMessage); ok {
+		m.Seq = seq
+		return m
+	}
+	return &RpcMessage{IMessage: message, Seq: seq}
+}
+
+// UnPackRpcMessage
+//
+//	@Description: 拆开从网络上收到的消息的信封，消息体替换为信封里真正的消息体，不带信封的消息原样保留消息体
+//	@param message 从网络上收到的消息
+//	@return *RpcMessage 拆开信封后的消息
+//	@return error 信封格式错误时的错误信息
+func UnPackRpcMessage(message netx.IMessage) (*RpcMessage, error) {
+	body := message.GetBody()
+	if !bytes.HasPrefix(body, envelopeMagic) {
+		return &RpcMessage{IMessage: message}, nil
+	}
+	body = body[len(envelopeMagic):]
+	if len(body) < 4 || uint64(binary.BigEndian.Uint32(body)) > uint64(len(body)-4) {
+		return &RpcMessage{IMessage: message}, fmt.Errorf("broken rpc header of command %s", string(message.GetCommand()))
+	}
+	size := binary.BigEndian.Uint32(body)
+	var header RpcHeader
+	if err := json.Unmarshal(body[4:4+size], &header); err != nil {
+		return &RpcMessage{IMessage: message}, err
+	}
+	message.SetBody(body[4+size:])
+	rpcMessage := &RpcMessage{IMessage: message, Seq: header.Seq, Protoc: header.Protoc, Meta: header.Meta, Status: header.Status}
+	if header.Timeout > 0 {
+		rpcMessage.Deadline = time.Now().Add(header.Timeout)
+	}
+	return rpcMessage, nil
+}
+
+// PackRpcMessage
+//
+//	@Description: 给消息套上信封并发送到网络上，消息体原样跟在消息头后面，不会再编码一次
+//	@param dataPack 连接包
+//	@param message 需要发送的消息
+//	@return error 发送失败时的错误信息
+func PackRpcMessage(dataPack *netx.DataPack, message netx.IMessage) error {
+	var header RpcHeader
+	if m, ok := message.(*RpcMessage); ok {
+		header = RpcHeader{Seq: m.Seq, Timeout: m.Timeout, Protoc: m.Protoc, Meta: m.Meta, Status: m.Status}
+	}
+	body := message.GetBody()
+	if header.empty() && !bytes.HasPrefix(body, envelopeMagic) {
+		return dataPack.Pack(message.GetCommand(), body)
+	}
+	headerBytes, err := json.Marshal(&header)
+	if err != nil {
+		return err
+	}
+	packed := make([]byte, 0, len(envelopeMagic)+4+len(headerBytes)+len(body))
+	packed = append(packed, envelopeMagic...)
+	packed = binary.BigEndian.AppendUint32(packed, uint32(len(headerBytes)))
+	packed = append(packed, headerBytes...)
+	packed = append(packed, body...)
+	return dataPack.Pack(message.GetCommand(), packed)
+}
+
+// SetStatus
+//
+//	@Description: 把错误作为调用状态设置到回复消息上，同时清空消息体
+//	@param message 回复消息
+//	@param err 错误，非StatusError的错误视为服务端内部错误
+//	@return *RpcMessage 设置了状态的消息
+func SetStatus(message netx.IMessage, err error) *RpcMessage {
+	m, ok := message.(*RpcMessage)
+	if !ok {
+		m = &RpcMessage{IMessage: message}
+	}
+	m.Status = errorx.FromError(err)
+	m.SetBody(nil)
+	return m
+}
+
+// StatusOf
+//
+//	@Description: 获取回复消息上的调用状态
+//	@param message 回复消息
+//	@return error 调用失败时为*errorx.StatusError，成功时为nil
+func StatusOf(message netx.IMessage) error {
+	if m, ok := message.(*RpcMessage); ok && m.Status != nil {
+		return m.Status
+	}
+	return nil
+}
+
+// ContextOf
+//
+//	@Description: 创建处理消息用的context，带有调用方的地址、元信息和截止时间，调用方已经放弃的调用可以通过它提前结束
+//	@param dataPack 收到消息的连接包
+//	@param message 收到的消息
+//	@return context.Context
+//	@return context.CancelFunc
+func ContextOf(dataPack *netx.DataPack, message netx.IMessage) (context.Context, context.CancelFunc) {
+	ctx := context.WithValue(context.Background(), peerAddrKey, dataPack.RemoteAddr().String())
+	m, ok := message.(*RpcMessage)
+	if !ok {
+		return context.WithCancel(ctx)
+	}
+	if m.Meta != nil {
+		ctx = context.WithValue(ctx, incomingMetaKey, m.Meta)
+	}
+	if !m.Deadline.IsZero() {
+		return context.WithDeadline(ctx, m.Deadline)
+	}
+	return context.WithCancel(ctx)
+}
+
+// ProtocOf
+//
+//	@Description: 获取消息体的编码协议，信封里没有指定时使用消息自带的协议
+//	@param message
+//	@return string
+func ProtocOf(message netx.IMessage) string {
+	if m, ok := message.(*RpcMessage); ok && m.Protoc != "" {
+		return m.Protoc
+	}
+	return string(message.GetProtoc())
+}
@@ -0,0 +1,221 @@
+package model
+
+import (
+	"fmt"
+	"github.com/yuhao-jack/evolving-rpc/contents"
+	"regexp"
+	"strings"
+)
+
+type SelectorOperator string
+
+func (k SelectorOperator) String() string { return string(k) }
+
+const (
+	SelectorEquals       SelectorOperator = "="
+	SelectorNotEquals    SelectorOperator = "!="
+	SelectorIn           SelectorOperator = "in"
+	SelectorNotIn        SelectorOperator = "notin"
+	SelectorExists       SelectorOperator = "exists"
+	SelectorDoesNotExist SelectorOperator = "!"
+)
+
+var (
+	selectorKeyRegexp    = regexp.MustCompile(`^[A-Za-z0-9_.\-/]+$`)
+	selectorSetRegexp    = regexp.MustCompile(`^(\S+)\s+(in|notin)\s*\((.*)\)$`)
+	selectorEqualsRegexp = regexp.MustCompile(`^([^=!\s]+)\s*(!=|==|=)\s*(.*)$`)
+)
+
+// Requirement
+// @Description: 选择器中的一个条件
+type Requirement struct {
+	Key      string
+	Operator SelectorOperator
+	Values   []string
+}
+
+// Selector
+// @Description: 服务选择器，按附加元信息里的标签和服务状态筛选服务，所有条件都满足才算匹配
+type Selector []Requirement
+
+// ParseSelector
+//
+//	@Description: 解析选择器，条件之间用逗号分隔 eg:version=2, zone in (a,b), status=UP
+//	支持 key=value key==value key!=value key in (a,b) key notin (a,b) key !key
+//	@param selector 选择器，为空时匹配所有服务
+//	@return Selector
+//	@return error 格式错误时的错误信息
+func ParseSelector(selector string) (Selector, error) {
+	var s Selector
+	for _, part := range splitSelector(selector) {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		r, err := parseRequirement(part)
+		if err != nil {
+			return nil, err
+		}
+		s = append(s, r)
+	}
+	return s, nil
+}
+
+// splitSelector
+//
+//	@Description: 按括号外的逗号拆分条件
+//	@param selector
+//	@return []string
+func splitSelector(selector string) []string {
+	var parts []string
+	depth, start := 0, 0
+	for i, c := range selector {
+		switch c {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case ',':
+			if depth == 0 {
+				parts = append(parts, selector[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(parts, selector[start:])
+}
+
+// parseRequirement
+//
+//	@Description: 解析一个条件
+//	@param part
+//	@return Requirement
+//	@return error
+func parseRequirement(part string) (Requirement, error) {
+	if m := selectorSetRegexp.FindStringSubmatch(part); m != nil {
+		var values []string
+		for _, v := range strings.Split(m[3], ",") {
+			if v = strings.TrimSpace(v); v != "" {
+				values = append(values, v)
+			}
+		}
+		if len(values) == 0 {
+			return Requirement{}, fmt.Errorf("selector %q has no values", part)
+		}
+		return newRequirement(m[1], SelectorOperator(m[2]), values, part)
+	}
+	if m := selectorEqualsRegexp.FindStringSubmatch(part); m != nil {
+		op := SelectorEquals
+		if m[2] == "!=" {
+			op = SelectorNotEquals
+		}
+		return newRequirement(m[1], op, []string{strings.TrimSpace(m[3])}, part)
+	}
+	if strings.HasPrefix(part, "!") {
+		return newRequirement(strings.TrimSpace(part[1:]), SelectorDoesNotExist, nil, part)
+	}
+	return newRequirement(part, SelectorExists, nil, part)
+}
+
+// newRequirement
+//
+//	@Description: 创建条件并检查标签名
+//	@param key 标签名
+//	@param op 操作符
+//	@param values 值
+//	@param part 原始的条件，用于错误信息
+//	@return Requirement
+//	@return error
+func newRequirement(key string, op SelectorOperator, values []string, part string) (Requirement, error) {
+	if !selectorKeyRegexp.MatchString(key) {
+		return Requirement{}, fmt.Errorf("selector %q has invalid key %q", part, key)
+	}
+	for _, v := range values {
+		if strings.ContainsAny(v, "(),") {
+			return Requirement{}, fmt.Errorf("selector %q has invalid value %q", part, v)
+		}
+	}
+	return Requirement{Key: key, Operator: op, Values: values}, nil
+}
+
+// Matches
+//
+//	@Description: 服务是否满足所有条件
+//	@receiver s
+//	@param info 服务信息
+//	@return bool
+func (s Selector) Matches(info *ServiceInfo) bool {
+	for _, r := range s {
+		if !r.Matches(info) {
+			return false
+		}
+	}
+	return true
+}
+
+// Filter
+//
+//	@Description: 筛选出满足所有条件的服务
+//	@receiver s
+//	@param serviceList 服务信息
+//	@return []*ServiceInfo
+func (s Selector) Filter(serviceList []*ServiceInfo) []*ServiceInfo {
+	if len(s) == 0 {
+		return serviceList
+	}
+	var selected []*ServiceInfo
+	for _, info := range serviceList {
+		if s.Matches(info) {
+			selected = append(selected, info)
+		}
+	}
+	return selected
+}
+
+// Matches
+//
+//	@Description: 服务是否满足条件，status标签没有设置时视为UP
+//	@receiver r
+//	@param info 服务信息
+//	@return bool
+func (r Requirement) Matches(info *ServiceInfo) bool {
+	value, ok := labelOf(info, r.Key)
+	switch r.Operator {
+	case SelectorExists:
+		return ok
+	case SelectorDoesNotExist:
+		return !ok
+	case SelectorEquals, SelectorIn:
+		return ok && containsValue(r.Values, value)
+	case SelectorNotEquals, SelectorNotIn:
+		return !ok || !containsValue(r.Values, value)
+	}
+	return false
+}
+
+// labelOf
+//
+//	@Description: 获取服务的标签值
+//	@param info 服务信息
+//	@param key 标签名
+//	@return string 标签值
+//	@return bool 是否有这个标签
+func labelOf(info *ServiceInfo, key string) (string, bool) {
+	if key == contents.Status.String() {
+		return info.GetStatus().String(), true
+	}
+	value, ok := info.AdditionalMeta[key]
+	if !ok {
+		return "", false
+	}
+	return fmt.Sprint(value), true
+}
+
+func containsValue(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,10 @@
+package model
+
+import "github.com/yuhao-jack/evolving-rpc/contents"
+
+// ServiceEvent
+// @Description: 注册中心推送给订阅方的服务变化事件
+type ServiceEvent struct {
+	Type        contents.ServiceEventType `json:"type"`         //事件类型
+	ServiceInfo *ServiceInfo              `json:"service_info"` //变化后的服务信息
+}
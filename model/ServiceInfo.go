@@ -1,11 +1,113 @@
 package model
 
-import "github.com/yuhao-jack/evolving-rpc/contents"
+import (
+	"fmt"
+	"github.com/yuhao-jack/evolving-rpc/contents"
+	"github.com/yuhao-jack/go-toolx/fun"
+	"time"
+)
 
 type ServiceInfo struct {
-	ServiceName    string                 `json:"service_name"`    //服务名
-	ServiceHost    string                 `json:"service_host"`    //服务地址
-	ServicePort    int32                  `json:"service_port"`    //服务端口
-	ServiceProtoc  contents.ServiceProtoc `json:"service_protoc"`  //服务协议
-	AdditionalMeta map[string]any         `json:"additional_meta"` //服务附加元信息
+	Namespace      string                 `json:"namespace,omitempty"` //命名空间，为空时为default
+	Env            string                 `json:"env,omitempty"`       //环境 eg:dev staging prod
+	ServiceName    string                 `json:"service_name"`        //服务名
+	ServiceHost    string                 `json:"service_host"`        //服务地址
+	ServicePort    int32                  `json:"service_port"`        //服务端口
+	ServiceProtoc  contents.ServiceProtoc `json:"service_protoc"`      //服务协议
+	AdditionalMeta map[string]any         `json:"additional_meta"`     //服务附加元信息
+	LeaseId        string                 `json:"lease_id,omitempty"`  //注册中心分配的租约ID
+	LeaseTTL       time.Duration          `json:"lease_ttl,omitempty"` //希望的租约有效期，为0时使用注册中心的默认值
+}
+
+// Clone
+//
+//	@Description: 复制一份服务信息，附加元信息也会复制
+//	@receiver s
+//	@return *ServiceInfo
+func (s *ServiceInfo) Clone() *ServiceInfo {
+	info := *s
+	info.AdditionalMeta = make(map[string]any, len(s.AdditionalMeta))
+	for k, v := range s.AdditionalMeta {
+		info.AdditionalMeta[k] = v
+	}
+	return &info
+}
+
+// SameInstance
+//
+//	@Description: 是否是同一个服务实例
+//	@receiver s
+//	@param o
+//	@return bool
+func (s *ServiceInfo) SameInstance(o *ServiceInfo) bool {
+	return s.Key() == o.Key() && s.ServiceHost == o.ServiceHost && s.ServicePort == o.ServicePort
+}
+
+// GetNamespace
+//
+//	@Description: 获取服务的命名空间
+//	@receiver s
+//	@return string 没有指定时为default
+func (s *ServiceInfo) GetNamespace() string {
+	return fun.IfOr(s.Namespace == "", contents.DefaultNamespace, s.Namespace)
+}
+
+// Key
+//
+//	@Description: 服务的唯一标识，同一个命名空间和环境下的同名服务是同一个服务
+//	@receiver s
+//	@return string
+func (s *ServiceInfo) Key() string {
+	return ServiceKey(s.Namespace, s.Env, s.ServiceName)
+}
+
+// InScope
+//
+//	@Description: 服务是否在指定的命名空间和环境下
+//	@receiver s
+//	@param namespace 命名空间，为空时为default
+//	@param env 环境
+//	@return bool
+func (s *ServiceInfo) InScope(namespace, env string) bool {
+	return s.GetNamespace() == fun.IfOr(namespace == "", contents.DefaultNamespace, namespace) && s.Env == env
+}
+
+// ServiceKey
+//
+//	@Description: 服务的唯一标识
+//	@param namespace 命名空间，为空时为default
+//	@param env 环境
+//	@param serviceName 服务名
+//	@return string namespace/env/serviceName
+func ServiceKey(namespace, env, serviceName string) string {
+	return fmt.Sprintf("%s/%s/%s", fun.IfOr(namespace == "", contents.DefaultNamespace, namespace), env, serviceName)
+}
+
+// GetStatus
+//
+//	@Description: 获取服务的状态，经过json传输后附加元信息里的状态是字符串
+//	@receiver s
+//	@return contents.ServiceStatus
+func (s *ServiceInfo) GetStatus() contents.ServiceStatus {
+	status, ok := s.AdditionalMeta[contents.Status.String()]
+	if !ok {
+		return contents.Up
+	}
+	return contents.ServiceStatus(fmt.Sprint(status))
+}
+
+// Addr
+//
+//	@Description: 服务的地址
+//	@receiver s
+//	@return string host:port
+func (s *ServiceInfo) Addr() string {
+	return fmt.Sprintf("%s:%d", s.ServiceHost, s.ServicePort)
+}
+
+// ClientInfo
+// @Description: 连接到服务端的客户端
+type ClientInfo struct {
+	Addr        string    `json:"addr"`         //客户端地址
+	ConnectedAt time.Time `json:"connected_at"` //连接的时间
 }
@@ -1,15 +1,19 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
 	evolvingserver "github.com/yuhao-jack/evolving-rpc/evolving-server"
-	"github.com/yuhao-jack/evolving-rpc/evolving-server/svr_mgr"
+	"github.com/yuhao-jack/evolving-rpc/evolving-server/admin"
+	"github.com/yuhao-jack/evolving-rpc/evolving-server/cluster"
 	"github.com/yuhao-jack/evolving-rpc/model"
 	go_log "github.com/yuhao-jack/go-log"
 	"github.com/yuhao-jack/go-toolx/fun"
 	"net/http"
 	"os"
+	"strings"
+	"time"
 )
 
 var logger = go_log.DefaultGoLog()
@@ -26,33 +30,104 @@ func main() {
 		logger.Error("GetLocalIp err:%v", err)
 		os.Exit(1)
 	}
+	localIp := ip
 	ip = ""
 	flag.StringVar(&serverConf.BindHost, "rdh", ip, "注册发现服务的host")
 	flag.IntVar(&rdport, "rdp", 6601, "注册发现服务的端口")
-	serverConf.ServerPort = int32(rdport)
-	flag.StringVar(&host, "h", ip, "工具服务host")
+	flag.DurationVar(&serverConf.HeartbeatInterval, "hb", 0, "客户端的心跳间隔，为0时不检测死连接")
+	flag.IntVar(&serverConf.MaxMissedHeartbeats, "mhb", 3, "连续多少次没有收到心跳后断开连接")
+	flag.StringVar(&serverConf.ConfigToken, "ctoken", "", "发布和回滚配置需要的令牌，为空时任何连上注册中心的调用方都能修改配置")
+	var (
+		dataDir, nodeAddr, peers          string
+		leaseTTL, snapshotInterval, grace time.Duration
+	)
+	flag.DurationVar(&leaseTTL, "ttl", 30*time.Second, "服务注册时没有指定租约有效期时使用的默认值")
+	flag.StringVar(&dataDir, "data", "", "注册信息持久化的目录，为空时不持久化")
+	flag.DurationVar(&snapshotInterval, "snap", 5*time.Minute, "生成快照的间隔")
+	flag.DurationVar(&grace, "grace", 30*time.Second, "重启后恢复的服务需要在这段时间内重新续约")
+	flag.StringVar(&nodeAddr, "node", "", "集群中本节点供其它节点连接的地址，为空时为本机ip:注册发现服务的端口")
+	flag.StringVar(&peers, "peers", "", "集群中其它节点的地址，用逗号分隔，为空时单机运行")
+	var adminToken string
+	//  管理接口能强制下线和修改服务实例，默认只监听本机
+	flag.StringVar(&host, "h", "127.0.0.1", "工具服务host，对外开放时需要同时指定-atoken")
 	flag.IntVar(&port, "p", 8080, "工具服务端口")
+	flag.StringVar(&adminToken, "atoken", "", "管理接口修改服务实例需要的令牌，请求头带上Authorization: Bearer <令牌>，为空时不校验")
 	flag.Parse()
+	serverConf.ServerPort = int32(rdport)
+	evolvingServer := evolvingserver.NewEvolvingServer(&serverConf)
+	serviceMgr := evolvingServer.EnableRegistry()
+	serviceMgr.SetLeaseTTL(leaseTTL)
+	if dataDir != "" {
+		if err = serviceMgr.EnablePersistence(dataDir, snapshotInterval, grace); err != nil {
+			logger.Error("restore register center state from %s failed,err:%v", dataDir, err)
+			os.Exit(1)
+		}
+	}
 	logger.Info("register and discover center addr:%s:%d", serverConf.BindHost, serverConf.ServerPort)
 	logger.Info("tools service addr:%s:%d", host, port)
 
-	evolvingServer := evolvingserver.NewEvolvingServer(&serverConf)
-	go evolvingServer.Start()
 	handleMgr := HandleMgr{EvolvingServer: evolvingServer}
+	adminHandler := admin.NewAdminHandler(evolvingServer)
+	adminHandler.SetToken(adminToken)
+	if peers != "" {
+		handleMgr.Node = cluster.NewClusterNode(evolvingServer, &model.ClusterConf{
+			//  其它节点可能在别的机器上，不能让它们连回环地址
+			NodeAddr: fun.IfOr(nodeAddr != "", nodeAddr, fmt.Sprintf("%s:%d", localIp, rdport)),
+			Peers:    strings.Split(peers, ","),
+		})
+		adminHandler.SetCluster(handleMgr.Node)
+		handleMgr.Node.Start()
+		defer handleMgr.Node.Close()
+	}
+	go evolvingServer.Start()
 	http.HandleFunc("/serviceInfoList", handleMgr.ServiceInfoList)
-	http.ListenAndServe(fmt.Sprintf("%s:%d", host, port), nil)
+	http.HandleFunc("/cluster", handleMgr.Cluster)
+	http.Handle("/api/", adminHandler)
+	if err = http.ListenAndServe(fmt.Sprintf("%s:%d", host, port), nil); err != nil {
+		logger.Error("start tools service failed,err:%v", err)
+	}
 }
 
 type HandleMgr struct {
 	EvolvingServer *evolvingserver.EvolvingServer
+	Node           *cluster.Node // 单机运行时为nil
 }
 
+// ServiceInfoList
+//
+//	@Description: 查看命名空间和环境下的服务，通过namespace和env参数指定，namespace为空时为default，
+//	更多的查询和管理操作见/api/下的管理接口
+//	@receiver h
+//	@param w
+//	@param r
 func (h *HandleMgr) ServiceInfoList(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	serviceInfos := h.EvolvingServer.GetServiceMgr().ServiceInfosInScope(query.Get("namespace"), query.Get("env"))
+	bytes, err := json.Marshal(fun.IfOr(serviceInfos != nil, serviceInfos, make([]*model.ServiceInfo, 0)))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(bytes)
+}
 
-	if svr_mgr.GetServiceMgrInstance().ServiceInfoList.Size() > 0 {
-		w.Write([]byte(fun.StrVal(map[string]any{"msg": "success", "data": svr_mgr.GetServiceMgrInstance().ServiceInfoList.Elements(), "code": 0})))
-
-	} else {
-		w.Write([]byte(fun.StrVal(map[string]any{"msg": "no data", "code": 10001})))
+// Cluster
+//
+//	@Description: 查看本节点在集群中的状态，包括当前任期和认为的主节点，单机运行时返回404
+//	@receiver h
+//	@param w
+//	@param r
+func (h *HandleMgr) Cluster(w http.ResponseWriter, r *http.Request) {
+	if h.Node == nil {
+		http.NotFound(w, r)
+		return
+	}
+	bytes, err := json.Marshal(map[string]any{"term": h.Node.Term(), "leader": h.Node.Leader(), "is_leader": h.Node.IsLeader()})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(bytes)
 }
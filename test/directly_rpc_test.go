@@ -1,11 +1,19 @@
 package test
 
 import (
+	"bytes"
+	"context"
+	"encoding/gob"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"github.com/yuhao-jack/evolving-rpc/contents"
+	"github.com/yuhao-jack/evolving-rpc/errorx"
 	evolving_client "github.com/yuhao-jack/evolving-rpc/evolving-client"
 	evolving_server "github.com/yuhao-jack/evolving-rpc/evolving-server"
 	"github.com/yuhao-jack/evolving-rpc/model"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/wrapperspb"
 	"log"
 	"math/rand"
 	"sync"
@@ -48,6 +56,39 @@ func (a *Arith) Divide(req *ArithReq) (reply ArithReply) {
 	return
 }
 
+func (a *Arith) Sleep(d time.Duration) (done bool) {
+	time.Sleep(d)
+	return true
+}
+
+func (a *Arith) Mod(ctx context.Context, req *ArithReq) (reply ArithReply, err error) {
+	if req.B == 0 {
+		return reply, errorx.New(errorx.BadRequest, "divide by zero")
+	}
+	reply.Rem = req.A % req.B
+	return reply, nil
+}
+
+func (a *Arith) Whoami(ctx context.Context, name string) (reply map[string]string) {
+	reply = map[string]string{"name": name, "peer": model.PeerAddr(ctx)}
+	for k, v := range model.IncomingMeta(ctx) {
+		reply[k] = v
+	}
+	return reply
+}
+
+func (a *Arith) ResetOffset(offset int64) error {
+	if offset < 0 {
+		return errors.New("negative offset")
+	}
+	atomic.StoreInt64(&off, offset)
+	return nil
+}
+
+func (a *Arith) Square(req *wrapperspb.Int64Value) (reply *wrapperspb.Int64Value) {
+	return wrapperspb.Int64(req.GetValue() * req.GetValue())
+}
+
 type EchoReq struct {
 	Key       []byte
 	Val       []byte
@@ -118,6 +159,340 @@ func TestDirectlyRpc(t *testing.T) {
 	client.Close()
 }
 
+func TestDirectlyRpcConcurrent(t *testing.T) {
+	beforeTestDirectlyRpc()
+	config := evolving_client.DirectlyRpcClientConfig{EvolvingClientConfig: model.EvolvingClientConfig{
+		EvolvingServerHost: "0.0.0.0",
+		EvolvingServerPort: 3302,
+		HeartbeatInterval:  5 * time.Minute,
+	}}
+	client := evolving_client.NewDirectlyRpcClient(&config)
+	defer client.Close()
+
+	wg := sync.WaitGroup{}
+	for i := 1; i <= 200; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			bytes, _ := json.Marshal(&ArithReq{A: i * 7, B: i})
+			res, err := client.ExecuteCommand("Arith.Divide", bytes, true)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			var reply ArithReply
+			if err = json.Unmarshal(res, &reply); err != nil {
+				t.Error(err)
+				return
+			}
+			if reply.Quo != 7 || reply.Rem != 0 {
+				t.Errorf("call %d got reply of another call: %+v", i, reply)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestDirectlyRpcStatusError(t *testing.T) {
+	beforeTestDirectlyRpc()
+	config := evolving_client.DirectlyRpcClientConfig{EvolvingClientConfig: model.EvolvingClientConfig{
+		EvolvingServerHost: "0.0.0.0",
+		EvolvingServerPort: 3302,
+		HeartbeatInterval:  5 * time.Minute,
+	}}
+	client := evolving_client.NewDirectlyRpcClient(&config)
+	defer client.Close()
+
+	_, err := client.ExecuteCommand("Arith.Power", []byte("{}"), true)
+	if errorx.CodeOf(err) != errorx.UnknownCommand {
+		t.Errorf("unknown command got %v", err)
+	}
+	_, err = client.ExecuteCommand("Arith.Multiply", []byte("not json"), true)
+	var statusErr *errorx.StatusError
+	if !errors.As(err, &statusErr) || statusErr.Code != errorx.BadRequest {
+		t.Errorf("bad request got %v", err)
+	}
+}
+
+func TestDirectlyRpcCall(t *testing.T) {
+	beforeTestDirectlyRpc()
+	config := evolving_client.DirectlyRpcClientConfig{EvolvingClientConfig: model.EvolvingClientConfig{
+		EvolvingServerHost: "0.0.0.0",
+		EvolvingServerPort: 3302,
+		HeartbeatInterval:  5 * time.Minute,
+		CallTimeout:        100 * time.Millisecond,
+	}}
+	client := evolving_client.NewDirectlyRpcClient(&config)
+	defer client.Close()
+
+	var reply ArithReply
+	if err := client.Call(context.Background(), "Arith.Multiply", &ArithReq{A: 6, B: 7}, &reply); err != nil || reply.Pro != 42 {
+		t.Errorf("call got %+v,%v", reply, err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	var done bool
+	err := client.Call(ctx, "Arith.Sleep", 2*time.Second, &done)
+	if errorx.CodeOf(err) != errorx.DeadlineExceeded {
+		t.Errorf("slow call got %v,%v", done, err)
+	}
+	if time.Since(start) > time.Second {
+		t.Errorf("slow call returned after %v", time.Since(start))
+	}
+
+	//  不带context的同步调用按配置的CallTimeout超时
+	start = time.Now()
+	bytes, _ := json.Marshal(2 * time.Second)
+	if _, err = client.ExecuteCommand("Arith.Sleep", bytes, true); errorx.CodeOf(err) != errorx.DeadlineExceeded {
+		t.Errorf("slow command got %v", err)
+	}
+	if time.Since(start) > time.Second {
+		t.Errorf("slow command returned after %v", time.Since(start))
+	}
+}
+
+func TestDirectlyRpcPanicRecover(t *testing.T) {
+	beforeTestDirectlyRpc()
+	config := evolving_client.DirectlyRpcClientConfig{EvolvingClientConfig: model.EvolvingClientConfig{
+		EvolvingServerHost: "0.0.0.0",
+		EvolvingServerPort: 3302,
+		HeartbeatInterval:  5 * time.Minute,
+	}}
+	client := evolving_client.NewDirectlyRpcClient(&config)
+	defer client.Close()
+
+	var reply ArithReply
+	err := client.Call(context.Background(), "Arith.Divide", &ArithReq{A: 1, B: 0}, &reply)
+	if errorx.CodeOf(err) != errorx.Internal {
+		t.Errorf("divide by zero got %v", err)
+	}
+	//  同一连接上的后续调用不受影响
+	if err = client.Call(context.Background(), "Arith.Divide", &ArithReq{A: 9, B: 2}, &reply); err != nil || reply.Quo != 4 || reply.Rem != 1 {
+		t.Errorf("call after panic got %+v,%v", reply, err)
+	}
+}
+
+func TestDirectlyRpcHandlerSignatures(t *testing.T) {
+	beforeTestDirectlyRpc()
+	config := evolving_client.DirectlyRpcClientConfig{EvolvingClientConfig: model.EvolvingClientConfig{
+		EvolvingServerHost: "0.0.0.0",
+		EvolvingServerPort: 3302,
+		HeartbeatInterval:  5 * time.Minute,
+	}}
+	client := evolving_client.NewDirectlyRpcClient(&config)
+	defer client.Close()
+
+	var reply ArithReply
+	if err := client.Call(context.Background(), "Arith.Mod", &ArithReq{A: 9, B: 4}, &reply); err != nil || reply.Rem != 1 {
+		t.Errorf("Mod got %+v,%v", reply, err)
+	}
+	if err := client.Call(context.Background(), "Arith.Mod", &ArithReq{A: 9}, &reply); errorx.CodeOf(err) != errorx.BadRequest {
+		t.Errorf("Mod by zero got %v", err)
+	}
+
+	var who map[string]string
+	ctx := model.WithOutgoingMeta(context.Background(), map[string]string{"trace_id": "t-1"})
+	if err := client.Call(ctx, "Arith.Whoami", "yuhao", &who); err != nil || who["name"] != "yuhao" || who["trace_id"] != "t-1" || who["peer"] == "" {
+		t.Errorf("Whoami got %v,%v", who, err)
+	}
+
+	if err := client.Call(context.Background(), "Arith.ResetOffset", int64(0), nil); err != nil {
+		t.Errorf("ResetOffset got %v", err)
+	}
+	if err := client.Call(context.Background(), "Arith.ResetOffset", int64(-1), nil); errorx.CodeOf(err) != errorx.Internal {
+		t.Errorf("negative ResetOffset got %v", err)
+	}
+}
+
+func TestDirectlyRpcInterceptor(t *testing.T) {
+	server := evolving_server.NewDirectlyRpcServer(&evolving_server.DirectlyRpcServerConfig{EvolvingServerConf: model.EvolvingServerConf{
+		BindHost:   "0.0.0.0",
+		ServerPort: 3303,
+	}})
+	if err := server.Register(new(Arith)); err != nil {
+		t.Fatal(err)
+	}
+	var commands []string
+	lock := sync.Mutex{}
+	server.Use(func(ctx context.Context, command string, req any, handler evolving_server.RpcHandler) (any, error) {
+		lock.Lock()
+		commands = append(commands, command)
+		lock.Unlock()
+		if model.IncomingMeta(ctx)["token"] != "secret" {
+			return nil, errorx.New(errorx.BadRequest, "no token")
+		}
+		switch model.IncomingMeta(ctx)["panic"] {
+		case "interceptor":
+			panic("interceptor panic")
+		case "req":
+			//  换成非指针的入参，调用服务方法前取值时panic
+			return handler(ctx, ArithReq{})
+		}
+		return handler(ctx, req)
+	})
+	go server.Run()
+	time.Sleep(time.Second)
+
+	client := evolving_client.NewDirectlyRpcClient(&evolving_client.DirectlyRpcClientConfig{EvolvingClientConfig: model.EvolvingClientConfig{
+		EvolvingServerHost: "0.0.0.0",
+		EvolvingServerPort: 3303,
+		HeartbeatInterval:  5 * time.Minute,
+	}})
+	defer client.Close()
+
+	var reply ArithReply
+	if err := client.Call(context.Background(), "Arith.Multiply", &ArithReq{A: 2, B: 3}, &reply); errorx.CodeOf(err) != errorx.BadRequest {
+		t.Errorf("call without token got %v", err)
+	}
+	ctx := model.WithOutgoingMeta(context.Background(), map[string]string{"token": "secret"})
+	if err := client.Call(ctx, "Arith.Multiply", &ArithReq{A: 2, B: 3}, &reply); err != nil || reply.Pro != 6 {
+		t.Errorf("call with token got %+v,%v", reply, err)
+	}
+	if len(commands) != 2 || commands[1] != "Arith.Multiply" {
+		t.Errorf("interceptor saw %v", commands)
+	}
+
+	//  拦截器panic时回复内部错误，连接继续可用
+	for _, where := range []string{"interceptor", "req"} {
+		panicCtx := model.WithOutgoingMeta(context.Background(), map[string]string{"token": "secret", "panic": where})
+		if err := client.Call(panicCtx, "Arith.Multiply", &ArithReq{A: 2, B: 3}, &reply); errorx.CodeOf(err) != errorx.Internal {
+			t.Errorf("%s panic got %v", where, err)
+		}
+	}
+	//  注册的编解码方法panic时同样回复内部错误
+	server.SetProtocUnmarshalHandler("panic", func(in []byte, recv any) error { panic("unmarshal panic") })
+	client.SetProtocMarshalHandler("panic", json.Marshal)
+	if err := client.Call(ctx, "Arith.Multiply", &ArithReq{A: 2, B: 3}, &reply, evolving_client.WithProtoc("panic")); errorx.CodeOf(err) != errorx.Internal {
+		t.Errorf("codec panic got %v", err)
+	}
+	reply = ArithReply{}
+	if err := client.Call(ctx, "Arith.Multiply", &ArithReq{A: 3, B: 4}, &reply); err != nil || reply.Pro != 12 {
+		t.Errorf("call after interceptor panic got %+v,%v", reply, err)
+	}
+}
+
+func TestDirectlyRpcPb(t *testing.T) {
+	beforeTestDirectlyRpc()
+	config := evolving_client.DirectlyRpcClientConfig{EvolvingClientConfig: model.EvolvingClientConfig{
+		EvolvingServerHost: "0.0.0.0",
+		EvolvingServerPort: 3302,
+		HeartbeatInterval:  5 * time.Minute,
+	}}
+	client := evolving_client.NewDirectlyRpcClient(&config)
+	defer client.Close()
+
+	reply := &wrapperspb.Int64Value{}
+	if err := client.Call(context.Background(), "Arith.Square", wrapperspb.Int64(12), reply, evolving_client.WithProtoc(contents.Pb)); err != nil || reply.GetValue() != 144 {
+		t.Errorf("pb call got %v,%v", reply, err)
+	}
+	//  非proto.Message的入参无法使用protobuf编码
+	if err := client.Call(context.Background(), "Arith.Multiply", &ArithReq{A: 1, B: 2}, nil, evolving_client.WithProtoc(contents.Pb)); errorx.CodeOf(err) != errorx.BadRequest {
+		t.Errorf("pb call with plain struct got %v", err)
+	}
+}
+
+func TestDirectlyRpcProtocNegotiation(t *testing.T) {
+	beforeTestDirectlyRpc()
+	config := evolving_client.DirectlyRpcClientConfig{EvolvingClientConfig: model.EvolvingClientConfig{
+		EvolvingServerHost: "0.0.0.0",
+		EvolvingServerPort: 3302,
+		HeartbeatInterval:  5 * time.Minute,
+	}, DefaultProtoc: contents.Pb}
+	client := evolving_client.NewDirectlyRpcClient(&config)
+	defer client.Close()
+
+	reply := &wrapperspb.Int64Value{}
+	if err := client.Call(context.Background(), "Arith.Square", wrapperspb.Int64(3), reply); err != nil || reply.GetValue() != 9 {
+		t.Errorf("default pb call got %v,%v", reply, err)
+	}
+	//  异步执行的命令也按客户端默认的编码协议标记消息体
+	req, _ := proto.Marshal(wrapperspb.Int64(4))
+	replyChan := make(chan []byte, 1)
+	client.ExecuteCmd("Arith.Square", req, func(res []byte) { replyChan <- res })
+	select {
+	case res := <-replyChan:
+		if err := proto.Unmarshal(res, reply); err != nil || reply.GetValue() != 16 {
+			t.Errorf("default pb command got %v,%v", reply, err)
+		}
+	case <-time.After(time.Second):
+		t.Error("default pb command timeout")
+	}
+
+	client.SetProtocMarshalHandler("gob", func(recv any) ([]byte, error) {
+		buf := bytes.Buffer{}
+		err := gob.NewEncoder(&buf).Encode(recv)
+		return buf.Bytes(), err
+	})
+	err := client.Call(context.Background(), "Arith.Multiply", &ArithReq{A: 1, B: 2}, nil, evolving_client.WithProtoc("gob"))
+	var statusErr *errorx.StatusError
+	if !errors.As(err, &statusErr) || statusErr.Code != errorx.UnsupportedProtoc || statusErr.Details["supported"] != "json,pb" {
+		t.Errorf("unsupported protoc got %v", err)
+	}
+}
+
+func TestDirectlyRpcReconnect(t *testing.T) {
+	serverConfig := evolving_server.DirectlyRpcServerConfig{EvolvingServerConf: model.EvolvingServerConf{
+		BindHost:   "0.0.0.0",
+		ServerPort: 3304,
+	}}
+	server := evolving_server.NewDirectlyRpcServer(&serverConfig)
+	_ = server.Register(new(Arith))
+	go server.Run()
+	time.Sleep(time.Second)
+
+	client := evolving_client.NewDirectlyRpcClient(&evolving_client.DirectlyRpcClientConfig{EvolvingClientConfig: model.EvolvingClientConfig{
+		EvolvingServerHost: "0.0.0.0",
+		EvolvingServerPort: 3304,
+		HeartbeatInterval:  5 * time.Minute,
+		ReconnectInterval:  100 * time.Millisecond,
+	}})
+	defer client.Close()
+	states := make(chan contents.ConnState, 8)
+	client.SetStateCallBack(func(state contents.ConnState) {
+		states <- state
+	})
+
+	//  服务端关闭后，正在等待回复的调用立即失败
+	errChan := make(chan error, 1)
+	go func() {
+		var done bool
+		errChan <- client.Call(context.Background(), "Arith.Sleep", 5*time.Second, &done)
+	}()
+	time.Sleep(200 * time.Millisecond)
+	server.Close()
+	select {
+	case err := <-errChan:
+		if errorx.CodeOf(err) != errorx.Unavailable {
+			t.Errorf("in-flight call got %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("in-flight call did not fail fast")
+	}
+	if state := <-states; state != contents.Disconnected {
+		t.Errorf("state got %s", state)
+	}
+
+	//  服务端重启后自动重连
+	server = evolving_server.NewDirectlyRpcServer(&serverConfig)
+	_ = server.Register(new(Arith))
+	go server.Run()
+	defer server.Close()
+	select {
+	case state := <-states:
+		if state != contents.Connected {
+			t.Errorf("state got %s", state)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("client did not reconnect")
+	}
+	var reply ArithReply
+	if err := client.Call(context.Background(), "Arith.Multiply", &ArithReq{A: 3, B: 3}, &reply); err != nil || reply.Pro != 9 {
+		t.Errorf("call after reconnect got %+v,%v", reply, err)
+	}
+}
+
 func TestSendMsg(t *testing.T) {
 	beforeTestDirectlyRpc()
 	config := evolving_client.DirectlyRpcClientConfig{EvolvingClientConfig: model.EvolvingClientConfig{
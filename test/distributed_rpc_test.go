@@ -1,14 +1,29 @@
 package test
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/yuhao-jack/evolving-rpc/contents"
+	"github.com/yuhao-jack/evolving-rpc/errorx"
 	evolving_client "github.com/yuhao-jack/evolving-rpc/evolving-client"
 	evolving_server "github.com/yuhao-jack/evolving-rpc/evolving-server"
+	"github.com/yuhao-jack/evolving-rpc/evolving-server/admin"
+	"github.com/yuhao-jack/evolving-rpc/evolving-server/svr_mgr"
 	"github.com/yuhao-jack/evolving-rpc/model"
+	"github.com/yuhao-jack/go-toolx/netx"
 	"log"
-
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -20,6 +35,7 @@ func beforeTestDistributedRpc() {
 	//	ServerPort: 6601,
 	//}
 	//evolvingServer := evolving_server.NewEvolvingServer(&serverConf)
+	//evolvingServer.EnableRegistry()
 	//go evolvingServer.Start()
 	time.Sleep(time.Second)
 
@@ -78,3 +94,1244 @@ func TestDistributedRpc(t *testing.T) {
 	res, err = rpcClient.ExecuteCommand("Arith", "Arith.Divide", bytes, true)
 	contents.RpcLogger.Warn("%s,%v", string(res), err)
 }
+
+func TestDeadPeerDetection(t *testing.T) {
+	evolvingServer := evolving_server.NewEvolvingServer(&model.EvolvingServerConf{
+		BindHost:            "0.0.0.0",
+		ServerPort:          6602,
+		HeartbeatInterval:   100 * time.Millisecond,
+		MaxMissedHeartbeats: 2,
+	})
+	serviceMgr := evolvingServer.EnableRegistry()
+	go evolvingServer.Start()
+	defer evolvingServer.Close()
+	time.Sleep(time.Second)
+
+	//  心跳正常的客户端一直保持连接
+	alive := evolving_client.NewEvolvingClient(&model.EvolvingClientConfig{
+		EvolvingServerHost: "0.0.0.0",
+		EvolvingServerPort: 6602,
+		HeartbeatInterval:  50 * time.Millisecond,
+	})
+	defer alive.Close()
+
+	//  不发心跳的客户端会被断开，注册的服务被标记为DOWN
+	silent := evolving_client.NewEvolvingClient(&model.EvolvingClientConfig{
+		EvolvingServerHost: "0.0.0.0",
+		EvolvingServerPort: 6602,
+		HeartbeatInterval:  5 * time.Minute,
+		ReconnectInterval:  time.Minute,
+	})
+	defer silent.Close()
+	registered := make(chan struct{})
+	err := silent.RegisterService(&model.ServiceInfo{
+		ServiceName:    "DeadPeer",
+		ServiceHost:    "0.0.0.0",
+		ServicePort:    3399,
+		AdditionalMeta: map[string]any{},
+	}, func(reply netx.IMessage) {
+		close(registered)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-registered
+
+	time.Sleep(time.Second)
+	if state := silent.GetState(); state != contents.Disconnected {
+		t.Errorf("silent client state got %s", state)
+	}
+	if state := alive.GetState(); state != contents.Connected {
+		t.Errorf("alive client state got %s", state)
+	}
+	infos := serviceMgr.FindServiceInfosByServiceName("DeadPeer")
+	if len(infos) != 1 || infos[0].AdditionalMeta[contents.Status.String()] != contents.Down {
+		t.Errorf("dead peer service info got %v", infos)
+	}
+}
+
+func TestLeaseExpiry(t *testing.T) {
+	evolvingServer := evolving_server.NewEvolvingServer(&model.EvolvingServerConf{
+		BindHost:   "0.0.0.0",
+		ServerPort: 6603,
+	})
+	serviceMgr := evolvingServer.EnableRegistry()
+	go evolvingServer.Start()
+	defer evolvingServer.Close()
+	time.Sleep(time.Second)
+
+	client := evolving_client.NewEvolvingClient(&model.EvolvingClientConfig{
+		EvolvingServerHost: "0.0.0.0",
+		EvolvingServerPort: 6603,
+		HeartbeatInterval:  5 * time.Minute,
+	})
+	defer client.Close()
+
+	//  直接发REGISTER不会续约，连接还在租约也会过期
+	bytes, _ := json.Marshal(&model.ServiceInfo{ServiceName: "LeaseExpired", ServiceHost: "0.0.0.0", ServicePort: 3398, LeaseTTL: time.Second})
+	leaseChan := make(chan model.Lease, 1)
+	client.Execute(netx.NewDefaultMessage([]byte(contents.Register), bytes), func(reply netx.IMessage) {
+		var lease model.Lease
+		_ = json.Unmarshal(reply.GetBody(), &lease)
+		leaseChan <- lease
+	})
+	if lease := <-leaseChan; lease.LeaseId == "" || lease.TTL != time.Second {
+		t.Fatalf("lease got %+v", lease)
+	}
+
+	//  通过RegisterService注册的服务会自动续约
+	err := client.RegisterService(&model.ServiceInfo{ServiceName: "LeaseRenewed", ServiceHost: "0.0.0.0", ServicePort: 3397, LeaseTTL: time.Second}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(3 * time.Second)
+	if infos := serviceMgr.FindServiceInfosByServiceName("LeaseExpired"); len(infos) != 0 {
+		t.Errorf("expired lease still registered: %v", infos)
+	}
+	if infos := serviceMgr.FindServiceInfosByServiceName("LeaseRenewed"); len(infos) != 1 {
+		t.Errorf("renewed lease got %v", infos)
+	}
+}
+
+func TestRegistryPersistence(t *testing.T) {
+	dataDir := t.TempDir()
+	register := func(serviceMgr *svr_mgr.ServiceMgr, serviceName string, port int32) *model.Lease {
+		return serviceMgr.RegisterServiceInfo(&model.ServiceInfo{ServiceName: serviceName, ServiceHost: "0.0.0.0", ServicePort: port, LeaseTTL: time.Minute})
+	}
+
+	//  第一次启动注册的服务在第二次启动时写进快照
+	serviceMgr := svr_mgr.NewServiceMgr()
+	if err := serviceMgr.EnablePersistence(dataDir, time.Hour, 0); err != nil {
+		t.Fatal(err)
+	}
+	snapshotLease := register(serviceMgr, "InSnapshot", 3343)
+	serviceMgr.PushConfig("", "Persisted", map[string]string{"v": "1"})
+	serviceMgr.Close()
+
+	//  第二次启动后的变化只在变更日志里
+	serviceMgr = svr_mgr.NewServiceMgr()
+	if err := serviceMgr.EnablePersistence(dataDir, time.Hour, 0); err != nil {
+		t.Fatal(err)
+	}
+	register(serviceMgr, "InWal", 3344)
+	removed := &model.ServiceInfo{ServiceName: "Removed", ServiceHost: "0.0.0.0", ServicePort: 3345}
+	register(serviceMgr, removed.ServiceName, removed.ServicePort)
+	serviceMgr.DeregisterServiceInfo(removed)
+	serviceMgr.PushConfig("", "Persisted", map[string]string{"v": "2"})
+	serviceMgr.Close()
+
+	//  写到一半时崩溃留下的最后一行不影响恢复
+	wal, err := os.OpenFile(filepath.Join(dataDir, "wal.log"), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = wal.WriteString(`{"type":"ADD","service_info":{"service_na`)
+	_ = wal.Close()
+
+	//  恢复的租约2秒内没有续约时过期
+	serviceMgr = svr_mgr.NewServiceMgr()
+	defer serviceMgr.Close()
+	if err := serviceMgr.EnablePersistence(dataDir, time.Hour, 2*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	for _, serviceName := range []string{"InSnapshot", "InWal"} {
+		if infos := serviceMgr.FindServiceInfosByServiceName(serviceName); len(infos) != 1 {
+			t.Errorf("%s restored %v", serviceName, infos)
+		}
+	}
+	if infos := serviceMgr.FindServiceInfosByServiceName("Removed"); len(infos) != 0 {
+		t.Errorf("deregistered service restored %v", infos)
+	}
+	if history := serviceMgr.ConfigHistory("", "Persisted"); len(history) != 2 || history[1].Version != 2 || history[1].Data["v"] != "2" {
+		t.Errorf("config history restored %+v", history)
+	}
+	for i := 0; i < 4; i++ {
+		if unknown := serviceMgr.KeepAlive(snapshotLease.LeaseId); len(unknown) != 0 {
+			t.Fatalf("restored lease %s unknown", snapshotLease.LeaseId)
+		}
+		time.Sleep(time.Second)
+	}
+	if infos := serviceMgr.FindServiceInfosByServiceName("InSnapshot"); len(infos) != 1 {
+		t.Errorf("renewed service got %v", infos)
+	}
+	if infos := serviceMgr.FindServiceInfosByServiceName("InWal"); len(infos) != 0 {
+		t.Errorf("unconfirmed lease still registered: %v", infos)
+	}
+
+	//  中间的记录损坏时拒绝启动，不能丢掉后面的变化
+	brokenDir := t.TempDir()
+	valid, _ := json.Marshal(&model.ServiceEvent{Type: contents.ServiceAdd, ServiceInfo: &model.ServiceInfo{ServiceName: "Valid", ServiceHost: "0.0.0.0", ServicePort: 3346}})
+	if err := os.WriteFile(filepath.Join(brokenDir, "wal.log"), []byte("not json\n"+string(valid)+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	broken := svr_mgr.NewServiceMgr()
+	defer broken.Close()
+	if err := broken.EnablePersistence(brokenDir, time.Hour, 0); err == nil {
+		t.Error("broken wal loaded without error")
+	}
+
+	//  注册中心关闭时连接断开的服务先标记为下线，再关闭变更日志
+	closedDir := t.TempDir()
+	registerCenter := evolving_server.NewEvolvingServer(&model.EvolvingServerConf{BindHost: "0.0.0.0", ServerPort: 6620})
+	if err := registerCenter.EnableRegistry().EnablePersistence(closedDir, time.Hour, 0); err != nil {
+		t.Fatal(err)
+	}
+	go registerCenter.Start()
+	time.Sleep(500 * time.Millisecond)
+	provider := evolving_client.NewEvolvingClient(&model.EvolvingClientConfig{EvolvingServerHost: "0.0.0.0", EvolvingServerPort: 6620, HeartbeatInterval: 5 * time.Minute})
+	if provider == nil {
+		t.Fatal("connect register center failed")
+	}
+	defer provider.Close()
+	if err := provider.RegisterService(&model.ServiceInfo{ServiceName: "LostOnClose", ServiceHost: "0.0.0.0", ServicePort: 3347, LeaseTTL: time.Minute}, nil); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(200 * time.Millisecond)
+	registerCenter.Close()
+	restored := svr_mgr.NewServiceMgr()
+	defer restored.Close()
+	if err := restored.EnablePersistence(closedDir, time.Hour, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if infos := restored.FindServiceInfosByServiceName("LostOnClose"); len(infos) != 1 || infos[0].GetStatus() != contents.Down {
+		t.Errorf("service lost on close restored %v", infos)
+	}
+}
+
+func TestServiceWatch(t *testing.T) {
+	registerCenter := evolving_server.NewEvolvingServer(&model.EvolvingServerConf{
+		BindHost:   "0.0.0.0",
+		ServerPort: 6604,
+	})
+	registerCenter.EnableRegistry()
+	go registerCenter.Start()
+	defer registerCenter.Close()
+	server := evolving_server.NewDirectlyRpcServer(&evolving_server.DirectlyRpcServerConfig{EvolvingServerConf: model.EvolvingServerConf{
+		BindHost:   "0.0.0.0",
+		ServerPort: 3311,
+	}})
+	_ = server.Register(new(Arith))
+	go server.Run()
+	defer server.Close()
+	time.Sleep(time.Second)
+
+	//  客户端先启动，这时还没有服务
+	config := model.EvolvingClientConfig{
+		EvolvingServerHost: "0.0.0.0",
+		EvolvingServerPort: 6604,
+		HeartbeatInterval:  5 * time.Minute,
+	}
+	rpcClient := evolving_client.NewDistributedRpcClient([]*model.EvolvingClientConfig{&config}, []string{"WatchArith"})
+	defer rpcClient.Close()
+	var reply ArithReply
+	err := rpcClient.Call(context.Background(), "WatchArith", "Arith.Multiply", &ArithReq{A: 2, B: 3}, &reply)
+	if !errors.Is(err, errorx.New(errorx.Unavailable, "")) {
+		t.Fatalf("call before register got %v", err)
+	}
+
+	//  服务注册后推送给客户端
+	provider := evolving_client.NewEvolvingClient(&config)
+	err = provider.RegisterService(&model.ServiceInfo{ServiceName: "WatchArith", ServiceHost: "0.0.0.0", ServicePort: 3311}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(500 * time.Millisecond)
+	if err = rpcClient.Call(context.Background(), "WatchArith", "Arith.Multiply", &ArithReq{A: 2, B: 3}, &reply); err != nil || reply.Pro != 6 {
+		t.Fatalf("call after register got %+v,%v", reply, err)
+	}
+
+	//  服务和注册中心断开后被标记为DOWN，客户端不再调用它
+	provider.Close()
+	time.Sleep(500 * time.Millisecond)
+	err = rpcClient.Call(context.Background(), "WatchArith", "Arith.Multiply", &ArithReq{A: 2, B: 3}, &reply)
+	if !errors.Is(err, errorx.New(errorx.Unavailable, "")) {
+		t.Errorf("call after down got %v", err)
+	}
+}
+
+func TestGracefulDrain(t *testing.T) {
+	registerCenter := evolving_server.NewEvolvingServer(&model.EvolvingServerConf{
+		BindHost:   "0.0.0.0",
+		ServerPort: 6605,
+	})
+	serviceMgr := registerCenter.EnableRegistry()
+	go registerCenter.Start()
+	defer registerCenter.Close()
+	time.Sleep(time.Second)
+
+	config := model.EvolvingClientConfig{
+		EvolvingServerHost: "0.0.0.0",
+		EvolvingServerPort: 6605,
+		HeartbeatInterval:  5 * time.Minute,
+	}
+	rpcServer := evolving_server.NewDistributedRpcServer(&config, &model.ServiceInfo{
+		ServiceName: "DrainArith",
+		ServiceHost: "0.0.0.0",
+		ServicePort: 3312,
+	})
+	_ = rpcServer.Register(new(Arith))
+	go rpcServer.Run()
+	time.Sleep(500 * time.Millisecond)
+
+	rpcClient := evolving_client.NewDistributedRpcClient([]*model.EvolvingClientConfig{&config}, []string{"DrainArith"})
+	defer rpcClient.Close()
+
+	//  关闭时正在处理的调用正常完成
+	done := make(chan error, 1)
+	go func() {
+		var slept bool
+		done <- rpcClient.Call(context.Background(), "DrainArith", "Arith.Sleep", 500*time.Millisecond, &slept)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	rpcServer.Close()
+	if err := <-done; err != nil {
+		t.Errorf("in-flight call got %v", err)
+	}
+
+	//  下线后立即从注册中心移除，调用方不再调用它
+	if infos := serviceMgr.FindServiceInfosByServiceName("DrainArith"); len(infos) != 0 {
+		t.Errorf("deregistered service still registered: %v", infos)
+	}
+	time.Sleep(100 * time.Millisecond)
+	var reply ArithReply
+	err := rpcClient.Call(context.Background(), "DrainArith", "Arith.Multiply", &ArithReq{A: 2, B: 3}, &reply)
+	if !errors.Is(err, errorx.New(errorx.Unavailable, "")) {
+		t.Errorf("call after drain got %v", err)
+	}
+}
+
+func TestRegisterCenterCluster(t *testing.T) {
+	bin := filepath.Join(t.TempDir(), "register_discover")
+	if out, err := exec.Command("go", "build", "-o", bin, "../register_discover").CombinedOutput(); err != nil {
+		t.Fatalf("build register_discover failed,err:%v\n%s", err, out)
+	}
+	//  3个节点都在本机，工具服务的端口是注册中心的端口加2000
+	nodes := map[int]*exec.Cmd{}
+	for _, port := range []int{6611, 6612, 6613} {
+		var peers []string
+		for _, peer := range []int{6611, 6612, 6613} {
+			if peer != port {
+				peers = append(peers, fmt.Sprintf("127.0.0.1:%d", peer))
+			}
+		}
+		cmd := exec.Command(bin, "-rdp", fmt.Sprint(port), "-p", fmt.Sprint(port+2000), "-h", "127.0.0.1",
+			"-node", fmt.Sprintf("127.0.0.1:%d", port), "-peers", strings.Join(peers, ","), "-ctoken", "secret")
+		cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+		if err := cmd.Start(); err != nil {
+			t.Fatal(err)
+		}
+		nodes[port] = cmd
+		t.Cleanup(func() {
+			_ = cmd.Process.Kill()
+			_ = cmd.Wait()
+		})
+	}
+	leaderOf := func(port int) string {
+		resp, err := http.Get(fmt.Sprintf("http://127.0.0.1:%d/cluster", port+2000))
+		if err != nil {
+			return ""
+		}
+		defer resp.Body.Close()
+		var status struct {
+			Leader string `json:"leader"`
+		}
+		_ = json.NewDecoder(resp.Body).Decode(&status)
+		return status.Leader
+	}
+	//  等节点对主节点的看法一致，并且主节点是其中之一
+	waitLeader := func(ports ...int) (leader int, followers []int) {
+		for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(100 * time.Millisecond) {
+			addr := leaderOf(ports[0])
+			agreed := addr != ""
+			for _, port := range ports[1:] {
+				agreed = agreed && leaderOf(port) == addr
+			}
+			if !agreed {
+				continue
+			}
+			leader, _ = strconv.Atoi(addr[strings.LastIndex(addr, ":")+1:])
+			followers = nil
+			for _, port := range ports {
+				if port != leader {
+					followers = append(followers, port)
+				}
+			}
+			if len(followers) < len(ports) {
+				return leader, followers
+			}
+		}
+		t.Fatalf("nodes %v elected no leader", ports)
+		return 0, nil
+	}
+	leader, followers := waitLeader(6611, 6612, 6613)
+
+	connect := func(port int32) *evolving_client.EvolvingClient {
+		client := evolving_client.NewEvolvingClient(&model.EvolvingClientConfig{
+			EvolvingServerHost: "127.0.0.1",
+			EvolvingServerPort: port,
+			HeartbeatInterval:  5 * time.Minute,
+			ConfigToken:        "secret",
+		})
+		if client == nil {
+			t.Fatalf("connect register center %d failed", port)
+		}
+		t.Cleanup(client.Close)
+		return client
+	}
+	discover := func(client *evolving_client.EvolvingClient, serviceName string) []*model.ServiceInfo {
+		replyChan := make(chan []*model.ServiceInfo, 1)
+		_ = client.DisCover(serviceName, func(reply netx.IMessage) {
+			var serviceList []*model.ServiceInfo
+			_ = json.Unmarshal(reply.GetBody(), &serviceList)
+			replyChan <- serviceList
+		})
+		select {
+		case serviceList := <-replyChan:
+			return serviceList
+		case <-time.After(3 * time.Second):
+			t.Fatalf("discover %s timeout", serviceName)
+			return nil
+		}
+	}
+	configOf := func(client *evolving_client.EvolvingClient, f func(client *evolving_client.EvolvingClient, callBack func(reply netx.IMessage)) error) *model.Config {
+		replyChan := make(chan netx.IMessage, 1)
+		if err := f(client, func(reply netx.IMessage) { replyChan <- reply }); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case reply := <-replyChan:
+			var config model.Config
+			if model.StatusOf(reply) != nil || json.Unmarshal(reply.GetBody(), &config) != nil {
+				return nil
+			}
+			return &config
+		case <-time.After(3 * time.Second):
+			t.Fatal("config request timeout")
+			return nil
+		}
+	}
+	getConfig := func(client *evolving_client.EvolvingClient, callBack func(reply netx.IMessage)) error {
+		return client.GetConfig("ClusterArith", 0, callBack)
+	}
+
+	//  通过follower注册，任何节点都能发现
+	follower, reader := connect(int32(followers[0])), connect(int32(followers[1]))
+	err := follower.RegisterService(&model.ServiceInfo{ServiceName: "ClusterArith", ServiceHost: "127.0.0.1", ServicePort: 3313, LeaseTTL: time.Second}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(500 * time.Millisecond)
+	if infos := discover(reader, "ClusterArith"); len(infos) != 1 {
+		t.Fatalf("discover via %d got %v", followers[1], infos)
+	}
+
+	//  follower的管理接口不能修改服务实例，回复leader的地址
+	req, _ := http.NewRequest(http.MethodDelete, fmt.Sprintf("http://127.0.0.1:%d/api/instances?name=ClusterArith&host=127.0.0.1&port=3313", followers[0]+2000), nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var misdirected struct {
+		Leader string `json:"leader"`
+	}
+	_ = json.NewDecoder(resp.Body).Decode(&misdirected)
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusMisdirectedRequest || misdirected.Leader != fmt.Sprintf("127.0.0.1:%d", leader) {
+		t.Errorf("delete via follower got %d %+v", resp.StatusCode, misdirected)
+	}
+	if infos := discover(reader, "ClusterArith"); len(infos) != 1 {
+		t.Errorf("discover after delete via follower got %v", infos)
+	}
+
+	//  通过follower发布的配置由leader分配版本号，同步到所有节点
+	pushed := configOf(follower, func(client *evolving_client.EvolvingClient, callBack func(reply netx.IMessage)) error {
+		return client.PushConfig("ClusterArith", map[string]string{"timeout": "1s"}, callBack)
+	})
+	if pushed == nil || pushed.Version != 1 {
+		t.Fatalf("push config via %d got %+v", followers[0], pushed)
+	}
+	time.Sleep(500 * time.Millisecond)
+	if config := configOf(reader, getConfig); config == nil || config.Data["timeout"] != "1s" {
+		t.Errorf("get config via %d got %+v", followers[1], config)
+	}
+
+	//  leader挂掉后剩下的两个节点仍然是多数，选出新的leader，注册信息还在，租约继续续约
+	_ = nodes[leader].Process.Kill()
+	leader, followers = waitLeader(followers...)
+	time.Sleep(time.Second)
+	if infos := discover(reader, "ClusterArith"); len(infos) != 1 || infos[0].GetStatus() != contents.Up {
+		t.Errorf("discover after leader lost got %v", infos)
+	}
+	if config := configOf(reader, getConfig); config == nil || config.Version != 1 {
+		t.Errorf("get config after leader lost got %+v", config)
+	}
+	err = follower.RegisterService(&model.ServiceInfo{ServiceName: "ClusterArith", ServiceHost: "127.0.0.1", ServicePort: 3314, LeaseTTL: time.Second}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(500 * time.Millisecond)
+	if infos := discover(reader, "ClusterArith"); len(infos) != 2 {
+		t.Errorf("register after leader lost got %v", infos)
+	}
+
+	//  只剩一个节点时不是多数，原来的leader超时后它不能成为leader
+	_ = nodes[leader].Process.Kill()
+	time.Sleep(2 * time.Second)
+	for i := 0; i < 10; i++ {
+		if addr := leaderOf(followers[0]); addr != "" {
+			t.Fatalf("node %d follows %s without quorum", followers[0], addr)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func TestIsolatedRegistries(t *testing.T) {
+	registerCenter := evolving_server.NewEvolvingServer(&model.EvolvingServerConf{
+		BindHost:   "0.0.0.0",
+		ServerPort: 6606,
+	})
+	serviceMgr := registerCenter.EnableRegistry()
+	go registerCenter.Start()
+	defer registerCenter.Close()
+	//  没有开启注册中心的服务端不处理注册
+	plain := evolving_server.NewEvolvingServer(&model.EvolvingServerConf{
+		BindHost:   "0.0.0.0",
+		ServerPort: 6607,
+	})
+	go plain.Start()
+	defer plain.Close()
+	time.Sleep(time.Second)
+
+	info := &model.ServiceInfo{ServiceName: "IsolatedArith", ServiceHost: "0.0.0.0", ServicePort: 3315}
+	for _, port := range []int32{6606, 6607} {
+		client := evolving_client.NewEvolvingClient(&model.EvolvingClientConfig{
+			EvolvingServerHost: "0.0.0.0",
+			EvolvingServerPort: port,
+			HeartbeatInterval:  5 * time.Minute,
+		})
+		defer client.Close()
+		bytes, _ := json.Marshal(info)
+		reply, err := client.ExecuteContext(context.Background(), netx.NewDefaultMessage([]byte(contents.Register), bytes))
+		if port == 6606 && err != nil {
+			t.Errorf("register got %v", err)
+		}
+		if port == 6607 && !errors.Is(err, errorx.UnknownCommandErr) {
+			t.Errorf("register to plain server got %v,%v", reply, err)
+		}
+	}
+	if infos := serviceMgr.FindServiceInfosByServiceName("IsolatedArith"); len(infos) != 1 {
+		t.Errorf("registered service got %v", infos)
+	}
+	if plain.GetServiceMgr() != nil {
+		t.Error("plain server has a service manager")
+	}
+}
+
+func TestServiceNamespaces(t *testing.T) {
+	registerCenter := evolving_server.NewEvolvingServer(&model.EvolvingServerConf{
+		BindHost:   "0.0.0.0",
+		ServerPort: 6608,
+	})
+	registerCenter.EnableRegistry()
+	go registerCenter.Start()
+	defer registerCenter.Close()
+	time.Sleep(time.Second)
+
+	//  同名的服务注册在不同的命名空间和环境下
+	scopes := []*model.EvolvingClientConfig{
+		{EvolvingServerHost: "0.0.0.0", EvolvingServerPort: 6608, HeartbeatInterval: 5 * time.Minute},
+		{EvolvingServerHost: "0.0.0.0", EvolvingServerPort: 6608, HeartbeatInterval: 5 * time.Minute, Namespace: "team-a", Env: "staging"},
+	}
+	for i, config := range scopes {
+		client := evolving_client.NewEvolvingClient(config)
+		defer client.Close()
+		err := client.RegisterService(&model.ServiceInfo{Namespace: config.Namespace, Env: config.Env, ServiceName: "ScopedArith", ServiceHost: "0.0.0.0", ServicePort: int32(3316 + i)}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(500 * time.Millisecond)
+
+	//  发现服务时只能看到自己命名空间和环境下的
+	for i, config := range scopes {
+		client := evolving_client.NewEvolvingClient(config)
+		defer client.Close()
+		replyChan := make(chan []*model.ServiceInfo, 1)
+		_ = client.DisCover("ScopedArith", func(reply netx.IMessage) {
+			var serviceList []*model.ServiceInfo
+			_ = json.Unmarshal(reply.GetBody(), &serviceList)
+			replyChan <- serviceList
+		})
+		if infos := <-replyChan; len(infos) != 1 || infos[0].ServicePort != int32(3316+i) {
+			t.Errorf("discover in %s/%s got %v", config.Namespace, config.Env, infos)
+		}
+	}
+}
+
+func TestDiscoverSelector(t *testing.T) {
+	registerCenter := evolving_server.NewEvolvingServer(&model.EvolvingServerConf{
+		BindHost:   "0.0.0.0",
+		ServerPort: 6609,
+	})
+	serviceMgr := registerCenter.EnableRegistry()
+	go registerCenter.Start()
+	defer registerCenter.Close()
+	time.Sleep(time.Second)
+
+	for i, meta := range []map[string]any{
+		{"version": "1", "zone": "a"},
+		{"version": "2", "zone": "a"},
+		{"version": "2", "zone": "b"},
+		{"version": "2", "zone": "c"},
+	} {
+		serviceMgr.RegisterServiceInfo(&model.ServiceInfo{ServiceName: "SelectArith", ServiceHost: "0.0.0.0", ServicePort: int32(3320 + i), AdditionalMeta: meta})
+	}
+	serviceMgr.MarkServiceDown(&model.ServiceInfo{ServiceName: "SelectArith", ServiceHost: "0.0.0.0", ServicePort: 3322})
+
+	client := evolving_client.NewEvolvingClient(&model.EvolvingClientConfig{
+		EvolvingServerHost: "0.0.0.0",
+		EvolvingServerPort: 6609,
+		HeartbeatInterval:  5 * time.Minute,
+	})
+	defer client.Close()
+	for selector, want := range map[string][]int32{
+		"":                                    {3320, 3321, 3322, 3323},
+		"version=2, zone in (a,b), status=UP": {3321},
+		"version!=2":                          {3320},
+		"zone notin (a), status=DOWN":         {3322},
+		"!version":                            nil,
+	} {
+		replyChan := make(chan []*model.ServiceInfo, 1)
+		if err := client.DisCoverBySelector("SelectArith", selector, func(reply netx.IMessage) {
+			var serviceList []*model.ServiceInfo
+			_ = json.Unmarshal(reply.GetBody(), &serviceList)
+			replyChan <- serviceList
+		}); err != nil {
+			t.Fatal(err)
+		}
+		var got []int32
+		for _, info := range <-replyChan {
+			got = append(got, info.ServicePort)
+		}
+		sort.Slice(got, func(i, j int) bool { return got[i] < got[j] })
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("discover by %q got %v,want %v", selector, got, want)
+		}
+	}
+	if err := client.DisCoverBySelector("SelectArith", "zone in ()", nil); err == nil {
+		t.Error("bad selector accepted")
+	}
+}
+
+func TestConfigCenter(t *testing.T) {
+	registerCenter := evolving_server.NewEvolvingServer(&model.EvolvingServerConf{
+		BindHost:    "0.0.0.0",
+		ServerPort:  6610,
+		ConfigToken: "secret",
+	})
+	registerCenter.EnableRegistry()
+	go registerCenter.Start()
+	defer registerCenter.Close()
+	time.Sleep(time.Second)
+
+	config := model.EvolvingClientConfig{
+		EvolvingServerHost: "0.0.0.0",
+		EvolvingServerPort: 6610,
+		HeartbeatInterval:  5 * time.Minute,
+	}
+	watcher := evolving_client.NewEvolvingClient(&config)
+	defer watcher.Close()
+	publisherConfig := config
+	publisherConfig.ConfigToken = "secret"
+	publisher := evolving_client.NewEvolvingClient(&publisherConfig)
+	defer publisher.Close()
+	changes := make(chan *model.Config, 10)
+	if err := watcher.WatchConfig("ConfArith", func(config *model.Config) { changes <- config }); err != nil {
+		t.Fatal(err)
+	}
+	expect := func(version uint64, value string) {
+		select {
+		case config := <-changes:
+			if config.Version != version || config.Data["timeout"] != value {
+				t.Errorf("config change got %+v,want version %d timeout %s", config, version, value)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("config version %d not pushed", version)
+		}
+	}
+	execute := func(f func(callBack func(reply netx.IMessage)) error) (*model.Config, error) {
+		replyChan := make(chan netx.IMessage, 1)
+		if err := f(func(reply netx.IMessage) { replyChan <- reply }); err != nil {
+			return nil, err
+		}
+		reply := <-replyChan
+		if err := model.StatusOf(reply); err != nil {
+			return nil, err
+		}
+		var config model.Config
+		return &config, json.Unmarshal(reply.GetBody(), &config)
+	}
+
+	//  发布的每个版本都推送给订阅方
+	for i, value := range []string{"1s", "2s"} {
+		value := value
+		if _, err := execute(func(callBack func(reply netx.IMessage)) error {
+			return publisher.PushConfig("ConfArith", map[string]string{"timeout": value}, callBack)
+		}); err != nil {
+			t.Fatal(err)
+		}
+		expect(uint64(i+1), value)
+	}
+	old, err := execute(func(callBack func(reply netx.IMessage)) error { return publisher.GetConfig("ConfArith", 1, callBack) })
+	if err != nil || old.Data["timeout"] != "1s" {
+		t.Errorf("get config version 1 got %+v,%v", old, err)
+	}
+
+	//  回滚后原来版本的内容作为新版本推送
+	rollback, err := execute(func(callBack func(reply netx.IMessage)) error {
+		return publisher.RollbackConfig("ConfArith", 1, callBack)
+	})
+	if err != nil || rollback.Version != 3 || rollback.RollbackOf != 1 {
+		t.Errorf("rollback got %+v,%v", rollback, err)
+	}
+	expect(3, "1s")
+	_, err = execute(func(callBack func(reply netx.IMessage)) error {
+		return publisher.RollbackConfig("ConfArith", 99, callBack)
+	})
+	if !errors.Is(err, errorx.New(errorx.NotFound, "")) {
+		t.Errorf("rollback to missing version got %v", err)
+	}
+
+	//  没有带令牌的调用方不能修改配置
+	_, err = execute(func(callBack func(reply netx.IMessage)) error {
+		return watcher.PushConfig("ConfArith", map[string]string{"timeout": "9s"}, callBack)
+	})
+	if !errors.Is(err, errorx.New(errorx.PermissionDenied, "")) {
+		t.Errorf("push without token got %v", err)
+	}
+	if latest, err := execute(func(callBack func(reply netx.IMessage)) error { return watcher.GetConfig("ConfArith", 0, callBack) }); err != nil || latest.Version != 3 {
+		t.Errorf("config after rejected push got %+v,%v", latest, err)
+	}
+}
+
+func TestAdminApi(t *testing.T) {
+	registerCenter := evolving_server.NewEvolvingServer(&model.EvolvingServerConf{
+		BindHost:   "0.0.0.0",
+		ServerPort: 6614,
+	})
+	serviceMgr := registerCenter.EnableRegistry()
+	go registerCenter.Start()
+	defer registerCenter.Close()
+	time.Sleep(time.Second)
+	client := evolving_client.NewEvolvingClient(&model.EvolvingClientConfig{
+		EvolvingServerHost: "0.0.0.0",
+		EvolvingServerPort: 6614,
+		HeartbeatInterval:  5 * time.Minute,
+	})
+	defer client.Close()
+	adminHandler := admin.NewAdminHandler(registerCenter)
+	adminHandler.SetToken("admin-secret")
+	adminServer := httptest.NewServer(adminHandler)
+	defer adminServer.Close()
+
+	info := &model.ServiceInfo{ServiceName: "AdminArith", ServiceHost: "0.0.0.0", ServicePort: 3330, AdditionalMeta: map[string]any{"version": "1"}}
+	serviceMgr.RegisterServiceInfo(info)
+	instance := "/api/instances?name=AdminArith&host=0.0.0.0&port=3330"
+	request := func(method, path, body string, wantStatus int, resp any) {
+		req, _ := http.NewRequest(method, adminServer.URL+path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer admin-secret")
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		if res.StatusCode != wantStatus {
+			t.Errorf("%s %s got status %d,want %d", method, path, res.StatusCode, wantStatus)
+		}
+		if resp != nil {
+			_ = json.NewDecoder(res.Body).Decode(resp)
+		}
+	}
+
+	var serviceList []*model.ServiceInfo
+	request(http.MethodGet, "/api/services?name=AdminArith&selector=version%3D1", "", http.StatusOK, &serviceList)
+	if len(serviceList) != 1 {
+		t.Errorf("list services got %v", serviceList)
+	}
+	request(http.MethodGet, "/api/services?selector=zone+in+()", "", http.StatusBadRequest, nil)
+	request(http.MethodPost, "/api/services", "", http.StatusMethodNotAllowed, nil)
+	request(http.MethodGet, "/api/instances?name=AdminArith", "", http.StatusBadRequest, nil)
+	request(http.MethodGet, "/api/instances?name=AdminArith&host=0.0.0.0&port=1", "", http.StatusNotFound, nil)
+
+	//  修改服务实例需要令牌
+	unauthorized, _ := http.NewRequest(http.MethodDelete, adminServer.URL+instance, nil)
+	if res, err := http.DefaultClient.Do(unauthorized); err != nil || res.StatusCode != http.StatusUnauthorized {
+		t.Errorf("delete without token got %v,%v", res, err)
+	} else {
+		res.Body.Close()
+	}
+
+	//  停用后重新注册也保持停用
+	var got model.ServiceInfo
+	request(http.MethodPut, "/api/instances/status"+instance[len("/api/instances"):], `{"status":"DISABLED"}`, http.StatusOK, &got)
+	serviceMgr.RegisterServiceInfo(info)
+	request(http.MethodGet, instance, "", http.StatusOK, &got)
+	if got.GetStatus() != contents.Disabled {
+		t.Errorf("disabled instance got %+v", got)
+	}
+
+	metaPath := "/api/instances/meta" + instance[len("/api/instances"):]
+	request(http.MethodPatch, metaPath, `{"status":"UP"}`, http.StatusBadRequest, nil)
+	request(http.MethodPatch, metaPath, `{"version":"2"}`, http.StatusOK, &got)
+	if got.AdditionalMeta["version"] != "2" {
+		t.Errorf("edit meta got %+v", got)
+	}
+
+	var clients []*model.ClientInfo
+	request(http.MethodGet, "/api/clients", "", http.StatusOK, &clients)
+	if len(clients) != 1 {
+		t.Errorf("clients got %v", clients)
+	}
+
+	request(http.MethodDelete, instance, "", http.StatusNoContent, nil)
+	request(http.MethodDelete, instance, "", http.StatusNotFound, nil)
+
+	//  强制下线后服务的持有者还在续约，也不会自动重新注册
+	provider := &model.ServiceInfo{ServiceName: "AdminArith", ServiceHost: "0.0.0.0", ServicePort: 3331, LeaseTTL: 3 * time.Second}
+	registered := make(chan struct{}, 1)
+	if err := client.RegisterService(provider, func(reply netx.IMessage) { registered <- struct{}{} }); err != nil {
+		t.Fatal(err)
+	}
+	<-registered
+	providerInstance := "/api/instances?name=AdminArith&host=0.0.0.0&port=3331"
+	request(http.MethodDelete, providerInstance, "", http.StatusNoContent, nil)
+	time.Sleep(2 * time.Second)
+	request(http.MethodGet, providerInstance, "", http.StatusNotFound, nil)
+}
+
+func TestLoadBalance(t *testing.T) {
+	registerCenter := evolving_server.NewEvolvingServer(&model.EvolvingServerConf{
+		BindHost:   "0.0.0.0",
+		ServerPort: 6615,
+	})
+	serviceMgr := registerCenter.EnableRegistry()
+	go registerCenter.Start()
+	defer registerCenter.Close()
+	//  3个服务实例，记录每个实例收到的调用
+	var counts [3]int64
+	var sleeping int64 = -1
+	for i, weight := range []int{1, 0, 3} {
+		i := i
+		server := evolving_server.NewDirectlyRpcServer(&evolving_server.DirectlyRpcServerConfig{EvolvingServerConf: model.EvolvingServerConf{
+			BindHost:   "0.0.0.0",
+			ServerPort: int32(3331 + i),
+		}})
+		_ = server.Register(new(Arith))
+		server.Use(func(ctx context.Context, command string, req any, handler evolving_server.RpcHandler) (any, error) {
+			if command == "Arith.Sleep" {
+				atomic.StoreInt64(&sleeping, int64(i))
+			}
+			atomic.AddInt64(&counts[i], 1)
+			return handler(ctx, req)
+		})
+		go server.Run()
+		defer server.Close()
+		serviceMgr.RegisterServiceInfo(&model.ServiceInfo{ServiceName: "BalanceArith", ServiceHost: "0.0.0.0", ServicePort: int32(3331 + i), AdditionalMeta: map[string]any{contents.Weight.String(): weight}})
+	}
+	time.Sleep(time.Second)
+	rpcClient := evolving_client.NewDistributedRpcClient([]*model.EvolvingClientConfig{{
+		EvolvingServerHost: "0.0.0.0",
+		EvolvingServerPort: 6615,
+		HeartbeatInterval:  5 * time.Minute,
+	}}, []string{"BalanceArith"})
+	defer rpcClient.Close()
+	call := func(n int) [3]int64 {
+		for i := range counts {
+			atomic.StoreInt64(&counts[i], 0)
+		}
+		for i := 0; i < n; i++ {
+			var reply ArithReply
+			if err := rpcClient.Call(context.Background(), "BalanceArith", "Arith.Multiply", &ArithReq{A: 2, B: 3}, &reply); err != nil {
+				t.Fatal(err)
+			}
+		}
+		var got [3]int64
+		for i := range counts {
+			got[i] = atomic.LoadInt64(&counts[i])
+		}
+		return got
+	}
+
+	//  默认轮询，同一个命令均匀分到所有实例
+	if got := call(30); got != [3]int64{10, 10, 10} {
+		t.Errorf("round robin got %v", got)
+	}
+	//  按权重随机，权重为0的实例不会被选中
+	_ = rpcClient.SetBalanceStrategy("BalanceArith", contents.Weighted)
+	if got := call(200); got[1] != 0 || got[0] == 0 || got[2] <= got[0] {
+		t.Errorf("weighted got %v", got)
+	}
+	//  未完成调用最少，正在处理慢调用的实例不会被选中
+	_ = rpcClient.SetBalanceStrategy("BalanceArith", contents.LeastOutstanding)
+	done := make(chan struct{})
+	go func() {
+		var slept bool
+		_ = rpcClient.Call(context.Background(), "BalanceArith", "Arith.Sleep", time.Second, &slept)
+		close(done)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	if got := call(30); got[atomic.LoadInt64(&sleeping)] != 0 {
+		t.Errorf("least outstanding got %v,sleeping %d", got, atomic.LoadInt64(&sleeping))
+	}
+	<-done
+	if err := rpcClient.SetBalanceStrategy("BalanceArith", "unknown"); err == nil {
+		t.Error("unknown strategy accepted")
+	}
+}
+
+func TestConsistentHash(t *testing.T) {
+	registerCenter := evolving_server.NewEvolvingServer(&model.EvolvingServerConf{
+		BindHost:   "0.0.0.0",
+		ServerPort: 6616,
+	})
+	serviceMgr := registerCenter.EnableRegistry()
+	go registerCenter.Start()
+	defer registerCenter.Close()
+	//  3个服务实例，先注册前两个，记录最近一次调用由哪个实例处理
+	var served int64 = -1
+	infos := make([]*model.ServiceInfo, 3)
+	for i := range infos {
+		i := i
+		server := evolving_server.NewDirectlyRpcServer(&evolving_server.DirectlyRpcServerConfig{EvolvingServerConf: model.EvolvingServerConf{
+			BindHost:   "0.0.0.0",
+			ServerPort: int32(3334 + i),
+		}})
+		_ = server.Register(new(Arith))
+		server.Use(func(ctx context.Context, command string, req any, handler evolving_server.RpcHandler) (any, error) {
+			atomic.StoreInt64(&served, int64(i))
+			return handler(ctx, req)
+		})
+		go server.Run()
+		defer server.Close()
+		infos[i] = &model.ServiceInfo{ServiceName: "HashArith", ServiceHost: "0.0.0.0", ServicePort: int32(3334 + i)}
+	}
+	serviceMgr.RegisterServiceInfo(infos[0])
+	serviceMgr.RegisterServiceInfo(infos[1])
+	time.Sleep(time.Second)
+	rpcClient := evolving_client.NewDistributedRpcClient([]*model.EvolvingClientConfig{{
+		EvolvingServerHost: "0.0.0.0",
+		EvolvingServerPort: 6616,
+		HeartbeatInterval:  5 * time.Minute,
+	}}, []string{"HashArith"})
+	defer rpcClient.Close()
+	if err := rpcClient.SetBalanceStrategy("HashArith", contents.ConsistentHash); err != nil {
+		t.Fatal(err)
+	}
+	route := func() map[string]int64 {
+		routes := make(map[string]int64)
+		for i := 0; i < 100; i++ {
+			key := fmt.Sprintf("user-%d", i)
+			var reply ArithReply
+			if err := rpcClient.Call(context.Background(), "HashArith", "Arith.Multiply", &ArithReq{A: 2, B: 3}, &reply, evolving_client.WithRoutingKey(key)); err != nil {
+				t.Fatal(err)
+			}
+			routes[key] = atomic.LoadInt64(&served)
+		}
+		return routes
+	}
+
+	//  同一个路由键总是发给同一个实例
+	before := route()
+	if again := route(); fmt.Sprint(again) != fmt.Sprint(before) {
+		t.Fatalf("routes changed without membership change,before %v,after %v", before, again)
+	}
+	//  新实例加入，只有一部分路由键迁移到新实例
+	serviceMgr.RegisterServiceInfo(infos[2])
+	time.Sleep(time.Second)
+	moved := 0
+	for key, i := range route() {
+		if i != before[key] {
+			if i != 2 {
+				t.Errorf("key %s moved from %d to %d", key, before[key], i)
+			}
+			moved++
+		}
+	}
+	if moved == 0 || moved > 60 {
+		t.Errorf("%d of 100 keys moved after join", moved)
+	}
+	//  新实例离开，路由恢复原样
+	serviceMgr.DeregisterServiceInfo(infos[2])
+	time.Sleep(time.Second)
+	if after := route(); fmt.Sprint(after) != fmt.Sprint(before) {
+		t.Errorf("routes not restored after leave,before %v,after %v", before, after)
+	}
+
+	//  实例暂时不能选择时只有它的路由键顺时针交给下一个实例，其它路由键不动
+	balancer := evolving_client.NewConsistentHashBalancer(0)
+	members := make([]*evolving_client.Instance, len(infos))
+	for i, info := range infos {
+		members[i] = &evolving_client.Instance{Info: info}
+	}
+	for i := 0; i < 100; i++ {
+		info := evolving_client.PickInfo{RoutingKey: fmt.Sprintf("user-%d", i), Members: members}
+		picked := balancer.Pick(info, members)
+		if skipped := balancer.Pick(info, members[:2]); picked != members[2] && skipped != picked {
+			t.Errorf("key %s moved from %s to %s while %s unavailable", info.RoutingKey, picked.Info.Addr(), skipped.Info.Addr(), members[2].Info.Addr())
+		}
+	}
+}
+
+func TestRetryPolicy(t *testing.T) {
+	registerCenter := evolving_server.NewEvolvingServer(&model.EvolvingServerConf{
+		BindHost:   "0.0.0.0",
+		ServerPort: 6617,
+	})
+	serviceMgr := registerCenter.EnableRegistry()
+	go registerCenter.Start()
+	defer registerCenter.Close()
+	//  2个服务实例，第二个收到调用后总是返回服务不可用
+	var calls [2]int64
+	for i := 0; i < 2; i++ {
+		i := i
+		server := evolving_server.NewDirectlyRpcServer(&evolving_server.DirectlyRpcServerConfig{EvolvingServerConf: model.EvolvingServerConf{
+			BindHost:   "0.0.0.0",
+			ServerPort: int32(3337 + i),
+		}})
+		_ = server.Register(new(Arith))
+		server.Use(func(ctx context.Context, command string, req any, handler evolving_server.RpcHandler) (any, error) {
+			atomic.AddInt64(&calls[i], 1)
+			if i == 1 {
+				return nil, errorx.New(errorx.Unavailable, "instance is broken")
+			}
+			return handler(ctx, req)
+		})
+		go server.Run()
+		defer server.Close()
+		serviceMgr.RegisterServiceInfo(&model.ServiceInfo{ServiceName: "RetryArith", ServiceHost: "0.0.0.0", ServicePort: int32(3337 + i)})
+	}
+	time.Sleep(time.Second)
+	rpcClient := evolving_client.NewDistributedRpcClient([]*model.EvolvingClientConfig{{
+		EvolvingServerHost: "0.0.0.0",
+		EvolvingServerPort: 6617,
+		HeartbeatInterval:  5 * time.Minute,
+	}}, []string{"RetryArith"})
+	defer rpcClient.Close()
+	call := func(n int) (failed int) {
+		for i := 0; i < n; i++ {
+			var reply ArithReply
+			if err := rpcClient.Call(context.Background(), "RetryArith", "Arith.Multiply", &ArithReq{A: 2, B: 3}, &reply); err != nil {
+				if !errors.Is(err, errorx.New(errorx.Unavailable, "")) {
+					t.Fatal(err)
+				}
+				failed++
+			}
+		}
+		return failed
+	}
+
+	//  默认不重试，轮询到坏的实例就失败
+	if failed := call(10); failed != 5 {
+		t.Errorf("without retry policy %d of 10 calls failed", failed)
+	}
+	//  幂等方法重试到另一个实例
+	policy := &evolving_client.RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond, Idempotent: true}
+	rpcClient.SetRetryPolicy("RetryArith", "Arith.Multiply", policy)
+	rpcClient.SetRetryBudget(nil)
+	atomic.StoreInt64(&calls[0], 0)
+	if failed := call(10); failed != 0 || atomic.LoadInt64(&calls[0]) != 10 {
+		t.Errorf("with retry policy %d of 10 calls failed,good instance got %d calls", failed, atomic.LoadInt64(&calls[0]))
+	}
+	//  非幂等方法请求已经发出，不重试
+	rpcClient.SetRetryPolicy("RetryArith", "", &evolving_client.RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond})
+	rpcClient.SetRetryPolicy("RetryArith", "Arith.Multiply", nil)
+	if failed := call(10); failed != 5 {
+		t.Errorf("non idempotent method %d of 10 calls failed", failed)
+	}
+	//  重试预算用完后不再重试
+	rpcClient.SetRetryPolicy("RetryArith", "Arith.Multiply", policy)
+	rpcClient.SetRetryBudget(evolving_client.NewRetryBudget(4, 0))
+	atomic.StoreInt64(&calls[0], 0)
+	atomic.StoreInt64(&calls[1], 0)
+	failed := call(10)
+	if failed == 0 || atomic.LoadInt64(&calls[0]) != int64(10-failed) || atomic.LoadInt64(&calls[1]) != int64(failed+1) {
+		t.Errorf("with retry budget %d of 10 calls failed,calls %d %d", failed, atomic.LoadInt64(&calls[0]), atomic.LoadInt64(&calls[1]))
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	registerCenter := evolving_server.NewEvolvingServer(&model.EvolvingServerConf{
+		BindHost:   "0.0.0.0",
+		ServerPort: 6618,
+	})
+	serviceMgr := registerCenter.EnableRegistry()
+	go registerCenter.Start()
+	defer registerCenter.Close()
+	//  2个服务实例，第二个坏掉时Arith.Multiply返回服务不可用
+	var calls [2]int64
+	var broken int64 = 1
+	infos := make([]*model.ServiceInfo, 2)
+	for i := range infos {
+		i := i
+		server := evolving_server.NewDirectlyRpcServer(&evolving_server.DirectlyRpcServerConfig{EvolvingServerConf: model.EvolvingServerConf{
+			BindHost:   "0.0.0.0",
+			ServerPort: int32(3339 + i),
+		}})
+		_ = server.Register(new(Arith))
+		server.Use(func(ctx context.Context, command string, req any, handler evolving_server.RpcHandler) (any, error) {
+			if command != "Arith.Multiply" {
+				return handler(ctx, req)
+			}
+			atomic.AddInt64(&calls[i], 1)
+			if i == 1 && atomic.LoadInt64(&broken) == 1 {
+				return nil, errorx.New(errorx.Unavailable, "instance is broken")
+			}
+			return handler(ctx, req)
+		})
+		go server.Run()
+		defer server.Close()
+		infos[i] = &model.ServiceInfo{ServiceName: "BreakerArith", ServiceHost: "0.0.0.0", ServicePort: int32(3339 + i)}
+		serviceMgr.RegisterServiceInfo(infos[i])
+	}
+	time.Sleep(time.Second)
+	rpcClient := evolving_client.NewDistributedRpcClient([]*model.EvolvingClientConfig{{
+		EvolvingServerHost: "0.0.0.0",
+		EvolvingServerPort: 6618,
+		HeartbeatInterval:  5 * time.Minute,
+	}}, []string{"BreakerArith"})
+	defer rpcClient.Close()
+	var lock sync.Mutex
+	var changes []string
+	rpcClient.SetCircuitBreaker(&evolving_client.CircuitBreakerConfig{
+		WindowSize:       4,
+		MinRequests:      4,
+		SlowCallDuration: 200 * time.Millisecond,
+		OpenDuration:     300 * time.Millisecond,
+		OnStateChange: func(addr, command string, from, to contents.CircuitState) {
+			lock.Lock()
+			defer lock.Unlock()
+			changes = append(changes, fmt.Sprintf("%s %s %s->%s", addr, command, from, to))
+		},
+	})
+	call := func(n int) (failed int) {
+		for i := 0; i < n; i++ {
+			var reply ArithReply
+			if err := rpcClient.Call(context.Background(), "BreakerArith", "Arith.Multiply", &ArithReq{A: 2, B: 3}, &reply); err != nil {
+				failed++
+			}
+		}
+		return failed
+	}
+
+	//  坏掉的实例失败4次后熔断，之后的调用都发给另一个实例
+	if failed := call(8); failed != 4 {
+		t.Errorf("%d of 8 calls failed before circuit open", failed)
+	}
+	if state := rpcClient.CircuitState(infos[1].Addr(), "Arith.Multiply"); state != contents.CircuitOpen {
+		t.Fatalf("circuit is %s", state)
+	}
+	if failed := call(10); failed != 0 || atomic.LoadInt64(&calls[1]) != 4 {
+		t.Errorf("%d of 10 calls failed after circuit open,broken instance got %d calls", failed, atomic.LoadInt64(&calls[1]))
+	}
+	//  其它方法不受影响
+	if state := rpcClient.CircuitState(infos[1].Addr(), "Arith.Divide"); state != contents.CircuitClosed {
+		t.Errorf("circuit of other method is %s", state)
+	}
+	//  实例恢复后半开探测成功，重新接收调用
+	atomic.StoreInt64(&broken, 0)
+	time.Sleep(400 * time.Millisecond)
+	if failed := call(10); failed != 0 || atomic.LoadInt64(&calls[1]) == 4 {
+		t.Errorf("%d of 10 calls failed after recovery,recovered instance got %d calls", failed, atomic.LoadInt64(&calls[1]))
+	}
+	addr := infos[1].Addr()
+	want := []string{addr + " Arith.Multiply CLOSED->OPEN", addr + " Arith.Multiply OPEN->HALF_OPEN", addr + " Arith.Multiply HALF_OPEN->CLOSED"}
+	lock.Lock()
+	if fmt.Sprint(changes) != fmt.Sprint(want) {
+		t.Errorf("state changes %v", changes)
+	}
+	lock.Unlock()
+	//  慢调用比例达到阈值后所有实例都熔断，调用直接失败
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var done bool
+			_ = rpcClient.Call(context.Background(), "BreakerArith", "Arith.Sleep", 250*time.Millisecond, &done)
+		}()
+	}
+	wg.Wait()
+	var done bool
+	if err := rpcClient.Call(context.Background(), "BreakerArith", "Arith.Sleep", time.Millisecond, &done); !errors.Is(err, errorx.New(errorx.Unavailable, "")) {
+		t.Errorf("slow calls did not open circuits,err:%v", err)
+	}
+}
+
+func TestHedgedRequests(t *testing.T) {
+	registerCenter := evolving_server.NewEvolvingServer(&model.EvolvingServerConf{
+		BindHost:   "0.0.0.0",
+		ServerPort: 6619,
+	})
+	serviceMgr := registerCenter.EnableRegistry()
+	go registerCenter.Start()
+	defer registerCenter.Close()
+	//  2个服务实例，第一个处理Arith.Multiply很慢，记录被调用方取消的调用
+	var canceled int64
+	for i := 0; i < 2; i++ {
+		i := i
+		server := evolving_server.NewDirectlyRpcServer(&evolving_server.DirectlyRpcServerConfig{EvolvingServerConf: model.EvolvingServerConf{
+			BindHost:   "0.0.0.0",
+			ServerPort: int32(3341 + i),
+		}})
+		_ = server.Register(new(Arith))
+		server.Use(func(ctx context.Context, command string, req any, handler evolving_server.RpcHandler) (any, error) {
+			if i == 0 && command == "Arith.Multiply" {
+				select {
+				case <-time.After(500 * time.Millisecond):
+				case <-ctx.Done():
+					atomic.AddInt64(&canceled, 1)
+					return nil, ctx.Err()
+				}
+			}
+			return handler(ctx, req)
+		})
+		go server.Run()
+		defer server.Close()
+		serviceMgr.RegisterServiceInfo(&model.ServiceInfo{ServiceName: "HedgeArith", ServiceHost: "0.0.0.0", ServicePort: int32(3341 + i)})
+	}
+	time.Sleep(time.Second)
+	rpcClient := evolving_client.NewDistributedRpcClient([]*model.EvolvingClientConfig{{
+		EvolvingServerHost: "0.0.0.0",
+		EvolvingServerPort: 6619,
+		HeartbeatInterval:  5 * time.Minute,
+	}}, []string{"HedgeArith"})
+	defer rpcClient.Close()
+	call := func(n int) (slowest time.Duration) {
+		for i := 0; i < n; i++ {
+			var reply ArithReply
+			start := time.Now()
+			if err := rpcClient.Call(context.Background(), "HedgeArith", "Arith.Multiply", &ArithReq{A: 2, B: 3}, &reply); err != nil || reply.Pro != 6 {
+				t.Fatalf("reply %v,err:%v", reply, err)
+			}
+			if elapsed := time.Since(start); elapsed > slowest {
+				slowest = elapsed
+			}
+		}
+		return slowest
+	}
+
+	//  没有开启对冲调用时发给慢的实例要等它处理完
+	if slowest := call(4); slowest < 500*time.Millisecond {
+		t.Errorf("slowest call without hedging took %v", slowest)
+	}
+	//  开启后慢的实例没有及时回复时发给另一个实例，慢的实例收到取消
+	rpcClient.SetHedgingPolicy("HedgeArith", "Arith.Multiply", &evolving_client.HedgingPolicy{MaxDelay: 50 * time.Millisecond})
+	if slowest := call(6); slowest > 300*time.Millisecond {
+		t.Errorf("slowest call with hedging took %v", slowest)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if n := atomic.LoadInt64(&canceled); n == 0 {
+		t.Errorf("slow instance got %d cancels", n)
+	}
+}